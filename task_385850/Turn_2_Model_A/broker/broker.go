@@ -0,0 +1,301 @@
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPending bounds the unacknowledged messages kept per subscription.
+	maxPending   = 1024
+	writeTimeout = 5 * time.Second
+	// maxQueued bounds the frames waiting to be written to one connection.
+	// It holds a full backlog, so a resubscribe never overflows it.
+	maxQueued = 2 * maxPending
+)
+
+// Broker routes published messages to every subscription on their topic.
+//
+// Subscriptions are durable by name: messages not yet acknowledged are kept and
+// redelivered when a subscriber reconnects under the same name. Subscribers that
+// do not give a name get a subscription that is discarded when they disconnect.
+type Broker struct {
+	mu     sync.Mutex
+	topics map[string]map[string]*subscription
+	ln     net.Listener
+	conns  map[*conn]struct{}
+	closed bool
+	nextID int
+	wg     sync.WaitGroup
+}
+
+type subscription struct {
+	name      string
+	ephemeral bool
+	pending   []*Frame
+	conn      *conn
+}
+
+// conn is a client connection. Frames for it are queued and written by its
+// own writer, so a slow client never holds up a publisher.
+type conn struct {
+	nc   net.Conn
+	out  chan *Frame
+	done chan struct{}
+}
+
+func newConn(nc net.Conn) *conn {
+	return &conn{nc: nc, out: make(chan *Frame, maxQueued), done: make(chan struct{})}
+}
+
+// send queues f without blocking. A connection too far behind to take it
+// is closed; its subscriptions keep their pending messages until it
+// reconnects.
+func (c *conn) send(f *Frame) {
+	select {
+	case c.out <- f:
+	default:
+		log.Printf("Broker: %s is not keeping up, disconnecting", c.nc.RemoteAddr())
+		c.nc.Close()
+	}
+}
+
+func (c *conn) writeLoop() {
+	for {
+		select {
+		case f := <-c.out:
+			c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := writeFrame(c.nc, f); err != nil {
+				log.Printf("Broker: error writing to %s: %v", c.nc.RemoteAddr(), err)
+				c.nc.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// New creates a broker with no topics.
+func New() *Broker {
+	return &Broker{
+		topics: make(map[string]map[string]*subscription),
+		conns:  make(map[*conn]struct{}),
+	}
+}
+
+// ListenAndServe listens on addr and serves clients until Close is called.
+func (b *Broker) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return b.Serve(ln)
+}
+
+// Serve accepts clients on ln until Close is called.
+func (b *Broker) Serve(ln net.Listener) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		ln.Close()
+		return net.ErrClosed
+	}
+	b.ln = ln
+	b.mu.Unlock()
+
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			b.mu.Lock()
+			closed := b.closed
+			b.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		c := newConn(nc)
+		b.mu.Lock()
+		if b.closed {
+			// Accepted as Close ran; it will not see this connection
+			b.mu.Unlock()
+			nc.Close()
+			return nil
+		}
+		b.conns[c] = struct{}{}
+		// Added under the lock, so Close cannot be waiting already
+		b.wg.Add(2)
+		b.mu.Unlock()
+
+		go func() {
+			defer b.wg.Done()
+			c.writeLoop()
+		}()
+		go func() {
+			defer b.wg.Done()
+			b.handleConn(c)
+		}()
+	}
+}
+
+// Addr returns the listening address, or nil before Serve is called.
+func (b *Broker) Addr() net.Addr {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ln == nil {
+		return nil
+	}
+	return b.ln.Addr()
+}
+
+// Close stops accepting clients, disconnects the connected ones and waits
+// for their handlers to return.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	var err error
+	if b.ln != nil {
+		err = b.ln.Close()
+	}
+	for c := range b.conns {
+		c.nc.Close()
+	}
+	b.mu.Unlock()
+
+	b.wg.Wait()
+	return err
+}
+
+func (b *Broker) handleConn(c *conn) {
+	defer b.disconnect(c)
+
+	reader := bufio.NewReader(c.nc)
+	for {
+		f, err := readFrame(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Broker: error reading from %s: %v", c.nc.RemoteAddr(), err)
+			}
+			return
+		}
+
+		switch f.Op {
+		case OpPublish:
+			b.publish(c, f)
+		case OpSubscribe:
+			b.subscribe(c, f)
+		case OpAck:
+			b.ack(c, f)
+		default:
+			c.send(&Frame{Op: OpError, ID: f.ID, Error: fmt.Sprintf("unknown op %q", f.Op)})
+		}
+	}
+}
+
+func (b *Broker) publish(c *conn, f *Frame) {
+	if f.Topic == "" {
+		c.send(&Frame{Op: OpError, ID: f.ID, Error: "missing topic"})
+		return
+	}
+
+	deliver := &Frame{Op: OpDeliver, Topic: f.Topic, ID: f.ID, Payload: f.Payload}
+	b.mu.Lock()
+	for _, sub := range b.topics[f.Topic] {
+		if len(sub.pending) >= maxPending {
+			log.Printf("Broker: subscription %s/%s full, dropping %s", f.Topic, sub.name, sub.pending[0].ID)
+			sub.pending = sub.pending[1:]
+		}
+		sub.pending = append(sub.pending, deliver)
+		// Queued under the lock, so it cannot overtake a resubscribe's
+		// backlog. A delivery that never makes it stays pending and is
+		// redelivered when the subscriber reconnects.
+		if sub.conn != nil {
+			sub.conn.send(deliver)
+		}
+	}
+	b.mu.Unlock()
+	c.send(&Frame{Op: OpOK, ID: f.ID})
+}
+
+func (b *Broker) subscribe(c *conn, f *Frame) {
+	if f.Topic == "" {
+		c.send(&Frame{Op: OpError, Error: "missing topic"})
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subs := b.topics[f.Topic]
+	if subs == nil {
+		subs = make(map[string]*subscription)
+		b.topics[f.Topic] = subs
+	}
+	name := f.Subscriber
+	ephemeral := name == ""
+	if ephemeral {
+		b.nextID++
+		name = fmt.Sprintf("~%d", b.nextID)
+	}
+	sub := subs[name]
+	if sub == nil {
+		sub = &subscription{name: name, ephemeral: ephemeral}
+		subs[name] = sub
+	}
+	sub.conn = c
+	// Queued under the lock, so concurrent publishes cannot overtake the
+	// OK or the redelivered messages.
+	c.send(&Frame{Op: OpOK, Topic: f.Topic, Subscriber: name})
+	for _, deliver := range sub.pending {
+		c.send(deliver)
+	}
+}
+
+// ack removes an acknowledged message. Only the connection currently
+// holding the subscription may acknowledge its messages.
+func (b *Broker) ack(c *conn, f *Frame) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub := b.topics[f.Topic][f.Subscriber]
+	if sub == nil || sub.conn != c {
+		log.Printf("Broker: %s acked %s for subscription %s/%s it does not hold", c.nc.RemoteAddr(), f.ID, f.Topic, f.Subscriber)
+		return
+	}
+	for i, pending := range sub.pending {
+		if pending.ID == f.ID {
+			sub.pending = append(sub.pending[:i], sub.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+func (b *Broker) disconnect(c *conn) {
+	c.nc.Close()
+	close(c.done)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.conns, c)
+	for topic, subs := range b.topics {
+		for name, sub := range subs {
+			if sub.conn != c {
+				continue
+			}
+			sub.conn = nil
+			if sub.ephemeral {
+				delete(subs, name)
+			}
+		}
+		if len(subs) == 0 {
+			delete(b.topics, topic)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package broker
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"myapp/message"
+)
+
+func startBroker(t *testing.T) (*Broker, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	b := New()
+	go b.Serve(ln)
+	t.Cleanup(func() { b.Close() })
+	return b, ln.Addr().String()
+}
+
+func receive(t *testing.T, sub *Subscriber) message.Message {
+	t.Helper()
+	select {
+	case msg, ok := <-sub.C():
+		if !ok {
+			t.Fatal("Subscriber channel closed")
+		}
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for a message")
+	}
+	return message.Message{}
+}
+
+func TestFanOutToSubscribers(t *testing.T) {
+	_, addr := startBroker(t)
+
+	var subs []*Subscriber
+	for _, name := range []string{"a", "b"} {
+		sub, err := Subscribe(addr, "numbers", name)
+		if err != nil {
+			t.Fatalf("Subscribe(%s) failed: %v", name, err)
+		}
+		defer sub.Close()
+		subs = append(subs, sub)
+	}
+
+	pub, err := DialPublisher(addr)
+	if err != nil {
+		t.Fatalf("DialPublisher failed: %v", err)
+	}
+	defer pub.Close()
+
+	for i := 1; i <= 3; i++ {
+		if err := pub.Publish("numbers", message.Message{ID: strconv.Itoa(i), Value: i}); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+	}
+	if err := pub.Publish("other", message.Message{ID: "x", Value: 99}); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	for _, sub := range subs {
+		for i := 1; i <= 3; i++ {
+			if msg := receive(t, sub); msg.Value != i {
+				t.Errorf("Subscriber %s: expected %d, got %d", sub.name, i, msg.Value)
+			}
+		}
+	}
+}
+
+func TestUnackedMessagesAreRedelivered(t *testing.T) {
+	_, addr := startBroker(t)
+
+	sub, err := Subscribe(addr, "numbers", "durable")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	pub, err := DialPublisher(addr)
+	if err != nil {
+		t.Fatalf("DialPublisher failed: %v", err)
+	}
+	defer pub.Close()
+
+	pub.Publish("numbers", message.Message{ID: "1", Value: 1})
+	pub.Publish("numbers", message.Message{ID: "2", Value: 2})
+
+	if msg := receive(t, sub); msg.ID != "1" {
+		t.Fatalf("Expected message 1, got %s", msg.ID)
+	}
+	sub.Ack("1")
+	receive(t, sub)
+	sub.Close()
+
+	// Let the broker notice the disconnect before publishing again.
+	time.Sleep(50 * time.Millisecond)
+	pub.Publish("numbers", message.Message{ID: "3", Value: 3})
+
+	sub, err = Subscribe(addr, "numbers", "durable")
+	if err != nil {
+		t.Fatalf("Resubscribe failed: %v", err)
+	}
+	defer sub.Close()
+
+	for _, want := range []string{"2", "3"} {
+		if msg := receive(t, sub); msg.ID != want {
+			t.Errorf("Expected redelivery of %s, got %s", want, msg.ID)
+		}
+	}
+}
+
+func TestPublishWithoutTopicIsRejected(t *testing.T) {
+	_, addr := startBroker(t)
+
+	pub, err := DialPublisher(addr)
+	if err != nil {
+		t.Fatalf("DialPublisher failed: %v", err)
+	}
+	defer pub.Close()
+
+	if err := pub.Publish("", message.Message{ID: "1"}); err == nil {
+		t.Error("Expected publish without a topic to fail")
+	}
+}
+
+func TestStalledSubscriberDoesNotBlockPublisher(t *testing.T) {
+	_, addr := startBroker(t)
+
+	// A subscriber that never reads its deliveries.
+	stalled, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer stalled.Close()
+	if err := writeFrame(stalled, &Frame{Op: OpSubscribe, Topic: "numbers", Subscriber: "stalled"}); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	sub, err := Subscribe(addr, "numbers", "live")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer sub.Close()
+
+	pub, err := DialPublisher(addr)
+	if err != nil {
+		t.Fatalf("DialPublisher failed: %v", err)
+	}
+	defer pub.Close()
+
+	// Far more than the socket buffers hold, so a synchronous write to the
+	// stalled subscriber would block.
+	pad := strings.Repeat("x", 64*1024)
+	done := make(chan error, 1)
+	go func() {
+		for i := 1; i <= 100; i++ {
+			if err := pub.Publish("numbers", message.Message{ID: strconv.Itoa(i) + pad, Value: i}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 1; i <= 100; i++ {
+		msg := receive(t, sub)
+		if msg.Value != i {
+			t.Fatalf("Expected %d, got %d", i, msg.Value)
+		}
+		sub.Ack(msg.ID)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Publisher blocked by a stalled subscriber")
+	}
+}
+
+func TestAckFromAnotherConnectionIsIgnored(t *testing.T) {
+	_, addr := startBroker(t)
+
+	sub, err := Subscribe(addr, "numbers", "durable")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	pub, err := DialPublisher(addr)
+	if err != nil {
+		t.Fatalf("DialPublisher failed: %v", err)
+	}
+	defer pub.Close()
+
+	pub.Publish("numbers", message.Message{ID: "1", Value: 1})
+	receive(t, sub)
+
+	other, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer other.Close()
+	if err := writeFrame(other, &Frame{Op: OpAck, Topic: "numbers", Subscriber: "durable", ID: "1"}); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	sub.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	sub, err = Subscribe(addr, "numbers", "durable")
+	if err != nil {
+		t.Fatalf("Resubscribe failed: %v", err)
+	}
+	defer sub.Close()
+	if msg := receive(t, sub); msg.ID != "1" {
+		t.Errorf("Expected redelivery of 1, got %s", msg.ID)
+	}
+}
+
+// lateListener hands out one connection only once it is closed, as if it
+// had been accepted at the same moment the broker shut down.
+type lateListener struct {
+	net.Listener
+	closed chan struct{}
+	conn   net.Conn
+}
+
+func (l *lateListener) Accept() (net.Conn, error) {
+	<-l.closed
+	if l.conn != nil {
+		c := l.conn
+		l.conn = nil
+		return c, nil
+	}
+	return nil, net.ErrClosed
+}
+
+func (l *lateListener) Close() error {
+	close(l.closed)
+	return nil
+}
+
+func TestConnAcceptedDuringCloseIsClosed(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	b := New()
+	served := make(chan error, 1)
+	go func() { served <- b.Serve(&lateListener{closed: make(chan struct{}), conn: server}) }()
+	for {
+		b.mu.Lock()
+		serving := b.ln != nil
+		b.mu.Unlock()
+		if serving {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		b.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return")
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Expected Serve to return nil after Close, got %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Errorf("Expected the late connection to be closed, got %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"myapp/message"
+)
+
+const dialTimeout = 5 * time.Second
+
+// Publisher publishes messages to a broker over a single connection.
+type Publisher struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// DialPublisher connects a publisher to the broker at addr.
+func DialPublisher(addr string) (*Publisher, error) {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Publisher{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// Publish sends msg to topic and waits for the broker to confirm it.
+func (p *Publisher) Publish(topic string, msg message.Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.conn.SetDeadline(time.Now().Add(writeTimeout))
+	if err := writeFrame(p.conn, &Frame{Op: OpPublish, Topic: topic, ID: msg.ID, Payload: payload}); err != nil {
+		return err
+	}
+	reply, err := readFrame(p.reader)
+	if err != nil {
+		return err
+	}
+	if reply.Op != OpOK {
+		return fmt.Errorf("broker rejected publish: %s", reply.Error)
+	}
+	return nil
+}
+
+// Close closes the connection to the broker.
+func (p *Publisher) Close() error {
+	return p.conn.Close()
+}
+
+// Subscriber receives the messages published to one topic. Each received
+// message must be acknowledged with Ack, otherwise the broker redelivers it
+// the next time a subscriber connects under the same name.
+type Subscriber struct {
+	topic string
+	name  string
+	conn  net.Conn
+	ch    chan message.Message
+	done  chan struct{}
+	once  sync.Once
+
+	mu sync.Mutex
+}
+
+// Subscribe connects to the broker at addr and subscribes to topic under name.
+// An empty name creates a subscription that is discarded on disconnect.
+func Subscribe(addr, topic, name string) (*Subscriber, error) {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(writeTimeout))
+	if err := writeFrame(conn, &Frame{Op: OpSubscribe, Topic: topic, Subscriber: name}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	reply, err := readFrame(reader)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reply.Op != OpOK {
+		conn.Close()
+		return nil, fmt.Errorf("broker rejected subscribe: %s", reply.Error)
+	}
+	conn.SetDeadline(time.Time{})
+
+	s := &Subscriber{
+		topic: topic,
+		name:  reply.Subscriber,
+		conn:  conn,
+		ch:    make(chan message.Message, 64),
+		done:  make(chan struct{}),
+	}
+	go s.receive(reader)
+	return s, nil
+}
+
+func (s *Subscriber) receive(reader *bufio.Reader) {
+	defer close(s.ch)
+	for {
+		f, err := readFrame(reader)
+		if err != nil {
+			return
+		}
+		if f.Op != OpDeliver {
+			continue
+		}
+		var msg message.Message
+		if err := json.Unmarshal(f.Payload, &msg); err != nil {
+			log.Printf("Subscriber: invalid payload for %s: %v", f.ID, err)
+			continue
+		}
+		select {
+		case s.ch <- msg:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// C returns the channel messages are delivered on. It is closed when the
+// connection to the broker ends.
+func (s *Subscriber) C() <-chan message.Message {
+	return s.ch
+}
+
+// Ack tells the broker that the message with the given ID has been handled.
+func (s *Subscriber) Ack(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return writeFrame(s.conn, &Frame{Op: OpAck, Topic: s.topic, Subscriber: s.name, ID: id})
+}
+
+// Close closes the connection to the broker.
+func (s *Subscriber) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return s.conn.Close()
+}
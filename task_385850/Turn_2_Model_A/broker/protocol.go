@@ -0,0 +1,74 @@
+// Package broker implements a small topic-based pub/sub broker over TCP, so that
+// producers and consumers can run as separate processes.
+//
+// Every frame on the wire is a 4-byte big-endian length followed by a JSON-encoded Frame.
+package broker
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+const maxFrameSize = 1024 * 1024 // 1MB
+
+// Op identifies the kind of frame.
+type Op string
+
+const (
+	// OpPublish is sent by publishers; the broker answers with OpOK or OpError.
+	OpPublish Op = "publish"
+	// OpSubscribe is sent by subscribers; the broker answers with OpOK or OpError.
+	OpSubscribe Op = "subscribe"
+	// OpAck is sent by subscribers once a delivered message has been handled.
+	OpAck Op = "ack"
+	// OpDeliver carries a published message from the broker to a subscriber.
+	OpDeliver Op = "deliver"
+	// OpOK confirms a publish or subscribe.
+	OpOK Op = "ok"
+	// OpError rejects a publish or subscribe.
+	OpError Op = "error"
+)
+
+// Frame is a single protocol message.
+type Frame struct {
+	Op         Op              `json:"op"`
+	Topic      string          `json:"topic,omitempty"`
+	Subscriber string          `json:"subscriber,omitempty"`
+	ID         string          `json:"id,omitempty"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+func writeFrame(w io.Writer, f *Frame) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	_, err = w.Write(buf)
+	return err
+}
+
+func readFrame(r io.Reader) (*Frame, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length > maxFrameSize {
+		return nil, fmt.Errorf("frame too large: %d bytes", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	f := &Frame{}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"myapp/broker"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:7070", "address to listen on")
+	flag.Parse()
+
+	b := broker.New()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		log.Println("Received interrupt signal, shutting down...")
+		b.Close()
+	}()
+
+	log.Printf("Broker listening on %s", *addr)
+	if err := b.ListenAndServe(*addr); err != nil {
+		log.Fatalf("Error serving: %v", err)
+	}
+	log.Println("Shutdown complete")
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"myapp/broker"
+	"myapp/dedup"
+)
+
+func main() {
+	addr := flag.String("broker", "localhost:7070", "broker address")
+	topic := flag.String("topic", "numbers", "topic to subscribe to")
+	name := flag.String("name", "consumer", "durable subscription name")
+	dedupPath := flag.String("dedup", "dedup.log", "dedup store file")
+	flag.Parse()
+
+	store, err := dedup.OpenFileStore(*dedupPath, 24*time.Hour)
+	if err != nil {
+		log.Fatalf("Error opening dedup store: %v", err)
+	}
+	defer store.Close()
+	filter := dedup.NewFilter(store)
+
+	sub, err := broker.Subscribe(*addr, *topic, *name)
+	if err != nil {
+		log.Fatalf("Error subscribing: %v", err)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		sub.Close()
+	}()
+
+	for msg := range sub.C() {
+		_, err := filter.Handle(msg.ID, func() error {
+			fmt.Println("Consumed:", msg.Value)
+			return nil
+		})
+		if err != nil {
+			// Left unacked, so the broker redelivers it for another try.
+			log.Printf("Message %s: %v", msg.ID, err)
+			continue
+		}
+		// Duplicates are acked too, so the broker stops redelivering them.
+		if err := sub.Ack(msg.ID); err != nil {
+			log.Printf("Error acking %s: %v", msg.ID, err)
+		}
+	}
+	log.Printf("Dedup: %+v", filter.Stats())
+}
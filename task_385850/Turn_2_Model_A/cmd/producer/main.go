@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"myapp/broker"
+	"myapp/message"
+	"myapp/producer"
+	"myapp/queue"
+)
+
+func main() {
+	addr := flag.String("broker", "localhost:7070", "broker address")
+	topic := flag.String("topic", "numbers", "topic to publish to")
+	flag.Parse()
+
+	pub, err := broker.DialPublisher(*addr)
+	if err != nil {
+		log.Fatalf("Error connecting to broker: %v", err)
+	}
+	defer pub.Close()
+
+	// The queue absorbs broker hiccups; if it fills up the oldest readings are shed.
+	q := queue.New(queue.Config[message.Message]{
+		Capacity: 16,
+		Policy:   queue.DropOldest,
+		OnDrop: func(msg message.Message) {
+			log.Printf("Dropped: %s", msg.ID)
+		},
+	})
+	go producer.ProduceTo(q, message.NewIDGenerator("producer"))
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		q.Close()
+	}()
+
+	for msg := range q.C() {
+		if err := pub.Publish(*topic, msg); err != nil {
+			log.Fatalf("Error publishing %s: %v", msg.ID, err)
+		}
+	}
+	log.Printf("Queue: %+v", q.Stats())
+}
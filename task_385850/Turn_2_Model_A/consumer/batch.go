@@ -0,0 +1,128 @@
+package consumer
+
+import (
+	"sync"
+	"time"
+)
+
+// BatchConfig configures a Batcher.
+type BatchConfig struct {
+	// MaxSize flushes the batch once it holds this many items.
+	MaxSize int
+	// MaxWait flushes a non-empty batch this long after its first item arrived.
+	MaxWait time.Duration
+	// Flush writes a batch to storage. The slice is not reused after Flush returns.
+	Flush func(batch []int) error
+}
+
+// BatchStats summarises the batches flushed so far.
+type BatchStats struct {
+	Batches      uint64
+	Items        uint64
+	Failed       uint64
+	MinSize      int
+	MaxSize      int
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+}
+
+// AvgSize returns the mean number of items per batch.
+func (s BatchStats) AvgSize() float64 {
+	if s.Batches == 0 {
+		return 0
+	}
+	return float64(s.Items) / float64(s.Batches)
+}
+
+// AvgLatency returns the mean time spent in Flush.
+func (s BatchStats) AvgLatency() time.Duration {
+	if s.Batches == 0 {
+		return 0
+	}
+	return s.TotalLatency / time.Duration(s.Batches)
+}
+
+// Batcher groups consumed items into batches that are flushed when they reach
+// MaxSize items or when MaxWait elapses, whichever comes first.
+type Batcher struct {
+	cfg BatchConfig
+
+	mu    sync.Mutex
+	stats BatchStats
+}
+
+// NewBatcher creates a Batcher. A MaxSize below 1 is treated as 1.
+func NewBatcher(cfg BatchConfig) *Batcher {
+	if cfg.MaxSize < 1 {
+		cfg.MaxSize = 1
+	}
+	return &Batcher{cfg: cfg}
+}
+
+// Consume receives numbers from the channel and flushes them in batches.
+// When the channel is closed the remaining partial batch is flushed before returning.
+func (b *Batcher) Consume(ch <-chan int) {
+	batch := make([]int, 0, b.cfg.MaxSize)
+	timer := time.NewTimer(b.cfg.MaxWait)
+	timer.Stop()
+
+	flush := func() {
+		timer.Stop()
+		if len(batch) == 0 {
+			return
+		}
+		b.flush(batch)
+		batch = make([]int, 0, b.cfg.MaxSize)
+	}
+
+	for {
+		select {
+		case num, ok := <-ch:
+			if !ok {
+				flush()
+				return
+			}
+			if len(batch) == 0 {
+				timer.Reset(b.cfg.MaxWait)
+			}
+			batch = append(batch, num)
+			if len(batch) >= b.cfg.MaxSize {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+func (b *Batcher) flush(batch []int) {
+	start := time.Now()
+	err := b.cfg.Flush(batch)
+	latency := time.Since(start)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := &b.stats
+	s.Batches++
+	s.Items += uint64(len(batch))
+	if err != nil {
+		s.Failed++
+	}
+	if s.MinSize == 0 || len(batch) < s.MinSize {
+		s.MinSize = len(batch)
+	}
+	if len(batch) > s.MaxSize {
+		s.MaxSize = len(batch)
+	}
+	s.TotalLatency += latency
+	if latency > s.MaxLatency {
+		s.MaxLatency = latency
+	}
+}
+
+// Stats returns a snapshot of the batch statistics.
+func (b *Batcher) Stats() BatchStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats
+}
@@ -0,0 +1,94 @@
+package consumer
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	mu      sync.Mutex
+	batches [][]int
+}
+
+func (r *recorder) flush(batch []int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batches = append(r.batches, batch)
+	return nil
+}
+
+func (r *recorder) get() [][]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.batches
+}
+
+func TestBatcherFlushesOnSize(t *testing.T) {
+	rec := &recorder{}
+	b := NewBatcher(BatchConfig{MaxSize: 3, MaxWait: time.Hour, Flush: rec.flush})
+
+	ch := make(chan int)
+	done := make(chan struct{})
+	go func() {
+		b.Consume(ch)
+		close(done)
+	}()
+	for i := 1; i <= 7; i++ {
+		ch <- i
+	}
+	close(ch)
+	<-done
+
+	got := rec.get()
+	if len(got) != 3 || len(got[0]) != 3 || len(got[1]) != 3 || len(got[2]) != 1 {
+		t.Fatalf("Expected batches of 3, 3 and a final 1, got %v", got)
+	}
+	if got[2][0] != 7 {
+		t.Errorf("Expected partial batch [7], got %v", got[2])
+	}
+
+	s := b.Stats()
+	if s.Batches != 3 || s.Items != 7 || s.MinSize != 1 || s.MaxSize != 3 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+}
+
+func TestBatcherFlushesOnTime(t *testing.T) {
+	rec := &recorder{}
+	b := NewBatcher(BatchConfig{MaxSize: 100, MaxWait: 20 * time.Millisecond, Flush: rec.flush})
+
+	ch := make(chan int)
+	go b.Consume(ch)
+	defer close(ch)
+
+	ch <- 1
+	ch <- 2
+	deadline := time.Now().Add(time.Second)
+	for len(rec.get()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Batch was not flushed after MaxWait")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := rec.get(); len(got[0]) != 2 {
+		t.Errorf("Expected a batch of 2, got %v", got)
+	}
+}
+
+func TestBatcherCountsFailures(t *testing.T) {
+	b := NewBatcher(BatchConfig{MaxSize: 1, Flush: func([]int) error {
+		return errors.New("storage unavailable")
+	}})
+
+	ch := make(chan int, 2)
+	ch <- 1
+	ch <- 2
+	close(ch)
+	b.Consume(ch)
+
+	if s := b.Stats(); s.Failed != 2 || s.Batches != 2 {
+		t.Errorf("Expected 2 failed batches, got %+v", s)
+	}
+}
@@ -2,11 +2,25 @@ package consumer
 
 import (
 	"fmt"
+	"log"
+
+	"myapp/dedup"
+	"myapp/message"
 )
 
 // Consume receives numbers from the channel and prints them
-func Consume(ch chan int) {
+func Consume(ch <-chan int) {
 	for num := range ch {
 		fmt.Println("Consumed:", num)
 	}
-}
\ No newline at end of file
+}
+
+// ConsumeMessages passes each message to handle through the dedup filter,
+// so a redelivered message is never handled again, even if its handler failed.
+func ConsumeMessages(ch <-chan message.Message, filter *dedup.Filter, handle func(message.Message) error) {
+	for msg := range ch {
+		if _, err := filter.Handle(msg.ID, func() error { return handle(msg) }); err != nil {
+			log.Printf("Message %s: %v", msg.ID, err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Package dedup suppresses redelivered messages so that handlers run at most once per ID.
+package dedup
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Store remembers message IDs for a bounded window.
+type Store interface {
+	// Seen reports whether id was recorded within the window.
+	Seen(id string) (bool, error)
+	// Add records id and reports whether it had not been seen within the window.
+	Add(id string) (bool, error)
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// MemoryStore is an in-memory Store whose entries expire after a TTL.
+type MemoryStore struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewMemoryStore creates a store that remembers IDs for ttl.
+func NewMemoryStore(ttl time.Duration) *MemoryStore {
+	return &MemoryStore{
+		ttl:  ttl,
+		now:  time.Now,
+		seen: make(map[string]time.Time),
+	}
+}
+
+// Seen implements Store.
+func (s *MemoryStore) Seen(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seenAt(id, s.now()), nil
+}
+
+func (s *MemoryStore) seenAt(id string, at time.Time) bool {
+	seenAt, ok := s.seen[id]
+	return ok && at.Sub(seenAt) < s.ttl
+}
+
+// Add implements Store.
+func (s *MemoryStore) Add(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.add(id, s.now()), nil
+}
+
+func (s *MemoryStore) add(id string, at time.Time) bool {
+	s.sweep(at)
+	if s.seenAt(id, at) {
+		return false
+	}
+	s.seen[id] = at
+	return true
+}
+
+// sweep drops expired entries, at most once per TTL so Add stays cheap.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < s.ttl {
+		return
+	}
+	for id, seenAt := range s.seen {
+		if now.Sub(seenAt) >= s.ttl {
+			delete(s.seen, id)
+		}
+	}
+	s.lastSweep = now
+}
+
+// Len returns the number of IDs currently remembered.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.seen)
+}
+
+// Close implements Store.
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// Stats counts the messages seen by a Filter.
+type Stats struct {
+	Processed  uint64
+	Duplicates uint64
+	Failed     uint64
+}
+
+// Filter runs handlers only for message IDs its store has not seen before.
+type Filter struct {
+	store Store
+
+	processed  atomic.Uint64
+	duplicates atomic.Uint64
+	failed     atomic.Uint64
+}
+
+// NewFilter creates a Filter backed by store.
+func NewFilter(store Store) *Filter {
+	return &Filter{store: store}
+}
+
+// Handle calls fn unless id was already recorded, and reports whether fn ran.
+// The ID is recorded before fn is called, so fn runs at most once per ID: a
+// duplicate arriving while fn runs is suppressed, and a message whose handler
+// failed, or whose process died while it ran, is not handled again when it is
+// redelivered. Such failures are counted in Stats.Failed.
+func (f *Filter) Handle(id string, fn func() error) (bool, error) {
+	fresh, err := f.store.Add(id)
+	if err != nil {
+		return false, err
+	}
+	if !fresh {
+		f.duplicates.Add(1)
+		return false, nil
+	}
+	if err := fn(); err != nil {
+		f.failed.Add(1)
+		return true, err
+	}
+	f.processed.Add(1)
+	return true, nil
+}
+
+// Stats returns the filter counters.
+func (f *Filter) Stats() Stats {
+	return Stats{
+		Processed:  f.processed.Load(),
+		Duplicates: f.duplicates.Load(),
+		Failed:     f.failed.Load(),
+	}
+}
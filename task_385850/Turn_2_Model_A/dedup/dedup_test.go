@@ -0,0 +1,154 @@
+package dedup
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreTTL(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := NewMemoryStore(time.Minute)
+	s.now = func() time.Time { return now }
+
+	if fresh, _ := s.Add("a"); !fresh {
+		t.Fatal("Expected first Add to be fresh")
+	}
+	if fresh, _ := s.Add("a"); fresh {
+		t.Fatal("Expected second Add within TTL to be a duplicate")
+	}
+
+	now = now.Add(time.Minute)
+	if fresh, _ := s.Add("a"); !fresh {
+		t.Error("Expected Add after TTL to be fresh")
+	}
+	if s.Len() != 1 {
+		t.Errorf("Expected 1 remembered ID, got %d", s.Len())
+	}
+}
+
+func TestFilterRunsOncePerID(t *testing.T) {
+	f := NewFilter(NewMemoryStore(time.Hour))
+	calls := 0
+	handle := func() error {
+		calls++
+		return nil
+	}
+
+	for _, id := range []string{"a", "b", "a", "a", "c"} {
+		if _, err := f.Handle(id, handle); err != nil {
+			t.Fatalf("Handle(%s) failed: %v", id, err)
+		}
+	}
+
+	if calls != 3 {
+		t.Errorf("Expected 3 handler calls, got %d", calls)
+	}
+	if s := f.Stats(); s.Processed != 3 || s.Duplicates != 2 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+}
+
+func TestFilterDoesNotRetryFailedHandler(t *testing.T) {
+	f := NewFilter(NewMemoryStore(time.Hour))
+	errBoom := errors.New("boom")
+
+	if ran, err := f.Handle("a", func() error { return errBoom }); !ran || err != errBoom {
+		t.Fatalf("Expected handler to run and fail, got ran=%v err=%v", ran, err)
+	}
+	if ran, err := f.Handle("a", func() error { return nil }); ran || err != nil {
+		t.Fatalf("Expected redelivery of a failed message to be suppressed, got ran=%v err=%v", ran, err)
+	}
+	if s := f.Stats(); s.Failed != 1 || s.Processed != 0 || s.Duplicates != 1 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+}
+
+func TestFilterRecordsIDBeforeHandling(t *testing.T) {
+	store := NewMemoryStore(time.Hour)
+	f := NewFilter(store)
+	f.Handle("a", func() error {
+		// A crash here must not lead to the message being handled again
+		if seen, _ := store.Seen("a"); !seen {
+			t.Error("Expected the ID to be recorded before the handler runs")
+		}
+		return nil
+	})
+}
+
+func TestFilterSuppressesInFlightDuplicate(t *testing.T) {
+	f := NewFilter(NewMemoryStore(time.Hour))
+	started, release := make(chan struct{}), make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.Handle("a", func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	if ran, _ := f.Handle("a", func() error { return nil }); ran {
+		t.Error("Expected a duplicate to be suppressed while the first is running")
+	}
+	close(release)
+	<-done
+	if s := f.Stats(); s.Processed != 1 || s.Duplicates != 1 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+}
+
+func TestFileStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.log")
+
+	s, err := OpenFileStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("OpenFileStore failed: %v", err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if fresh, err := s.Add(id); err != nil || !fresh {
+			t.Fatalf("Add(%s): fresh=%v err=%v", id, fresh, err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	s, err = OpenFileStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer s.Close()
+
+	if fresh, _ := s.Add("a"); fresh {
+		t.Error("Expected a to be remembered after restart")
+	}
+	if fresh, _ := s.Add("c"); !fresh {
+		t.Error("Expected c to be fresh")
+	}
+}
+
+func TestFileStoreDropsExpiredEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.log")
+
+	s, err := OpenFileStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("OpenFileStore failed: %v", err)
+	}
+	s.mem.now = func() time.Time { return time.Now().Add(-2 * time.Hour) }
+	s.Add("old")
+	s.Close()
+
+	s, err = OpenFileStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer s.Close()
+
+	if fresh, _ := s.Add("old"); !fresh {
+		t.Error("Expected expired ID to be forgotten after restart")
+	}
+}
@@ -0,0 +1,166 @@
+package dedup
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// compactSlack is how many lines beyond the live entries the log may grow
+// before it is rewritten.
+const compactSlack = 1024
+
+// FileStore is a Store that keeps its window in memory and persists every ID to
+// an append-only log, so duplicates are still suppressed after a restart.
+type FileStore struct {
+	mem      *MemoryStore
+	path     string
+	file     *os.File
+	appended int
+}
+
+// OpenFileStore loads the IDs recorded in path within the last ttl and opens
+// the log for appending. The file is created if it does not exist.
+func OpenFileStore(path string, ttl time.Duration) (*FileStore, error) {
+	s := &FileStore{
+		mem:  NewMemoryStore(ttl),
+		path: path,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := s.mem.now()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		ts, id, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			// A torn final line from a crash mid-write; skip it.
+			continue
+		}
+		nanos, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			continue
+		}
+		if seenAt := time.Unix(0, nanos); now.Sub(seenAt) < s.mem.ttl {
+			s.mem.seen[id] = seenAt
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the log with only the live entries and reopens it for appending.
+// The old log stays in use if anything fails before the rename.
+func (s *FileStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for id, seenAt := range s.mem.seen {
+		fmt.Fprintf(w, "%d %s\n", seenAt.UnixNano(), id)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = file
+	s.appended = 0
+	return nil
+}
+
+// Seen implements Store.
+func (s *FileStore) Seen(id string) (bool, error) {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	if s.file == nil {
+		return false, os.ErrClosed
+	}
+	return s.mem.seenAt(id, s.mem.now()), nil
+}
+
+// Add implements Store. A new ID is synced to disk before Add returns.
+func (s *FileStore) Add(id string) (bool, error) {
+	if strings.ContainsAny(id, " \n") {
+		return false, fmt.Errorf("dedup: invalid message ID %q", id)
+	}
+
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	if s.file == nil {
+		return false, os.ErrClosed
+	}
+
+	now := s.mem.now()
+	if !s.mem.add(id, now) {
+		return false, nil
+	}
+	if _, err := fmt.Fprintf(s.file, "%d %s\n", now.UnixNano(), id); err != nil {
+		delete(s.mem.seen, id)
+		return false, err
+	}
+	if err := s.file.Sync(); err != nil {
+		delete(s.mem.seen, id)
+		return false, err
+	}
+
+	// The ID is already durable, so a failed compaction is only logged and
+	// retried on the next Add.
+	s.appended++
+	if s.appended > len(s.mem.seen)+compactSlack {
+		if err := s.compact(); err != nil {
+			log.Printf("dedup: compacting %s: %v", s.path, err)
+		}
+	}
+	return true, nil
+}
+
+// Close implements Store.
+func (s *FileStore) Close() error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -1,20 +1,109 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"myapp/consumer"
+	"myapp/dedup"
+	"myapp/message"
 	"myapp/producer"
-	_"os"
+	"myapp/queue"
 )
 
 func main() {
-	// Create a channel to communicate between producer and consumer
-	numCh := make(chan int)
+	seed := flag.Int64("seed", 0, "seed for the random sequence and message IDs (0 picks one from the clock)")
+	record := flag.String("record", "", "file to record produced values to")
+	replay := flag.String("replay", "", "file of recorded values to replay instead of random ones")
+	flag.Parse()
+
+	var opts []producer.Option
+	if *seed != 0 {
+		opts = append(opts, producer.WithSeed(*seed))
+	}
+	if *record != "" {
+		f, err := os.Create(*record)
+		if err != nil {
+			log.Fatalf("Error creating recording: %v", err)
+		}
+		defer f.Close()
+		opts = append(opts, producer.WithRecorder(f))
+	}
+	if *replay != "" {
+		values, err := producer.LoadRecording(*replay)
+		if err != nil {
+			log.Fatalf("Error loading recording: %v", err)
+		}
+		opts = append(opts, producer.WithReplay(values))
+	}
+
+	// Bounded queue between producer and consumer; a slow consumer makes
+	// the producer shed the oldest readings instead of stalling.
+	q := queue.New(queue.Config[message.Message]{
+		Capacity: 16,
+		Policy:   queue.DropOldest,
+		OnDrop: func(msg message.Message) {
+			log.Printf("Dropped: %s", msg.ID)
+		},
+	})
+
+	// Remember handled message IDs for a day, across restarts. A seeded run
+	// repeats the IDs of every earlier run with that seed, so it remembers
+	// them only for itself; otherwise each message would be suppressed as
+	// a duplicate of the last run's.
+	var store dedup.Store = dedup.NewMemoryStore(24 * time.Hour)
+	if *seed == 0 {
+		fs, err := dedup.OpenFileStore("dedup.log", 24*time.Hour)
+		if err != nil {
+			log.Fatalf("Error opening dedup store: %v", err)
+		}
+		store = fs
+	}
+	defer store.Close()
+	filter := dedup.NewFilter(store)
+
+	// Write consumed numbers in batches of up to 10, or every 5 seconds
+	batcher := consumer.NewBatcher(consumer.BatchConfig{
+		MaxSize: 10,
+		MaxWait: 5 * time.Second,
+		Flush: func(batch []int) error {
+			fmt.Println("Consumed batch:", batch)
+			return nil
+		},
+	})
 
 	// Start the producer and consumer goroutines
-	go producer.Produce(numCh)
-	go consumer.Consume(numCh)
-	
+	go producer.ProduceTo(q, producer.NewIDGenerator("producer", opts...), opts...)
+	values := make(chan int)
+	go func() {
+		consumer.ConsumeMessages(q.C(), filter, func(msg message.Message) error {
+			values <- msg.Value
+			return nil
+		})
+		close(values)
+	}()
+	done := make(chan struct{})
+	go func() {
+		batcher.Consume(values)
+		close(done)
+	}()
+
+	// Run until interrupted, then flush whatever is left
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+
+	q.Close()
+	<-done
 
-	// Keep the main program running
-	select {}
-}
\ No newline at end of file
+	s := batcher.Stats()
+	log.Printf("Batches: %d, items: %d, failed: %d, size min/avg/max: %d/%.1f/%d, flush latency avg/max: %v/%v",
+		s.Batches, s.Items, s.Failed, s.MinSize, s.AvgSize(), s.MaxSize, s.AvgLatency(), s.MaxLatency)
+	log.Printf("Queue: %+v", q.Stats())
+	log.Printf("Dedup: %+v", filter.Stats())
+}
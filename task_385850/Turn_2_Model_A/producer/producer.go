@@ -1,16 +1,171 @@
 package producer
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"math/rand"
+	"os"
+	"strconv"
+	"strings"
 	"time"
+
+	"myapp/message"
+	"myapp/queue"
 )
 
-// Produce generates random numbers and sends them to the provided channel
-func Produce(ch chan int) {
-	rand.Seed(time.Now().UnixNano())
+// Option configures Produce and ProduceTo.
+type Option func(*config)
+
+type config struct {
+	clock     Clock
+	rand      *rand.Rand
+	seed      int64
+	seeded    bool
+	interval  time.Duration
+	replay    []int
+	replaying bool
+	record    io.Writer
+}
+
+// WithClock sets the clock used to wait between values. The default is RealClock.
+func WithClock(c Clock) Option {
+	return func(cfg *config) { cfg.clock = c }
+}
+
+// WithSeed makes the generated sequence reproducible.
+func WithSeed(seed int64) Option {
+	return func(cfg *config) {
+		cfg.rand = rand.New(rand.NewSource(seed))
+		cfg.seed = seed
+		cfg.seeded = true
+	}
+}
+
+// WithRand sets the random source values are drawn from.
+func WithRand(src rand.Source) Option {
+	return func(cfg *config) { cfg.rand = rand.New(src) }
+}
+
+// WithInterval sets the time between values. The default is one second.
+func WithInterval(d time.Duration) Option {
+	return func(cfg *config) { cfg.interval = d }
+}
+
+// WithReplay emits values instead of random numbers and stops after the last one.
+func WithReplay(values []int) Option {
+	return func(cfg *config) {
+		cfg.replay = values
+		cfg.replaying = true
+	}
+}
+
+// WithRecorder writes every emitted value to w, one per line, in the format
+// read by LoadRecording.
+func WithRecorder(w io.Writer) Option {
+	return func(cfg *config) { cfg.record = w }
+}
+
+func newConfig(opts []Option) *config {
+	cfg := &config{
+		clock:    RealClock(),
+		interval: 1 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if cfg.rand == nil {
+		cfg.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return cfg
+}
+
+// next returns the next value, or false once a replayed sequence is exhausted.
+func (cfg *config) next() (int, bool) {
+	var num int
+	if cfg.replaying {
+		if len(cfg.replay) == 0 {
+			return 0, false
+		}
+		num, cfg.replay = cfg.replay[0], cfg.replay[1:]
+	} else {
+		num = cfg.rand.Intn(100)
+	}
+	if cfg.record != nil {
+		if _, err := fmt.Fprintln(cfg.record, num); err != nil {
+			log.Printf("Error recording value: %v", err)
+		}
+	}
+	return num, true
+}
+
+// NewIDGenerator creates the ID generator for a producer run with opts. The
+// run part of the IDs comes from the seed if one is set, otherwise from the
+// clock, so a seeded run or one on a FakeClock hands out the same IDs every
+// time, replays included. Give such a run a dedup store of its own: one that
+// outlived an earlier run would suppress every message as redelivery.
+func NewIDGenerator(source string, opts ...Option) *message.IDGenerator {
+	cfg := newConfig(opts)
+	if cfg.seeded {
+		return message.NewRunIDGenerator(source, uint64(cfg.seed))
+	}
+	return message.NewRunIDGenerator(source, uint64(cfg.clock.Now().UnixNano()))
+}
+
+// LoadRecording reads a sequence written by WithRecorder.
+func LoadRecording(path string) ([]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var values []int
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		num, err := strconv.Atoi(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		values = append(values, num)
+	}
+	return values, scanner.Err()
+}
+
+// Produce generates random numbers and sends them to the provided channel.
+// It only returns when replaying a recording, after the last value.
+func Produce(ch chan int, opts ...Option) {
+	cfg := newConfig(opts)
 	for {
-		num := rand.Intn(100)
+		num, ok := cfg.next()
+		if !ok {
+			return
+		}
 		ch <- num
-		time.Sleep(1 * time.Second)
+		<-cfg.clock.After(cfg.interval)
+	}
+}
+
+// ProduceTo generates random numbers, tags each with an ID from ids and puts them
+// on the bounded queue, leaving overflow handling to the queue's policy.
+// It returns once the queue is closed or a replayed recording is exhausted.
+func ProduceTo(q *queue.Queue[message.Message], ids *message.IDGenerator, opts ...Option) {
+	cfg := newConfig(opts)
+	for {
+		num, ok := cfg.next()
+		if !ok {
+			return
+		}
+		msg := message.Message{ID: ids.Next(), Value: num}
+		if err := q.Put(msg); errors.Is(err, queue.ErrClosed) {
+			return
+		}
+		<-cfg.clock.After(cfg.interval)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,104 @@
+package producer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func collect(t *testing.T, n int, opts ...Option) []int {
+	t.Helper()
+	clock := NewFakeClock(time.Unix(0, 0))
+	ch := make(chan int)
+	go Produce(ch, append(opts, WithClock(clock))...)
+
+	var got []int
+	for i := 0; i < n; i++ {
+		got = append(got, <-ch)
+		if i < n-1 {
+			clock.BlockUntil(1)
+			clock.Advance(time.Second)
+		}
+	}
+	return got
+}
+
+func TestSeededSequenceIsDeterministic(t *testing.T) {
+	first := collect(t, 5, WithSeed(42))
+	second := collect(t, 5, WithSeed(42))
+
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("Sequences differ: %v vs %v", first, second)
+		}
+	}
+}
+
+func TestProduceWaitsForClock(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	ch := make(chan int, 2)
+	go Produce(ch, WithClock(clock), WithSeed(1), WithInterval(time.Minute))
+
+	<-ch
+	clock.BlockUntil(1)
+	clock.Advance(59 * time.Second)
+	select {
+	case <-ch:
+		t.Fatal("Produced a value before the interval elapsed")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("No value produced after the interval elapsed")
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	var buf bytes.Buffer
+	recorded := collect(t, 4, WithSeed(7), WithRecorder(&buf))
+
+	path := filepath.Join(t.TempDir(), "recording.txt")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	values, err := LoadRecording(path)
+	if err != nil {
+		t.Fatalf("LoadRecording failed: %v", err)
+	}
+
+	ch := make(chan int)
+	done := make(chan struct{})
+	go func() {
+		Produce(ch, WithReplay(values), WithInterval(0))
+		close(done)
+	}()
+
+	for i, want := range recorded {
+		if got := <-ch; got != want {
+			t.Errorf("Value %d: expected %d, got %d", i, want, got)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Produce did not return after the recording was exhausted")
+	}
+}
+
+func TestReproducibleRunsHaveTheSameIDs(t *testing.T) {
+	first, second := NewIDGenerator("p", WithSeed(42)), NewIDGenerator("p", WithSeed(42))
+	if a, b := first.Next(), second.Next(); a != b {
+		t.Errorf("Seeded runs differ: %s vs %s", a, b)
+	}
+
+	clock := NewFakeClock(time.Unix(100, 0))
+	first, second = NewIDGenerator("p", WithClock(clock)), NewIDGenerator("p", WithClock(clock))
+	if a, b := first.Next(), second.Next(); a != b {
+		t.Errorf("Runs on the same clock differ: %s vs %s", a, b)
+	}
+}
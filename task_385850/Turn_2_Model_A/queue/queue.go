@@ -0,0 +1,184 @@
+// Package queue provides a bounded FIFO queue with selectable overflow policies,
+// so that producers can shed load instead of stalling behind a slow consumer.
+package queue
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Policy decides what happens when Put is called on a full queue.
+type Policy int
+
+const (
+	// Block waits until there is room in the queue.
+	Block Policy = iota
+	// DropNewest discards the item being put.
+	DropNewest
+	// DropOldest discards the item at the head of the queue to make room.
+	DropOldest
+	// BlockTimeout waits up to Config.Timeout, then discards the item being put.
+	BlockTimeout
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Block:
+		return "block"
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case BlockTimeout:
+		return "block-timeout"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	// ErrClosed is returned by Put after Close has been called.
+	ErrClosed = errors.New("queue: closed")
+	// ErrDropped is returned by Put when the item was discarded under DropNewest.
+	ErrDropped = errors.New("queue: item dropped")
+	// ErrTimeout is returned by Put when the item was discarded under BlockTimeout.
+	ErrTimeout = errors.New("queue: put timed out")
+)
+
+// Config configures a Queue.
+type Config[T any] struct {
+	Capacity int
+	Policy   Policy
+	// Timeout is how long Put waits under BlockTimeout.
+	Timeout time.Duration
+	// OnDrop, if set, is called with every discarded item.
+	OnDrop func(item T)
+}
+
+// Stats is a snapshot of the queue counters.
+type Stats struct {
+	Enqueued uint64
+	Dropped  uint64
+}
+
+// Queue is a bounded FIFO queue safe for concurrent producers and consumers.
+type Queue[T any] struct {
+	cfg  Config[T]
+	ch   chan T
+	done chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+	once   sync.Once
+
+	enqueued atomic.Uint64
+	dropped  atomic.Uint64
+}
+
+// New creates a queue. A capacity below 1 is treated as 1.
+func New[T any](cfg Config[T]) *Queue[T] {
+	if cfg.Capacity < 1 {
+		cfg.Capacity = 1
+	}
+	return &Queue[T]{
+		cfg:  cfg,
+		ch:   make(chan T, cfg.Capacity),
+		done: make(chan struct{}),
+	}
+}
+
+// Put adds an item according to the queue's overflow policy.
+func (q *Queue[T]) Put(item T) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrClosed
+	}
+
+	switch q.cfg.Policy {
+	case DropNewest:
+		select {
+		case q.ch <- item:
+		default:
+			q.drop(item)
+			return ErrDropped
+		}
+	case DropOldest:
+		for {
+			select {
+			case q.ch <- item:
+				q.enqueued.Add(1)
+				return nil
+			default:
+			}
+			select {
+			case old := <-q.ch:
+				q.drop(old)
+			default:
+			}
+		}
+	case BlockTimeout:
+		timer := time.NewTimer(q.cfg.Timeout)
+		defer timer.Stop()
+		select {
+		case q.ch <- item:
+		case <-timer.C:
+			q.drop(item)
+			return ErrTimeout
+		case <-q.done:
+			return ErrClosed
+		}
+	default:
+		select {
+		case q.ch <- item:
+		case <-q.done:
+			return ErrClosed
+		}
+	}
+	q.enqueued.Add(1)
+	return nil
+}
+
+func (q *Queue[T]) drop(item T) {
+	q.dropped.Add(1)
+	if q.cfg.OnDrop != nil {
+		q.cfg.OnDrop(item)
+	}
+}
+
+// C returns the channel consumers receive items from. It is closed by Close.
+func (q *Queue[T]) C() <-chan T {
+	return q.ch
+}
+
+// Len returns the number of items currently buffered.
+func (q *Queue[T]) Len() int {
+	return len(q.ch)
+}
+
+// Cap returns the queue capacity.
+func (q *Queue[T]) Cap() int {
+	return cap(q.ch)
+}
+
+// Stats returns the enqueue and drop counters.
+func (q *Queue[T]) Stats() Stats {
+	return Stats{
+		Enqueued: q.enqueued.Load(),
+		Dropped:  q.dropped.Load(),
+	}
+}
+
+// Close stops accepting items and closes C once blocked producers have returned.
+// Items already buffered can still be received.
+func (q *Queue[T]) Close() {
+	q.once.Do(func() {
+		close(q.done)
+		q.mu.Lock()
+		q.closed = true
+		close(q.ch)
+		q.mu.Unlock()
+	})
+}
@@ -0,0 +1,131 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func drain(q *Queue[int]) []int {
+	var got []int
+	for {
+		select {
+		case v := <-q.C():
+			got = append(got, v)
+		default:
+			return got
+		}
+	}
+}
+
+func TestDropNewest(t *testing.T) {
+	var dropped []int
+	q := New(Config[int]{Capacity: 2, Policy: DropNewest, OnDrop: func(v int) { dropped = append(dropped, v) }})
+
+	for i := 1; i <= 4; i++ {
+		err := q.Put(i)
+		if i <= 2 && err != nil {
+			t.Fatalf("Put(%d) failed: %v", i, err)
+		}
+		if i > 2 && err != ErrDropped {
+			t.Fatalf("Put(%d): expected ErrDropped, got %v", i, err)
+		}
+	}
+
+	if got := drain(q); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("Expected [1 2] queued, got %v", got)
+	}
+	if len(dropped) != 2 || dropped[0] != 3 || dropped[1] != 4 {
+		t.Errorf("Expected [3 4] dropped, got %v", dropped)
+	}
+	if s := q.Stats(); s.Enqueued != 2 || s.Dropped != 2 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+}
+
+func TestDropOldest(t *testing.T) {
+	var dropped []int
+	q := New(Config[int]{Capacity: 2, Policy: DropOldest, OnDrop: func(v int) { dropped = append(dropped, v) }})
+
+	for i := 1; i <= 4; i++ {
+		if err := q.Put(i); err != nil {
+			t.Fatalf("Put(%d) failed: %v", i, err)
+		}
+	}
+
+	if got := drain(q); len(got) != 2 || got[0] != 3 || got[1] != 4 {
+		t.Errorf("Expected [3 4] queued, got %v", got)
+	}
+	if len(dropped) != 2 || dropped[0] != 1 || dropped[1] != 2 {
+		t.Errorf("Expected [1 2] dropped, got %v", dropped)
+	}
+	if s := q.Stats(); s.Dropped != 2 {
+		t.Errorf("Expected 2 drops, got %d", s.Dropped)
+	}
+}
+
+func TestBlockTimeout(t *testing.T) {
+	q := New(Config[int]{Capacity: 1, Policy: BlockTimeout, Timeout: 20 * time.Millisecond})
+
+	if err := q.Put(1); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	start := time.Now()
+	if err := q.Put(2); err != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Put returned after %v, expected to wait for the timeout", elapsed)
+	}
+	if s := q.Stats(); s.Dropped != 1 {
+		t.Errorf("Expected 1 drop, got %d", s.Dropped)
+	}
+}
+
+func TestBlockUntilRoom(t *testing.T) {
+	q := New(Config[int]{Capacity: 1, Policy: Block})
+	if err := q.Put(1); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- q.Put(2) }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Put returned early with %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	<-q.C()
+	if err := <-done; err != nil {
+		t.Fatalf("Blocked Put failed: %v", err)
+	}
+	if v := <-q.C(); v != 2 {
+		t.Errorf("Expected 2, got %d", v)
+	}
+}
+
+func TestCloseUnblocksPut(t *testing.T) {
+	q := New(Config[int]{Capacity: 1, Policy: Block})
+	q.Put(1)
+
+	done := make(chan error)
+	go func() { done <- q.Put(2) }()
+	time.Sleep(10 * time.Millisecond)
+	q.Close()
+
+	if err := <-done; err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+	if err := q.Put(3); err != ErrClosed {
+		t.Errorf("Expected ErrClosed after Close, got %v", err)
+	}
+
+	var got []int
+	for v := range q.C() {
+		got = append(got, v)
+	}
+	if len(got) != 1 || got[0] != 1 {
+		t.Errorf("Expected buffered [1] after Close, got %v", got)
+	}
+}
@@ -1,50 +1,23 @@
-package main  
-import (    "bufio"
-    "encoding/json"
-    "fmt"
-    "log"
-    "net"
+package main
+
+import (
+	"context"
+	"log"
+
+	"tcpserver/protocol"
 )
-type Request struct {    
-    Method string `json:"method"`
-    Path   string `json:"path"`
-}
-type Response struct {
-    Status int    `json:"status"`
-    Body    string `json:"body"`
-}
 
-func dialTCP(addr string, path string) Response {
-    conn, err := net.Dial("tcp", addr)
-    if err != nil {
-        log.Fatalf("Error dialing: %v", err)
-    }
-    defer conn.Close()
-    req := Request{
-        Method: "GET",
-        Path:   path,
-    }
-    reqBytes, err := json.Marshal(req)
-    if err != nil {
-        log.Printf("Error marshalling request: %v", err)
-        return Response{}
-    }
-    fmt.Fprintln(conn, string(reqBytes))
-    reader := bufio.NewReader(conn)
-    data, err := reader.ReadBytes('\n')
-    if err != nil {
-        log.Printf("Error reading response: %v", err)
-        return Response{}
-    }
-    // Parse the JSON response
-    var resp Response
-    if err := json.Unmarshal(data, &resp); err != nil {
-        log.Printf("Error parsing response: %v", err)
-    }
-    return resp
+// dialTCP sends a GET for path to the server at addr.
+func dialTCP(ctx context.Context, addr string, path string) (*protocol.Response, error) {
+	client := protocol.NewClient(protocol.ClientOptions{Addr: addr})
+	defer client.Close()
+	return client.Do(ctx, &protocol.Request{Method: "GET", Path: path})
 }
 
 func main() {
-    resp := dialTCP("localhost:8080", "/hello")
-    log.Printf("Response: %+v", resp)
-}  
\ No newline at end of file
+	resp, err := dialTCP(context.Background(), "localhost:8080", "/hello")
+	if err != nil {
+		log.Fatalf("Error requesting /hello: %v", err)
+	}
+	log.Printf("Response: %+v", resp)
+}
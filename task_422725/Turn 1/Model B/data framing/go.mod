@@ -0,0 +1,7 @@
+module framing
+
+go 1.23
+
+require tcpserver v0.0.0
+
+replace tcpserver => "../../../Turn 2/Model A/TCP server"
@@ -1,61 +1,41 @@
+// Package framing frames requests and responses with the shared protocol
+// codec.
+package framing
 
-package main
 import (
-    "encoding/binary"
-    "encoding/json"
-    "io"
+	"io"
+
+	"tcpserver/protocol"
 )
-func writeRequest(writer io.Writer, req *Request) error {
-    data, err := json.Marshal(req)
-    if err != nil {
-        return err
-    }
-    err = binary.Write(writer, binary.BigEndian, uint32(len(data)))
-    if err != nil {
-        return err
-    }
-    _, err = writer.Write(data)
-    return err
+
+// maxFrameSize bounds the payload of one frame.
+const maxFrameSize = 1024 * 1024
+
+// Requests and responses are framed by protocol.Codec rather than a bare
+// uint32 length: each frame has a versioned header carrying a request ID,
+// and its payload uses an encoding the two ends agree on when the
+// connection opens. newClientCodec and newServerCodec do that handshake.
+
+func newClientCodec(rw io.ReadWriter) (*protocol.Codec, error) {
+	return protocol.ClientHandshake(rw, maxFrameSize)
+}
+
+func newServerCodec(rw io.ReadWriter) (*protocol.Codec, error) {
+	return protocol.ServerHandshake(rw, maxFrameSize)
 }
-func readRequest(reader io.Reader) (*Request, error) {
-    var length uint32
-    err := binary.Read(reader, binary.BigEndian, &length)
-    if err != nil {
-        return nil, err
-    }
-    data := make([]byte, length)
-    _, err = io.ReadFull(reader, data)
-    if err != nil {
-        return nil, err
-    }
-    var req Request
-    err = json.Unmarshal(data, &req)
-    return &req, err
+
+func writeRequest(codec *protocol.Codec, req *protocol.Request) error {
+	return codec.WriteRequest(req)
+}
+
+func readRequest(codec *protocol.Codec) (*protocol.Request, error) {
+	return codec.ReadRequest()
 }
-func writeResponse(writer io.Writer, resp *Response) error {
-    data, err := json.Marshal(resp)
-    if err != nil {
-        return err
-    }
-    err = binary.Write(writer, binary.BigEndian, uint32(len(data)))
-    if err != nil {
-        return err
-    }
-    _, err = writer.Write(data)
-    return err
+
+func writeResponse(codec *protocol.Codec, resp *protocol.Response) error {
+	return codec.WriteResponse(resp)
+}
+
+func readResponse(codec *protocol.Codec) (*protocol.Response, error) {
+	return codec.ReadResponse()
 }
-func readResponse(reader io.Reader) (*Response, error) {
-    var length uint32
-    err := binary.Read(reader, binary.BigEndian, &length)
-    if err != nil {
-        return nil, err
-    }
-    data := make([]byte, length)
-    _, err = io.ReadFull(reader, data)
-    if err != nil {
-        return nil, err
-    }
-    var resp Response
-    err = json.Unmarshal(data, &resp)
-    return &resp, err
-}
\ No newline at end of file
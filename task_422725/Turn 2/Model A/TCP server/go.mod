@@ -0,0 +1,3 @@
+module tcpserver
+
+go 1.23
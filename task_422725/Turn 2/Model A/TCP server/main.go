@@ -1,123 +1,327 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
-	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
+
+	"tcpserver/protocol"
 )
 
-type Request struct {
-	Method string `json:"method"`
-	Path   string `json:"path"`
-	Body   map[string]interface{} `json:"body,omitempty"`
+const shutdownTimeout = 30 * time.Second
+
+//Request handeling.
+
+func newRouter() *protocol.Router {
+	router := protocol.NewRouter()
+	router.Use(protocol.Logging, protocol.Recover)
+	router.Handle("GET", "/items/:id", itemHandler)
+	router.Handle("GET", "/whoami", whoamiHandler)
+	router.Handle("POST", "/upload", uploadHandler)
+	router.Handle("GET", "/download/:size", downloadHandler)
+	router.Handle("GET", "/*path", getHandler)
+	router.Handle("POST", "/*path", postHandler)
+	return router
 }
 
-type Response struct {
-	Status int    `json:"status"`
-	Message string `json:"message"`
-	Body    map[string]interface{} `json:"body,omitempty"`
+func getHandler(req *protocol.Request) *protocol.Response {
+	return &protocol.Response{
+		Status:  200,
+		Message: "OK",
+		Body: map[string]interface{}{
+			"path": req.Path,
+		},
+	}
 }
 
-const (
-	maxRequestSize = 1024 * 1024 // 1MB limit
-)
+func itemHandler(req *protocol.Request) *protocol.Response {
+	return &protocol.Response{
+		Status:  200,
+		Message: "OK",
+		Body: map[string]interface{}{
+			"id": req.Params["id"],
+		},
+	}
+}
 
-func serveTCP(listenAddr string) {
-	log.Printf("Listening on %s", listenAddr)
-	ln, err := net.Listen("tcp", listenAddr)
-	if err != nil {
-		log.Fatalf("Error listening: %v", err)
+func whoamiHandler(req *protocol.Request) *protocol.Response {
+	return &protocol.Response{
+		Status:  200,
+		Message: "OK",
+		Body: map[string]interface{}{
+			"addr":      req.RemoteAddr,
+			"identity":  protocol.PeerIdentity(req),
+			"principal": req.Principal,
+		},
 	}
-	defer ln.Close()
+}
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Printf("Error accepting: %v", err)
-			continue
-		}
+// uploadHandler reads a streamed body of any size and reports its length
+// and SHA-256.
+func uploadHandler(req *protocol.Request) *protocol.Response {
+	if req.Stream == nil {
+		return &protocol.Response{Status: 400, Message: "Expected a streamed body"}
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, req.Stream)
+	if err != nil {
+		return &protocol.Response{Status: 400, Message: err.Error()}
+	}
+	return &protocol.Response{
+		Status:  201,
+		Message: "Created",
+		Body: map[string]interface{}{
+			"bytes":  n,
+			"sha256": hex.EncodeToString(h.Sum(nil)),
+		},
+	}
+}
 
-		go handleConn(conn)
+// downloadHandler streams :size bytes of a repeating pattern.
+func downloadHandler(req *protocol.Request) *protocol.Response {
+	size, err := strconv.ParseInt(req.Params["size"], 10, 64)
+	if err != nil || size < 0 {
+		return &protocol.Response{Status: 400, Message: "Invalid size"}
+	}
+	return &protocol.Response{
+		Status:  200,
+		Message: "OK",
+		Stream: func(w io.Writer) error {
+			_, err := io.CopyN(w, &patternReader{}, size)
+			return err
+		},
 	}
 }
 
-func handleConn(conn net.Conn) {
-	defer conn.Close()
-	conn.SetDeadline(time.Now().Add(5 * time.Second))
+// patternReader yields the bytes 0 to 255 over and over.
+type patternReader struct {
+	next byte
+}
 
-	reader := bufio.NewReader(conn)
-	for {
-		data, err := readRequest(reader)
-		if err != nil {
-			if err == io.EOF {
-				log.Println("Connection closed")
-				return
-			}
-			log.Printf("Error reading request: %v", err)
-			sendResponse(conn, 500, "Internal Server Error")
-			continue
-		}
+func (r *patternReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.next
+		r.next++
+	}
+	return len(p), nil
+}
 
-		req := &Request{}
-		if err := json.Unmarshal(data, req); err != nil {
-			log.Printf("Error parsing request: %v", err)
-			sendResponse(conn, 400, "Bad Request")
-			continue
+// addEventRoutes lets clients subscribe to and publish on paths under
+// /events.
+func addEventRoutes(router *protocol.Router, broker *protocol.Broker) {
+	router.Handle(protocol.MethodSubscribe, "/events/*topic", func(req *protocol.Request) *protocol.Response {
+		return &protocol.Response{Status: 200, Message: "OK"}
+	})
+	router.Handle("POST", "/events/*topic", func(req *protocol.Request) *protocol.Response {
+		n := broker.Publish(req.Path, req.Body)
+		return &protocol.Response{
+			Status:  202,
+			Message: "Accepted",
+			Body:    map[string]interface{}{"delivered": n},
 		}
+	})
+}
 
-		log.Printf("Received request: %+v", req)
-		resp := handleRequest(req)
-		sendResponse(conn, resp.Status, resp.Message, resp.Body)
+func postHandler(req *protocol.Request) *protocol.Response {
+	return &protocol.Response{
+		Status:  201,
+		Message: "Created",
+		Body:    req.Body,
 	}
 }
 
-func readRequest(reader *bufio.Reader) ([]byte, error) {
-	length, err := reader.ReadBytes(':')
-	if err != nil {
-		return nil, err
-	}
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on; unix:/path or udp:host:port for other transports")
+	maxConns := flag.Int("max-conns", 1000, "maximum open connections; 0 for no limit")
+	idleTimeout := flag.Duration("idle-timeout", protocol.DefaultIdleTimeout, "close connections idle this long")
+	gatewayAddr := flag.String("gateway", "", "run an HTTP/JSON gateway on this address instead of the server")
+	upstream := flag.String("upstream", "localhost:8080", "server the -gateway and -replay send to")
+	upstreamToken := flag.String("upstream-token", "", "bearer token for authenticating to -upstream")
+	upstreamTLS := flag.Bool("upstream-tls", false, "connect to -upstream over TLS")
+	upstreamCA := flag.String("upstream-ca", "", "PEM CA bundle to verify -upstream with instead of the system roots; implies -upstream-tls")
+	upstreamPlaintextToken := flag.Bool("upstream-plaintext-token", false, "send -upstream-token without -upstream-tls, where it can be read off the network")
+	authFile := flag.String("auth-file", "", "credentials file; requires clients to authenticate")
+	plaintextTokens := flag.Bool("allow-plaintext-tokens", false, "accept -auth-file tokens without TLS, where they can be read off the network")
+	captureFile := flag.String("capture", "", "record every request and response to this file")
+	replayFile := flag.String("replay", "", "replay a -capture file against -upstream instead of serving, and report differences")
+	replayFast := flag.Bool("replay-fast", false, "with -replay, send requests as fast as possible instead of at their captured times")
+	var files protocol.TLSFiles
+	flag.StringVar(&files.CertFile, "tls-cert", "", "PEM certificate; enables TLS")
+	flag.StringVar(&files.KeyFile, "tls-key", "", "PEM private key for -tls-cert")
+	flag.StringVar(&files.CAFile, "tls-client-ca", "", "PEM CA bundle; requires and verifies client certificates")
+	flag.Parse()
 
-	size, err := fmt.Sscanf(string(length), "%d", &length)
-	if size != 1 || length > maxRequestSize {
-		return nil, fmt.Errorf("invalid request size: %d", length)
+	var upstreamTLSConfig *tls.Config
+	if *upstreamTLS || *upstreamCA != "" {
+		certs, err := protocol.NewCertReloader(protocol.TLSFiles{CAFile: *upstreamCA})
+		if err != nil {
+			log.Fatalf("Error loading -upstream-ca: %v", err)
+		}
+		// The server name comes from -upstream when dialing
+		upstreamTLSConfig = certs.ClientConfig("")
+	}
+	var upstreamAuth *protocol.ClientAuth
+	if *upstreamToken != "" {
+		if upstreamTLSConfig == nil && !*upstreamPlaintextToken {
+			log.Fatal("-upstream-token requires -upstream-tls, or -upstream-plaintext-token to send it anyway")
+		}
+		upstreamAuth = &protocol.ClientAuth{Token: *upstreamToken, AllowPlaintext: *upstreamPlaintextToken}
+	}
+	if *replayFile != "" {
+		if !runReplay(*replayFile, protocol.ReplayOptions{Addr: *upstream, Auth: upstreamAuth, TLS: upstreamTLSConfig, Fast: *replayFast}) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *gatewayAddr != "" {
+		stop := make(chan struct{})
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+			<-sig
+			log.Println("Shutting down gateway")
+			close(stop)
+		}()
+		if err := runGateway(*gatewayAddr, *upstream, upstreamAuth, upstreamTLSConfig, stop); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	return reader.ReadBytes('\n')
-}
-
-//Request handeling.
-
-func handleRequest(req *Request) *Response {
-	switch req.Method {
-	case "GET":
-		return getHandler(req)
-	case "POST":
-		return postHandler(req)
-	default:
-		return &Response{
-			Status: 405,
-			Message: "Method Not Allowed",
+	var tlsConfig *tls.Config
+	if files.CAFile != "" && files.CertFile == "" {
+		log.Fatal("-tls-client-ca requires -tls-cert")
+	}
+	if files.CertFile != "" {
+		certs, err := protocol.NewCertReloader(files)
+		if err != nil {
+			log.Fatalf("Error loading TLS files: %v", err)
+		}
+		tlsConfig = certs.ServerConfig()
+	}
+	var verifier protocol.Verifier
+	if *authFile != "" {
+		v, err := protocol.LoadStaticVerifier(*authFile)
+		if err != nil {
+			log.Fatalf("Error loading credentials: %v", err)
+		}
+		if len(v.Tokens) > 0 && tlsConfig == nil && !*plaintextTokens {
+			log.Printf("Tokens in %s will be refused without TLS; use -tls-cert or hmac keys", *authFile)
+		}
+		verifier = v
+	}
+	var capture *protocol.Capture
+	if *captureFile != "" {
+		c, err := protocol.CreateCapture(*captureFile)
+		if err != nil {
+			log.Fatalf("Error creating capture: %v", err)
+		}
+		capture = c
+	}
+	broker := protocol.NewBroker()
+	router := newRouter()
+	addEventRoutes(router, broker)
+	srv := &protocol.Server{
+		Handler:              router.ServeRequest,
+		Broker:               broker,
+		TLSConfig:            tlsConfig,
+		Verifier:             verifier,
+		AllowPlaintextTokens: *plaintextTokens,
+		Capture:              capture,
+		MaxConns:             *maxConns,
+		IdleTimeout:          *idleTimeout,
+	}
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		log.Println("Shutting down, draining connections")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Error draining connections: %v", err)
+		}
+	}()
+	if err := srv.ListenAndServe(*addr); !errors.Is(err, protocol.ErrServerClosed) {
+		log.Fatalf("Error serving: %v", err)
+	}
+	// Serve returns as soon as the listener closes; wait for the drain
+	<-drained
+	if capture != nil {
+		if err := capture.Close(); err != nil {
+			log.Printf("Error writing capture: %v", err)
 		}
 	}
 }
 
-func getHandler(req *Request) *Response {
-	return &Response{
-		Status: 200,
-		Message: "OK",
-		Body: map[string]interface{}{
-			"path": req.Path,
-		},
+// runReplay replays the capture at path, printing the differences, and
+// reports whether there were none.
+func runReplay(path string, opts protocol.ReplayOptions) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Error opening capture: %v", err)
 	}
+	entries, err := protocol.ReadCapture(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("Error reading capture %s: %v", path, err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	report, err := protocol.Replay(ctx, entries, opts)
+	if report == nil {
+		log.Fatalf("Error replaying: %v", err)
+	}
+	for _, d := range report.Diffs {
+		fmt.Println(d)
+	}
+	fmt.Printf("%d sent, %d skipped, %d differed\n", report.Sent, report.Skipped, len(report.Diffs))
+	if err != nil {
+		log.Printf("Replay stopped early: %v", err)
+		return false
+	}
+	return len(report.Diffs) == 0
 }
 
-func postHandler(req *Request) *Response {
-	return &Response{
-		Status: 201,
-		Message: "Created",
-		Body:    req.Body,
+// runGateway serves the gateway on httpAddr, forwarding to upstream, over
+// TLS if tlsConfig is set and with auth if it asks, until stop is closed and
+// the requests in progress have drained.
+func runGateway(httpAddr, upstream string, auth *protocol.ClientAuth, tlsConfig *tls.Config, stop <-chan struct{}) error {
+	client := protocol.NewClient(protocol.ClientOptions{Addr: upstream, Auth: auth, TLS: tlsConfig})
+	defer client.Close()
+	srv := &http.Server{
+		Addr:              httpAddr,
+		Handler:           &protocol.Gateway{Client: client},
+		ReadHeaderTimeout: 10 * time.Second,
 	}
-}
\ No newline at end of file
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-stop
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Error draining gateway: %v", err)
+		}
+	}()
+	log.Printf("Gateway listening on %s, forwarding to %s", httpAddr, upstream)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("gateway: %w", err)
+	}
+	<-drained
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"tcpserver/protocol"
+)
+
+func TestRouter(t *testing.T) {
+	router := newRouter()
+
+	tests := []struct {
+		req    *protocol.Request
+		status int
+		body   map[string]interface{}
+	}{
+		{&protocol.Request{Method: "GET", Path: "/hello"}, 200, map[string]interface{}{"path": "/hello"}},
+		{&protocol.Request{Method: "GET", Path: "/items/42"}, 200, map[string]interface{}{"id": "42"}},
+		{&protocol.Request{Method: "POST", Path: "/items", Body: map[string]interface{}{"n": 1}}, 201, map[string]interface{}{"n": 1}},
+		{&protocol.Request{Method: "POST", Path: "/upload"}, 400, nil},
+		{&protocol.Request{Method: "GET", Path: "/download/x"}, 400, nil},
+		{&protocol.Request{Method: "DELETE", Path: "/items"}, 405, nil},
+	}
+	for _, tt := range tests {
+		resp := router.ServeRequest(tt.req)
+		if resp.Status != tt.status {
+			t.Errorf("%s %s: expected status %d, got %d", tt.req.Method, tt.req.Path, tt.status, resp.Status)
+		}
+		for k, v := range tt.body {
+			if resp.Body[k] != v {
+				t.Errorf("%s %s: expected body.%s = %v, got %v", tt.req.Method, tt.req.Path, k, v, resp.Body[k])
+			}
+		}
+	}
+}
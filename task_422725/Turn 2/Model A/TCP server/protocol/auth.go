@@ -0,0 +1,272 @@
+package protocol
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// A server with a Verifier sets flagAuthRequired on its hello answer and
+// then expects the client to authenticate before any request:
+//
+//	client: auth      [authBearer] token
+//	server: result    [authOK] principal, or [authFailed] reason
+//
+// or, to prove knowledge of a shared key without sending it:
+//
+//	client: auth      [authHMAC] key ID
+//	server: challenge random nonce
+//	client: proof     HMAC-SHA256(key, nonce)
+//	server: result
+//
+// A failed or late authentication closes the connection; there is one
+// attempt per connection. A bearer token crosses the wire as it is, so
+// neither end uses one on a connection without TLS unless told otherwise;
+// see Server.AllowPlaintextTokens and ClientAuth.AllowPlaintext.
+const (
+	defaultAuthTimeout = 5 * time.Second
+	challengeSize      = 32
+)
+
+// Authentication mechanisms, the first byte of an auth frame.
+const (
+	authBearer byte = iota + 1
+	authHMAC
+)
+
+// Authentication results, the first byte of a result frame.
+const (
+	authOK byte = iota
+	authFailed
+)
+
+var (
+	// ErrAuthFailed is returned when credentials are rejected.
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrAuthRequired is returned by clients without credentials for a
+	// server that requires them.
+	ErrAuthRequired = errors.New("server requires authentication")
+	// ErrPlaintextToken is returned by clients asked for a bearer token on
+	// a connection without TLS; see ClientAuth.AllowPlaintext.
+	ErrPlaintextToken = errors.New("refusing to send a bearer token without TLS")
+)
+
+// Verifier checks the credentials a connection presents and names the
+// principal they belong to. Errors are logged by the server but not sent
+// to the client, which only learns that it failed.
+type Verifier interface {
+	VerifyToken(token string) (principal string, err error)
+	// VerifyHMAC checks that mac is HMAC-SHA256 of challenge under the key
+	// for keyID; see CheckHMAC.
+	VerifyHMAC(keyID string, challenge, mac []byte) (principal string, err error)
+}
+
+// ClientAuth holds a client's credentials: a bearer Token, or a KeyID and
+// shared Key for the challenge-response. Token wins if both are set.
+type ClientAuth struct {
+	Token string
+	KeyID string
+	Key   []byte
+	// AllowPlaintext sends Token on connections without TLS, where anyone
+	// on the path can read and replay it. Without it such connections fail
+	// with ErrPlaintextToken.
+	AllowPlaintext bool
+}
+
+// CheckHMAC reports, in constant time, whether mac is the proof for
+// challenge under key.
+func CheckHMAC(key, challenge, mac []byte) bool {
+	return hmac.Equal(mac, hmacProof(key, challenge))
+}
+
+func hmacProof(key, challenge []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(challenge)
+	return h.Sum(nil)
+}
+
+// StaticVerifier accepts a fixed set of tokens and keys. Tokens maps each
+// token to its principal; Keys maps each key ID, which is also the
+// principal, to its key.
+type StaticVerifier struct {
+	Tokens map[string]string
+	Keys   map[string][]byte
+}
+
+func (v *StaticVerifier) VerifyToken(token string) (string, error) {
+	// Every token is compared, so timing does not reveal near misses
+	var principal string
+	for t, p := range v.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			principal = p
+		}
+	}
+	if principal == "" {
+		return "", errors.New("unknown token")
+	}
+	return principal, nil
+}
+
+func (v *StaticVerifier) VerifyHMAC(keyID string, challenge, mac []byte) (string, error) {
+	key, ok := v.Keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("unknown key %q", keyID)
+	}
+	if !CheckHMAC(key, challenge, mac) {
+		return "", fmt.Errorf("bad proof for key %q", keyID)
+	}
+	return keyID, nil
+}
+
+// LoadStaticVerifier reads credentials from a file of lines
+//
+//	token <principal> <token>
+//	hmac <key ID> <hex key>
+//
+// Blank lines and lines starting with # are skipped.
+func LoadStaticVerifier(path string) (*StaticVerifier, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	v := &StaticVerifier{Tokens: map[string]string{}, Keys: map[string][]byte{}}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected 3 fields, got %d", path, line, len(fields))
+		}
+		switch fields[0] {
+		case "token":
+			v.Tokens[fields[2]] = fields[1]
+		case "hmac":
+			key, err := hex.DecodeString(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: bad key: %v", path, line, err)
+			}
+			v.Keys[fields[1]] = key
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown credential type %q", path, line, fields[0])
+		}
+	}
+	return v, scanner.Err()
+}
+
+// serverAuthenticate runs the server's side of authentication and returns
+// the principal. Bearer tokens are refused unless allowTokens is set. On
+// failure the client has been told, and the connection should be closed.
+func serverAuthenticate(codec *Codec, verifier Verifier, allowTokens bool) (string, error) {
+	f, err := codec.readFrame()
+	if err != nil {
+		return "", err
+	}
+	if f.kind != frameAuth || len(f.payload) == 0 {
+		return "", fmt.Errorf("%w: %d before authenticating", ErrUnexpectedFrame, f.kind)
+	}
+
+	var principal string
+	switch mech, data := f.payload[0], f.payload[1:]; mech {
+	case authBearer:
+		if !allowTokens {
+			err = errors.New("bearer token sent without TLS")
+			break
+		}
+		principal, err = verifier.VerifyToken(string(data))
+	case authHMAC:
+		var proof frame
+		challenge := make([]byte, challengeSize)
+		if _, err := rand.Read(challenge); err != nil {
+			return "", fmt.Errorf("generating challenge: %w", err)
+		}
+		if err := codec.writeFrame(frame{kind: frameAuthChallenge, payload: challenge}); err != nil {
+			return "", err
+		}
+		if proof, err = codec.readFrame(); err != nil {
+			return "", err
+		}
+		if proof.kind != frameAuthProof {
+			return "", fmt.Errorf("%w: %d instead of an auth proof", ErrUnexpectedFrame, proof.kind)
+		}
+		principal, err = verifier.VerifyHMAC(string(data), challenge, proof.payload)
+	default:
+		err = fmt.Errorf("unknown mechanism %d", mech)
+	}
+	if err == nil && principal == "" {
+		err = errors.New("verifier returned no principal")
+	}
+	if err != nil {
+		codec.writeFrame(frame{kind: frameAuthResult, payload: append([]byte{authFailed}, ErrAuthFailed.Error()...)})
+		return "", fmt.Errorf("%w: %v", ErrAuthFailed, err)
+	}
+	return principal, codec.writeFrame(frame{kind: frameAuthResult, payload: append([]byte{authOK}, principal...)})
+}
+
+// clientAuthenticate runs the client's side of authentication, if the
+// server asked for it, and returns the principal the server assigned.
+// secure says whether the connection is TLS.
+func clientAuthenticate(codec *Codec, auth *ClientAuth, secure bool) (string, error) {
+	if !codec.authRequired {
+		return "", nil
+	}
+	switch {
+	case auth == nil:
+		return "", ErrAuthRequired
+	case auth.Token != "":
+		if !secure && !auth.AllowPlaintext {
+			return "", ErrPlaintextToken
+		}
+		if err := codec.writeFrame(frame{kind: frameAuth, payload: append([]byte{authBearer}, auth.Token...)}); err != nil {
+			return "", err
+		}
+	case auth.KeyID != "":
+		if err := codec.writeFrame(frame{kind: frameAuth, payload: append([]byte{authHMAC}, auth.KeyID...)}); err != nil {
+			return "", err
+		}
+		f, err := codec.readFrame()
+		if err != nil {
+			return "", err
+		}
+		switch f.kind {
+		case frameAuthResult:
+			// Refused without a challenge, such as for an unknown mechanism
+			return readAuthResult(f)
+		case frameAuthChallenge:
+		default:
+			return "", fmt.Errorf("%w: %d instead of an auth challenge", ErrUnexpectedFrame, f.kind)
+		}
+		if err := codec.writeFrame(frame{kind: frameAuthProof, payload: hmacProof(auth.Key, f.payload)}); err != nil {
+			return "", err
+		}
+	default:
+		return "", ErrAuthRequired
+	}
+
+	f, err := codec.readFrame()
+	if err != nil {
+		return "", err
+	}
+	if f.kind != frameAuthResult {
+		return "", fmt.Errorf("%w: %d instead of an auth result", ErrUnexpectedFrame, f.kind)
+	}
+	return readAuthResult(f)
+}
+
+func readAuthResult(f frame) (string, error) {
+	if len(f.payload) == 0 || f.payload[0] != authOK {
+		return "", ErrAuthFailed
+	}
+	return string(f.payload[1:]), nil
+}
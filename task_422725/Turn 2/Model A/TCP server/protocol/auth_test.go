@@ -0,0 +1,279 @@
+package protocol
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startAuthServer serves the default routes, requiring the credentials in
+// testVerifier. It takes tokens without TLS, as the tests dial plain TCP;
+// their clients send them with plaintextToken.
+func startAuthServer(t *testing.T, authTimeout time.Duration) string {
+	t.Helper()
+	addr, _ := startServer(t, &Server{
+		Handler:              newRouter().ServeRequest,
+		Verifier:             testVerifier(),
+		AuthTimeout:          authTimeout,
+		AllowPlaintextTokens: true,
+	})
+	return addr
+}
+
+func testVerifier() *StaticVerifier {
+	return &StaticVerifier{
+		Tokens: map[string]string{"s3cret": "alice"},
+		Keys:   map[string][]byte{"bob": []byte("bob's key")},
+	}
+}
+
+// plaintextToken is the test token, to be sent without TLS.
+var plaintextToken = &ClientAuth{Token: "s3cret", AllowPlaintext: true}
+
+// startTLSAuthServer serves the default routes over TLS, requiring the
+// credentials in testVerifier, and returns its address and a config for
+// dialing it.
+func startTLSAuthServer(t *testing.T) (string, *tls.Config) {
+	t.Helper()
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "server", "server", x509.ExtKeyUsageServerAuth)
+	certs, err := NewCertReloader(TLSFiles{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("NewCertReloader failed: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	srv := &Server{Handler: newRouter().ServeRequest, Verifier: testVerifier()}
+	go srv.Serve(tls.NewListener(ln, certs.ServerConfig()))
+	t.Cleanup(func() { srv.Close() })
+
+	client, err := NewCertReloader(TLSFiles{CAFile: ca.path("ca.pem")})
+	if err != nil {
+		t.Fatalf("NewCertReloader failed: %v", err)
+	}
+	return ln.Addr().String(), client.ClientConfig("localhost")
+}
+
+func dialAuth(addr string, auth *ClientAuth) (*ClientConn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientConnAuth(conn, auth)
+}
+
+func TestAuthenticate(t *testing.T) {
+	addr := startAuthServer(t, 0)
+	tests := []struct {
+		name string
+		auth *ClientAuth
+		want string
+	}{
+		{"bearer token", plaintextToken, "alice"},
+		{"hmac key", &ClientAuth{KeyID: "bob", Key: []byte("bob's key")}, "bob"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := dialAuth(addr, tt.auth)
+			if err != nil {
+				t.Fatalf("Dial failed: %v", err)
+			}
+			defer c.Close()
+			if c.Principal() != tt.want {
+				t.Errorf("Expected principal %q, got %q", tt.want, c.Principal())
+			}
+			resp, err := c.Do(&Request{Method: "GET", Path: "/whoami"})
+			if err != nil {
+				t.Fatalf("Do failed: %v", err)
+			}
+			if resp.Body["principal"] != tt.want {
+				t.Errorf("Expected the handler to see %q, got %v", tt.want, resp.Body["principal"])
+			}
+		})
+	}
+}
+
+func TestAuthenticateRejected(t *testing.T) {
+	addr := startAuthServer(t, 0)
+	tests := []struct {
+		name string
+		auth *ClientAuth
+		want error
+	}{
+		{"no credentials", nil, ErrAuthRequired},
+		{"empty credentials", &ClientAuth{}, ErrAuthRequired},
+		{"wrong token", &ClientAuth{Token: "guess", AllowPlaintext: true}, ErrAuthFailed},
+		{"token without TLS", &ClientAuth{Token: "s3cret"}, ErrPlaintextToken},
+		{"wrong key", &ClientAuth{KeyID: "bob", Key: []byte("guess")}, ErrAuthFailed},
+		{"unknown key ID", &ClientAuth{KeyID: "mallory", Key: []byte("bob's key")}, ErrAuthFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := dialAuth(addr, tt.auth)
+			if err == nil {
+				c.Close()
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestAuthenticateRefusesTokenWithoutTLS(t *testing.T) {
+	srv := &Server{Handler: newRouter().ServeRequest, Verifier: testVerifier()}
+	plainAddr, _ := startServer(t, srv)
+	if _, err := dialAuth(plainAddr, &ClientAuth{Token: "s3cret"}); !errors.Is(err, ErrPlaintextToken) {
+		t.Errorf("Expected the client to refuse to send a token without TLS, got %v", err)
+	}
+	if _, err := dialAuth(plainAddr, plaintextToken); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("Expected the server to refuse a token without TLS, got %v", err)
+	}
+	c, err := dialAuth(plainAddr, &ClientAuth{KeyID: "bob", Key: []byte("bob's key")})
+	if err != nil {
+		t.Fatalf("Expected an HMAC key without TLS to be accepted, got %v", err)
+	}
+	c.Close()
+
+	tlsAddr, config := startTLSAuthServer(t)
+	conn, err := tls.Dial("tcp", tlsAddr, config)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	c, err = NewClientConnAuth(conn, &ClientAuth{Token: "s3cret"})
+	if err != nil {
+		t.Fatalf("Expected a token over TLS to be accepted, got %v", err)
+	}
+	defer c.Close()
+	if c.Principal() != "alice" {
+		t.Errorf("Expected principal alice, got %q", c.Principal())
+	}
+}
+
+func TestAuthenticateRequestBeforeAuthClosesConn(t *testing.T) {
+	addr := startAuthServer(t, 0)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	codec, err := ClientHandshake(conn, maxRequestSize)
+	if err != nil {
+		t.Fatalf("ClientHandshake failed: %v", err)
+	}
+	if !codec.authRequired {
+		t.Fatal("Expected the server to require authentication")
+	}
+
+	// Skipping authentication gets no answer, only a closed connection
+	if err := codec.WriteRequest(&Request{ID: 1, Method: "GET", Path: "/"}); err != nil {
+		t.Fatalf("WriteRequest failed: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if f, err := codec.readFrame(); err == nil {
+		t.Errorf("Expected the connection to be closed, got frame kind %d", f.kind)
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	addr := startAuthServer(t, 50*time.Millisecond)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	if _, err := ClientHandshake(conn, maxRequestSize); err != nil {
+		t.Fatalf("ClientHandshake failed: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	var ne net.Error
+	if err == nil || errors.As(err, &ne) && ne.Timeout() {
+		t.Errorf("Expected the server to close the silent connection, got %v", err)
+	}
+}
+
+func TestAuthNotRequired(t *testing.T) {
+	addr, _ := startServer(t, &Server{Handler: newRouter().ServeRequest})
+	c, err := dialAuth(addr, &ClientAuth{Token: "s3cret"})
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	if c.Principal() != "" {
+		t.Errorf("Expected no principal, got %q", c.Principal())
+	}
+	resp, err := c.Do(&Request{Method: "GET", Path: "/whoami"})
+	if err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+	if resp.Body["principal"] != "" {
+		t.Errorf("Expected an empty principal, got %v", resp.Body["principal"])
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	addr := startAuthServer(t, 0)
+	client := newTestClient(t, ClientOptions{Addr: addr, Auth: plaintextToken})
+	resp, err := client.Do(context.Background(), &Request{Method: "GET", Path: "/whoami"})
+	if err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+	if resp.Body["principal"] != "alice" {
+		t.Errorf("Expected principal alice, got %v", resp.Body["principal"])
+	}
+
+	client = newTestClient(t, ClientOptions{Addr: addr, MaxRetries: -1})
+	_, err = client.Do(context.Background(), &Request{Method: "GET", Path: "/whoami"})
+	var ce *ClientError
+	if !errors.As(err, &ce) || ce.Op != "connect" || !errors.Is(err, ErrAuthRequired) {
+		t.Errorf("Expected a connect error wrapping ErrAuthRequired, got %v", err)
+	}
+}
+
+func TestLoadStaticVerifier(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"valid", "# credentials\ntoken alice s3cret\n\nhmac bob 626f622773206b6579\n", false},
+		{"missing field", "token alice\n", true},
+		{"bad hex", "hmac bob zz\n", true},
+		{"unknown type", "password alice s3cret\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "creds")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+			v, err := LoadStaticVerifier(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected an error for %q", tt.content)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadStaticVerifier failed: %v", err)
+			}
+			if p, err := v.VerifyToken("s3cret"); err != nil || p != "alice" {
+				t.Errorf("Expected token to verify as alice, got %q, %v", p, err)
+			}
+			challenge := []byte("nonce")
+			if p, err := v.VerifyHMAC("bob", challenge, hmacProof([]byte("bob's key"), challenge)); err != nil || p != "bob" {
+				t.Errorf("Expected HMAC to verify as bob, got %q, %v", p, err)
+			}
+		})
+	}
+}
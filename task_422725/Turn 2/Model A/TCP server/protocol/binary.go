@@ -0,0 +1,289 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// binaryEncoding writes requests and responses as a sequence of fields:
+//
+//	request:  method string, path string, timeout uvarint, body value
+//	response: status uvarint, message string, body value
+//
+// Strings are a uvarint length followed by the bytes, and the timeout is in
+// nanoseconds. Values carry a one
+// byte tag, so bodies keep their JSON shape; as with JSON, every number
+// decodes as a float64.
+type binaryEncoding struct{}
+
+const (
+	tagNil byte = iota
+	tagFalse
+	tagTrue
+	tagInt
+	tagFloat
+	tagString
+	tagArray
+	tagMap
+)
+
+// maxValueDepth bounds nesting so a hostile payload cannot exhaust the stack.
+const maxValueDepth = 64
+
+var errTruncated = errors.New("binary payload truncated")
+
+func (binaryEncoding) ID() byte     { return 2 }
+func (binaryEncoding) Name() string { return "binary" }
+
+func (binaryEncoding) EncodeRequest(req *Request) ([]byte, error) {
+	var buf []byte
+	buf = appendString(buf, req.Method)
+	buf = appendString(buf, req.Path)
+	if req.Timeout < 0 {
+		return nil, fmt.Errorf("invalid timeout %v", req.Timeout)
+	}
+	buf = binary.AppendUvarint(buf, uint64(req.Timeout))
+	return appendBody(buf, req.Body)
+}
+
+func (binaryEncoding) DecodeRequest(data []byte) (*Request, error) {
+	d := &decoder{buf: data}
+	req := &Request{Method: d.string(), Path: d.string()}
+	timeout := d.uvarint()
+	if timeout > math.MaxInt64 && d.err == nil {
+		d.err = fmt.Errorf("invalid timeout %d", timeout)
+	}
+	req.Timeout = time.Duration(timeout)
+	req.Body = d.body()
+	return req, d.finish()
+}
+
+func (binaryEncoding) EncodeResponse(resp *Response) ([]byte, error) {
+	if resp.Status < 0 {
+		return nil, fmt.Errorf("invalid status %d", resp.Status)
+	}
+	buf := binary.AppendUvarint(nil, uint64(resp.Status))
+	buf = appendString(buf, resp.Message)
+	return appendBody(buf, resp.Body)
+}
+
+func (binaryEncoding) DecodeResponse(data []byte) (*Response, error) {
+	d := &decoder{buf: data}
+	status := d.uvarint()
+	if status > math.MaxInt32 && d.err == nil {
+		d.err = fmt.Errorf("invalid status %d", status)
+	}
+	resp := &Response{Status: int(status), Message: d.string()}
+	resp.Body = d.body()
+	return resp, d.finish()
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendBody(buf []byte, body map[string]interface{}) ([]byte, error) {
+	if body == nil {
+		return append(buf, tagNil), nil
+	}
+	return appendValue(buf, body, 0)
+}
+
+func appendValue(buf []byte, v interface{}, depth int) ([]byte, error) {
+	if depth > maxValueDepth {
+		return nil, errors.New("value nested too deeply")
+	}
+	switch v := v.(type) {
+	case nil:
+		return append(buf, tagNil), nil
+	case bool:
+		if v {
+			return append(buf, tagTrue), nil
+		}
+		return append(buf, tagFalse), nil
+	case int:
+		return appendInt(buf, int64(v)), nil
+	case int32:
+		return appendInt(buf, int64(v)), nil
+	case int64:
+		return appendInt(buf, v), nil
+	case float32:
+		return appendFloat(buf, float64(v)), nil
+	case float64:
+		return appendFloat(buf, v), nil
+	case string:
+		return appendString(append(buf, tagString), v), nil
+	case []interface{}:
+		buf = binary.AppendUvarint(append(buf, tagArray), uint64(len(v)))
+		var err error
+		for _, elem := range v {
+			if buf, err = appendValue(buf, elem, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case map[string]interface{}:
+		buf = binary.AppendUvarint(append(buf, tagMap), uint64(len(v)))
+		// Sorted keys keep the output deterministic.
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var err error
+		for _, k := range keys {
+			buf = appendString(buf, k)
+			if buf, err = appendValue(buf, v[k], depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	default:
+		return nil, fmt.Errorf("unsupported body value of type %T", v)
+	}
+}
+
+func appendInt(buf []byte, n int64) []byte {
+	return binary.AppendVarint(append(buf, tagInt), n)
+}
+
+// appendFloat writes whole numbers as varints, which is what most JSON
+// numbers are, and everything else as IEEE 754 bits.
+func appendFloat(buf []byte, f float64) []byte {
+	if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return appendInt(buf, int64(f))
+	}
+	buf = append(buf, tagFloat)
+	return binary.BigEndian.AppendUint64(buf, math.Float64bits(f))
+}
+
+// decoder reads fields from a binary payload, remembering the first error
+// so callers can check once at the end.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.buf = nil
+}
+
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.buf) > 0 {
+		d.err = fmt.Errorf("%d trailing bytes in binary payload", len(d.buf))
+	}
+	return d.err
+}
+
+func (d *decoder) byte() byte {
+	if len(d.buf) == 0 {
+		d.fail(errTruncated)
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	n, size := binary.Uvarint(d.buf)
+	if size <= 0 {
+		d.fail(errTruncated)
+		return 0
+	}
+	d.buf = d.buf[size:]
+	return n
+}
+
+func (d *decoder) varint() int64 {
+	n, size := binary.Varint(d.buf)
+	if size <= 0 {
+		d.fail(errTruncated)
+		return 0
+	}
+	d.buf = d.buf[size:]
+	return n
+}
+
+// count reads a length prefix, rejecting ones that could not fit in the rest
+// of the payload given at least min bytes per element.
+func (d *decoder) count(min int) int {
+	n := d.uvarint()
+	if n > uint64(len(d.buf)/min) {
+		d.fail(errTruncated)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) string() string {
+	n := d.count(1)
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+func (d *decoder) body() map[string]interface{} {
+	v := d.value(0)
+	if v == nil {
+		return nil
+	}
+	body, ok := v.(map[string]interface{})
+	if !ok {
+		d.fail(fmt.Errorf("body must be an object, got %T", v))
+	}
+	return body
+}
+
+func (d *decoder) value(depth int) interface{} {
+	if depth > maxValueDepth {
+		d.fail(errors.New("value nested too deeply"))
+		return nil
+	}
+	switch tag := d.byte(); tag {
+	case tagNil:
+		return nil
+	case tagFalse:
+		return false
+	case tagTrue:
+		return true
+	case tagInt:
+		return float64(d.varint())
+	case tagFloat:
+		if len(d.buf) < 8 {
+			d.fail(errTruncated)
+			return nil
+		}
+		f := math.Float64frombits(binary.BigEndian.Uint64(d.buf))
+		d.buf = d.buf[8:]
+		return f
+	case tagString:
+		return d.string()
+	case tagArray:
+		arr := make([]interface{}, d.count(1))
+		for i := 0; i < len(arr) && d.err == nil; i++ {
+			arr[i] = d.value(depth + 1)
+		}
+		return arr
+	case tagMap:
+		// Each entry is at least an empty key and a tag.
+		n := d.count(2)
+		m := make(map[string]interface{}, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			k := d.string()
+			m[k] = d.value(depth + 1)
+		}
+		return m
+	default:
+		d.fail(fmt.Errorf("unknown value tag %d", tag))
+		return nil
+	}
+}
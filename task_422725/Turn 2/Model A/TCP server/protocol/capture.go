@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CaptureEntry is one line of a capture file: a request as the server
+// decoded it or a response as it sent it, on the connection numbered Conn.
+// A request that would not decode has Error and its Raw payload instead.
+// Streamed bodies are not recorded, only flagged with Stream.
+type CaptureEntry struct {
+	Time     time.Time `json:"time"`
+	Conn     uint64    `json:"conn"`
+	Remote   string    `json:"remote,omitempty"`
+	ID       uint32    `json:"id"`
+	Request  *Request  `json:"request,omitempty"`
+	Response *Response `json:"response,omitempty"`
+	Stream   bool      `json:"stream,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Raw      []byte    `json:"raw,omitempty"`
+}
+
+// Capture records the traffic of a Server as JSON lines, one CaptureEntry
+// each. Entries are written as they happen, so a capture is readable up to
+// the moment a server crashed.
+type Capture struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+	err    error
+
+	lastConn atomic.Uint64
+}
+
+// NewCapture records to w.
+func NewCapture(w io.Writer) *Capture {
+	return &Capture{enc: json.NewEncoder(w)}
+}
+
+// CreateCapture records to a new file at path, replacing any there.
+func CreateCapture(path string) (*Capture, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	c := NewCapture(f)
+	c.closer = f
+	return c, nil
+}
+
+// Close closes the file of a Capture from CreateCapture and returns the
+// first error recording hit, if any.
+func (c *Capture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closer != nil {
+		if err := c.closer.Close(); c.err == nil {
+			c.err = err
+		}
+		c.closer = nil
+	}
+	return c.err
+}
+
+// conn starts recording a new connection.
+func (c *Capture) conn(remote string) *connCapture {
+	return &connCapture{c: c, id: c.lastConn.Add(1), remote: remote}
+}
+
+func (c *Capture) record(e *CaptureEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	// A failed capture must not take the server down with it, so the
+	// error is kept for Close and recording stops
+	c.err = c.enc.Encode(e)
+}
+
+// connCapture records one connection's requests and responses.
+type connCapture struct {
+	c      *Capture
+	id     uint64
+	remote string
+}
+
+func (cc *connCapture) request(req *Request, stream bool) {
+	cc.c.record(&CaptureEntry{
+		Time:    time.Now(),
+		Conn:    cc.id,
+		Remote:  cc.remote,
+		ID:      req.ID,
+		Request: req,
+		Stream:  stream,
+	})
+}
+
+func (cc *connCapture) malformed(f frame, err error) {
+	cc.c.record(&CaptureEntry{
+		Time:   time.Now(),
+		Conn:   cc.id,
+		Remote: cc.remote,
+		ID:     f.id,
+		Error:  err.Error(),
+		Raw:    f.payload,
+	})
+}
+
+func (cc *connCapture) response(resp *Response) {
+	cc.c.record(&CaptureEntry{
+		Time:     time.Now(),
+		Conn:     cc.id,
+		Remote:   cc.remote,
+		ID:       resp.ID,
+		Response: resp,
+		Stream:   resp.Stream != nil,
+	})
+}
+
+// ReadCapture reads the entries of a capture file.
+func ReadCapture(r io.Reader) ([]CaptureEntry, error) {
+	var entries []CaptureEntry
+	scanner := bufio.NewScanner(r)
+	// A line holds a whole request or response, up to a frame's size
+	scanner.Buffer(nil, 4*maxRequestSize)
+	for line := 1; scanner.Scan(); line++ {
+		var e CaptureEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,226 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureSession runs requests on two connections to a capturing server
+// and returns what was captured.
+func captureSession(t *testing.T) []CaptureEntry {
+	t.Helper()
+	var buf bytes.Buffer
+	capture := NewCapture(&buf)
+	srv := &Server{Handler: newRouter().ServeRequest, Capture: capture}
+	addr, _ := startServer(t, srv)
+
+	first := dialServer(t, addr)
+	second := dialServer(t, addr)
+	requests := []struct {
+		c   *ClientConn
+		req *Request
+	}{
+		{first, &Request{Method: "GET", Path: "/items/1"}},
+		{second, &Request{Method: "POST", Path: "/items", Body: map[string]interface{}{"name": "widget"}}},
+		{first, &Request{Method: "DELETE", Path: "/items"}},
+		{first, &Request{Method: "POST", Path: "/upload", Stream: strings.NewReader("data")}},
+	}
+	for _, r := range requests {
+		if _, err := r.c.Do(r.req); err != nil {
+			t.Fatalf("Do %s %s failed: %v", r.req.Method, r.req.Path, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	first.Close()
+	second.Close()
+	srv.Close()
+	if err := capture.Close(); err != nil {
+		t.Fatalf("Capture failed: %v", err)
+	}
+
+	entries, err := ReadCapture(&buf)
+	if err != nil {
+		t.Fatalf("ReadCapture failed: %v", err)
+	}
+	return entries
+}
+
+func TestCapture(t *testing.T) {
+	entries := captureSession(t)
+	if len(entries) != 8 {
+		t.Fatalf("Expected 8 entries, got %d", len(entries))
+	}
+
+	conns := make(map[uint64]int)
+	for i, e := range entries {
+		if e.Time.IsZero() || e.Remote == "" {
+			t.Errorf("Entry %d: expected a time and remote address, got %+v", i, e)
+		}
+		if i > 0 && e.Time.Before(entries[i-1].Time) {
+			t.Errorf("Entry %d: expected entries in time order", i)
+		}
+		conns[e.Conn]++
+		// Each request is followed by its response
+		if i%2 == 0 {
+			if e.Request == nil {
+				t.Fatalf("Entry %d: expected a request, got %+v", i, e)
+			}
+		} else if e.Response == nil || e.ID != entries[i-1].ID || e.Conn != entries[i-1].Conn {
+			t.Fatalf("Entry %d: expected the response to entry %d, got %+v", i, i-1, e)
+		}
+	}
+	if len(conns) != 2 || conns[entries[0].Conn] != 6 {
+		t.Errorf("Expected 6 entries on one connection and 2 on another, got %v", conns)
+	}
+	if e := entries[2]; e.Request.Path != "/items" || e.Request.Body["name"] != "widget" {
+		t.Errorf("Expected the POST body to be captured, got %+v", e.Request)
+	}
+	if e := entries[5]; e.Response.Status != 405 {
+		t.Errorf("Expected a captured 405, got %+v", e.Response)
+	}
+	if e := entries[6]; !e.Stream {
+		t.Errorf("Expected the upload to be marked as streamed, got %+v", e)
+	}
+}
+
+func TestCaptureMalformedRequest(t *testing.T) {
+	var buf bytes.Buffer
+	capture := NewCapture(&buf)
+	codec := newCodec(&bytes.Buffer{}, maxRequestSize)
+	codec.enc = JSONEncoding
+	codec.capture = capture.conn("client")
+
+	if _, err := codec.decodeRequest(frame{kind: frameRequest, id: 7, payload: []byte("GET:/items")}); err == nil {
+		t.Fatal("Expected a decode error")
+	}
+	entries, err := ReadCapture(&buf)
+	if err != nil {
+		t.Fatalf("ReadCapture failed: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(entries))
+	}
+	if e := entries[0]; e.ID != 7 || e.Error == "" || string(e.Raw) != "GET:/items" {
+		t.Errorf("Expected the raw payload and error, got %+v", e)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	entries := captureSession(t)
+
+	tests := []struct {
+		name    string
+		handler HandlerFunc
+		fast    bool
+		diffs   int
+	}{
+		{"same server", newRouter().ServeRequest, true, 0},
+		{"same server, timed", newRouter().ServeRequest, false, 0},
+		{"changed server", func(req *Request) *Response {
+			if req.Method == "POST" {
+				return &Response{Status: 201, Message: "Created", Body: map[string]interface{}{"name": "gadget"}}
+			}
+			return newRouter().ServeRequest(req)
+		}, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, _ := startServer(t, &Server{Handler: tt.handler})
+			began := time.Now()
+			report, err := Replay(context.Background(), entries, ReplayOptions{Addr: addr, Fast: tt.fast})
+			if err != nil {
+				t.Fatalf("Replay failed: %v", err)
+			}
+			if report.Sent != 3 || report.Skipped != 1 {
+				t.Errorf("Expected 3 sent and 1 skipped, got %d and %d", report.Sent, report.Skipped)
+			}
+			if len(report.Diffs) != tt.diffs {
+				t.Fatalf("Expected %d diffs, got %v", tt.diffs, report.Diffs)
+			}
+			if tt.diffs > 0 {
+				if diff := report.Diffs[0].String(); !strings.Contains(diff, "body.name: widget -> gadget") {
+					t.Errorf("Expected the diff to show the changed body, got %q", diff)
+				}
+			}
+			// The third request was captured about 40ms after the first
+			if elapsed := time.Since(began); !tt.fast && elapsed < 35*time.Millisecond {
+				t.Errorf("Expected a timed replay to keep the captured spacing, took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestReplayDialsWhenFirstRequestIsDue(t *testing.T) {
+	entries := captureSession(t)
+	// The second connection's request now comes well after the first's
+	for i := range entries {
+		if entries[i].Conn != entries[0].Conn {
+			entries[i].Time = entries[i].Time.Add(200 * time.Millisecond)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+
+	addr, _ := startServer(t, &Server{Handler: newRouter().ServeRequest, IdleTimeout: 100 * time.Millisecond})
+	report, err := Replay(context.Background(), entries, ReplayOptions{Addr: addr})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if report.Sent != 3 || len(report.Diffs) != 0 {
+		t.Errorf("Expected 3 requests sent without diffs, got %d and %v", report.Sent, report.Diffs)
+	}
+}
+
+func TestReplayReportsFailedConnections(t *testing.T) {
+	entries := captureSession(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	ln.Close()
+
+	report, err := Replay(context.Background(), entries, ReplayOptions{Addr: ln.Addr().String(), Fast: true})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(report.Diffs) != 3 {
+		t.Fatalf("Expected a diff for each request, got %v", report.Diffs)
+	}
+	if diff := report.Diffs[0].String(); !strings.Contains(diff, "connecting") {
+		t.Errorf("Expected the diff to show the connect error, got %q", diff)
+	}
+}
+
+func TestReplaySendsTokenOnlyOverTLS(t *testing.T) {
+	entries := captureSession(t)
+	tlsAddr, config := startTLSAuthServer(t)
+	plainAddr := startAuthServer(t, 0)
+	auth := &ClientAuth{Token: "s3cret"}
+
+	report, err := Replay(context.Background(), entries, ReplayOptions{Addr: tlsAddr, TLS: config, Auth: auth, Fast: true})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if report.Sent != 3 || len(report.Diffs) != 0 {
+		t.Errorf("Expected 3 requests sent over TLS without diffs, got %d and %v", report.Sent, report.Diffs)
+	}
+
+	report, err = Replay(context.Background(), entries, ReplayOptions{Addr: plainAddr, Auth: auth, Fast: true})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(report.Diffs) != 3 || !errors.Is(report.Diffs[0].Err, ErrPlaintextToken) {
+		t.Errorf("Expected every request to fail without TLS, got %v", report.Diffs)
+	}
+}
+
+func TestReadCaptureRejectsGarbage(t *testing.T) {
+	if _, err := ReadCapture(strings.NewReader("{}\nnot json\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Expected an error on line 2, got %v", err)
+	}
+}
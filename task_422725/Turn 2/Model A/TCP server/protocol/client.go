@@ -0,0 +1,313 @@
+package protocol
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// Client defaults, used for zero fields of ClientOptions.
+const (
+	defaultMaxConns     = 4
+	defaultWriteTimeout = 10 * time.Second
+	defaultReadTimeout  = 30 * time.Second
+	defaultMaxRetries   = 2
+	defaultRetryBackoff = 50 * time.Millisecond
+	maxRetryBackoff     = 2 * time.Second
+)
+
+// ErrClientClosed is returned by calls on a closed Client.
+var ErrClientClosed = errors.New("client closed")
+
+// ClientError reports which step of a request failed: "connect" (dialing
+// and the handshake), "write" (sending the request) or "read" (waiting for
+// the response). Err is the cause, such as a context error, ErrConnClosed
+// or a net.Error.
+type ClientError struct {
+	Op   string
+	Addr string
+	Err  error
+}
+
+func (e *ClientError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Addr, e.Err)
+}
+
+func (e *ClientError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the step failed by running out of time.
+func (e *ClientError) Timeout() bool {
+	var ne net.Error
+	return errors.Is(e.Err, context.DeadlineExceeded) || (errors.As(e.Err, &ne) && ne.Timeout())
+}
+
+// ClientOptions configures a Client. Only Addr is required.
+type ClientOptions struct {
+	// Addr is the server's address, which may name a transport as
+	// Server.ListenAndServe describes.
+	Addr string
+	// TLS, if set, is used for every connection.
+	TLS *tls.Config
+	// Encodings are offered at handshake, most preferred first.
+	Encodings []Encoding
+	// Auth holds the credentials used if the server asks for them.
+	Auth *ClientAuth
+	// MaxConns caps the pooled connections. Each carries up to maxInFlight
+	// requests at once, so a few go a long way.
+	MaxConns int
+
+	// ConnectTimeout bounds dialing and the handshake, WriteTimeout each
+	// write to the connection, and ReadTimeout the wait for a response
+	// once the request is written. Zero means the default; the context
+	// passed to Do can shorten any of them.
+	ConnectTimeout time.Duration
+	WriteTimeout   time.Duration
+	ReadTimeout    time.Duration
+
+	// MaxRetries is how many times a failed idempotent request is retried,
+	// waiting RetryBackoff, then twice that, and so on, with jitter. A
+	// negative MaxRetries disables retries.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// Client sends requests to one server over a pool of multiplexed
+// connections, dialing them as load needs and dropping them when they
+// fail. It is safe for concurrent use.
+type Client struct {
+	opts ClientOptions
+
+	mu      sync.Mutex
+	conns   []*ClientConn
+	dialing int
+	closed  bool
+}
+
+// NewClient returns a client for opts.Addr. Connections are made on demand.
+func NewClient(opts ClientOptions) *Client {
+	if opts.MaxConns <= 0 {
+		opts.MaxConns = defaultMaxConns
+	}
+	if opts.ConnectTimeout <= 0 {
+		opts.ConnectTimeout = connectTimeout
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = defaultWriteTimeout
+	}
+	if opts.ReadTimeout <= 0 {
+		opts.ReadTimeout = defaultReadTimeout
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = defaultMaxRetries
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = defaultRetryBackoff
+	}
+	return &Client{opts: opts}
+}
+
+// Do sends req and returns the server's response, whatever its status.
+// Errors are *ClientError, or ErrClientClosed. A request is retried on a
+// failed connect, and an idempotent one also after a failed write or read
+// or a 503 answer; requests with a Stream body are never retried, as it
+// cannot be sent twice. A streamed response body is discarded; use
+// DoStream to read it.
+func (c *Client) Do(ctx context.Context, req *Request) (*Response, error) {
+	resp, body, err := c.DoStream(ctx, req)
+	if body != nil {
+		body.Close()
+	}
+	return resp, err
+}
+
+// DoStream is like Do, and also returns the response body if the server
+// streamed one. The caller must close a non-nil body.
+func (c *Client) DoStream(ctx context.Context, req *Request) (*Response, io.ReadCloser, error) {
+	for attempt := 0; ; attempt++ {
+		resp, body, err := c.try(ctx, req)
+		if attempt >= c.opts.MaxRetries || !c.shouldRetry(req, resp, err) {
+			return resp, body, err
+		}
+		if body != nil {
+			body.Close()
+		}
+		if sleepCtx(ctx, c.backoff(attempt)) != nil {
+			return resp, nil, err
+		}
+	}
+}
+
+func (c *Client) try(ctx context.Context, req *Request) (*Response, io.ReadCloser, error) {
+	conn, err := c.get(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn.doStream(ctx, req, c.opts.ReadTimeout, nil)
+}
+
+func (c *Client) shouldRetry(req *Request, resp *Response, err error) bool {
+	if req.Stream != nil || errors.Is(err, ErrClientClosed) {
+		return false
+	}
+	var ce *ClientError
+	if errors.As(err, &ce) {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return false
+		}
+		// Nothing reached the server, so any request can be retried
+		return ce.Op == "connect" || idempotent(req.Method)
+	}
+	return err == nil && resp != nil && resp.Status == 503 && idempotent(req.Method)
+}
+
+// idempotent reports whether sending a request with method twice has the
+// same effect as sending it once.
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// backoff returns the wait before retry attempt+1: exponential, capped,
+// with full jitter so clients that failed together do not retry together.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := min(c.opts.RetryBackoff<<attempt, maxRetryBackoff)
+	return rand.N(d) + 1
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Subscribe subscribes to path on one of the pooled connections. It is not
+// retried; if the connection fails, the subscription ends with its error
+// and the caller may subscribe again.
+func (c *Client) Subscribe(ctx context.Context, path string) (*Subscription, error) {
+	conn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return conn.Subscribe(ctx, path)
+}
+
+// get returns the least loaded live connection, dialing a new one when all
+// are busy and the pool has room.
+func (c *Client) get(ctx context.Context) (*ClientConn, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClientClosed
+	}
+	live := c.conns[:0]
+	for _, conn := range c.conns {
+		if conn.Err() == nil {
+			live = append(live, conn)
+		} else {
+			conn.Close()
+		}
+	}
+	clear(c.conns[len(live):])
+	c.conns = live
+
+	var best *ClientConn
+	for _, conn := range c.conns {
+		if best == nil || len(conn.slots) < len(best.slots) {
+			best = conn
+		}
+	}
+	if best != nil && (len(best.slots) == 0 || len(c.conns)+c.dialing >= c.opts.MaxConns) {
+		c.mu.Unlock()
+		return best, nil
+	}
+	c.dialing++
+	c.mu.Unlock()
+
+	conn, err := c.dial(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dialing--
+	if err != nil {
+		if best != nil {
+			// Busy beats broken
+			return best, nil
+		}
+		return nil, err
+	}
+	if c.closed {
+		conn.Close()
+		return nil, ErrClientClosed
+	}
+	c.conns = append(c.conns, conn)
+	return conn, nil
+}
+
+func (c *Client) dial(ctx context.Context) (*ClientConn, error) {
+	fail := func(err error) error {
+		return &ClientError{Op: "connect", Addr: c.opts.Addr, Err: err}
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.opts.ConnectTimeout)
+	defer cancel()
+
+	conn, err := dialAddr(ctx, c.opts.Addr, c.opts.TLS)
+	if err != nil {
+		return nil, fail(err)
+	}
+
+	// The handshake and authentication are bounded by the same deadline
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	cc, err := newClientConn(&writeTimeoutConn{Conn: conn, timeout: c.opts.WriteTimeout}, c.opts.Encodings, c.opts.Auth)
+	if !stop() || err != nil {
+		if err == nil {
+			cc.Close()
+			err = ctx.Err()
+		}
+		return nil, fail(err)
+	}
+	conn.SetDeadline(time.Time{})
+	return cc, nil
+}
+
+// Close closes every pooled connection, failing requests in flight.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	conns := c.conns
+	c.conns, c.closed = nil, true
+	c.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// writeTimeoutConn gives every write its own deadline, so a peer that
+// stops reading fails the write instead of blocking it forever. Writes are
+// serialized by the Codec, so the deadlines never overlap.
+type writeTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *writeTimeoutConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
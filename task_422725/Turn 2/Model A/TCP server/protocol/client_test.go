@@ -0,0 +1,195 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testServer serves handler on a loopback port, counting connections.
+type testServer struct {
+	ln       net.Listener
+	accepted atomic.Int32
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newTestServer(t *testing.T, handler HandlerFunc) *testServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	s := &testServer{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.accepted.Add(1)
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go handleConn(conn, handler)
+		}
+	}()
+	return s
+}
+
+// dropConns closes every connection accepted so far.
+func (s *testServer) dropConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func newTestClient(t *testing.T, opts ClientOptions) *Client {
+	t.Helper()
+	if opts.RetryBackoff == 0 {
+		opts.RetryBackoff = time.Millisecond
+	}
+	c := NewClient(opts)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClientReusesPooledConnections(t *testing.T) {
+	srv := newTestServer(t, func(req *Request) *Response {
+		time.Sleep(time.Millisecond)
+		return &Response{Status: 200}
+	})
+	c := newTestClient(t, ClientOptions{Addr: srv.ln.Addr().String(), MaxConns: 2})
+
+	for i := 0; i < 5; i++ {
+		if _, err := c.Do(context.Background(), &Request{Method: "GET", Path: "/"}); err != nil {
+			t.Fatalf("Do failed: %v", err)
+		}
+	}
+	if n := srv.accepted.Load(); n != 1 {
+		t.Errorf("Expected sequential requests to share one connection, got %d", n)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4*maxInFlight; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Do(context.Background(), &Request{Method: "GET", Path: "/"}); err != nil {
+				t.Errorf("Do failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := srv.accepted.Load(); n > 2 {
+		t.Errorf("Expected at most 2 connections, got %d", n)
+	}
+}
+
+func TestClientReconnectsAfterServerDrop(t *testing.T) {
+	srv := newTestServer(t, func(req *Request) *Response {
+		return &Response{Status: 200}
+	})
+	c := newTestClient(t, ClientOptions{Addr: srv.ln.Addr().String()})
+
+	if _, err := c.Do(context.Background(), &Request{Method: "GET", Path: "/"}); err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+	srv.dropConns()
+	if _, err := c.Do(context.Background(), &Request{Method: "GET", Path: "/"}); err != nil {
+		t.Fatalf("Expected the request to succeed on a new connection, got %v", err)
+	}
+	if n := srv.accepted.Load(); n != 2 {
+		t.Errorf("Expected 2 connections, got %d", n)
+	}
+}
+
+func TestClientRetriesOnlyIdempotentRequests(t *testing.T) {
+	var calls atomic.Int32
+	srv := newTestServer(t, func(req *Request) *Response {
+		if calls.Add(1)%2 == 1 {
+			return &Response{Status: 503, Message: "Busy"}
+		}
+		return &Response{Status: 200}
+	})
+	c := newTestClient(t, ClientOptions{Addr: srv.ln.Addr().String()})
+
+	resp, err := c.Do(context.Background(), &Request{Method: "GET", Path: "/"})
+	if err != nil || resp.Status != 200 {
+		t.Fatalf("Expected GET to be retried to a 200, got %+v, %v", resp, err)
+	}
+
+	calls.Store(0)
+	resp, err = c.Do(context.Background(), &Request{Method: "POST", Path: "/"})
+	if err != nil || resp.Status != 503 {
+		t.Fatalf("Expected POST not to be retried, got %+v, %v", resp, err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected one POST attempt, got %d", n)
+	}
+}
+
+func TestClientConnectError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	c := newTestClient(t, ClientOptions{Addr: addr})
+	_, err = c.Do(context.Background(), &Request{Method: "POST", Path: "/"})
+	var ce *ClientError
+	if !errors.As(err, &ce) || ce.Op != "connect" {
+		t.Fatalf("Expected a connect ClientError, got %v", err)
+	}
+}
+
+func TestClientTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	srv := newTestServer(t, func(req *Request) *Response {
+		<-release
+		return &Response{Status: 200}
+	})
+
+	tests := []struct {
+		name    string
+		opts    ClientOptions
+		timeout time.Duration
+		wantCtx bool
+	}{
+		{"read timeout", ClientOptions{ReadTimeout: 20 * time.Millisecond, MaxRetries: -1}, time.Second, false},
+		{"context deadline", ClientOptions{}, 20 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Addr = srv.ln.Addr().String()
+			c := newTestClient(t, tt.opts)
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+
+			start := time.Now()
+			_, err := c.Do(ctx, &Request{Method: "GET", Path: "/slow"})
+			var ce *ClientError
+			if !errors.As(err, &ce) || ce.Op != "read" || !ce.Timeout() {
+				t.Fatalf("Expected a read timeout, got %v", err)
+			}
+			if got := errors.Is(err, context.DeadlineExceeded); got != tt.wantCtx {
+				t.Errorf("errors.Is(err, context.DeadlineExceeded) = %v, want %v", got, tt.wantCtx)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("Expected the call to give up promptly, took %v", elapsed)
+			}
+		})
+	}
+}
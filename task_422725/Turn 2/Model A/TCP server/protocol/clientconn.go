@@ -0,0 +1,360 @@
+package protocol
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrConnClosed is returned for requests on a closed ClientConn, including
+// ones still waiting for a response when it was closed.
+var ErrConnClosed = errors.New("connection closed")
+
+// ClientConn is a client connection that carries many requests at once.
+// Each request gets its own ID and Do waits for the response with that ID,
+// in whatever order the server answers. At most maxInFlight requests are
+// outstanding, matching what the server accepts; further calls wait.
+type ClientConn struct {
+	conn      net.Conn
+	codec     *Codec
+	principal string
+	streams   *streamSet
+	slots     chan struct{}
+
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan result
+	subs    map[uint32]*Subscription
+	err     error // why the connection stopped, once it has
+
+	done chan struct{}
+}
+
+type result struct {
+	resp *Response
+	body *recvStream
+	err  error
+}
+
+// connectTimeout bounds how long Dial waits for the connection.
+const connectTimeout = 5 * time.Second
+
+// Dial connects to a server at addr, which may name a transport as
+// Server.ListenAndServe describes.
+func Dial(addr string, prefer ...Encoding) (*ClientConn, error) {
+	return DialTLS(addr, nil, prefer...)
+}
+
+// DialTLS connects to a server at addr over TLS, or without it if config is
+// nil.
+func DialTLS(addr string, config *tls.Config, prefer ...Encoding) (*ClientConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+	conn, err := dialAddr(ctx, addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientConn(conn, prefer...)
+}
+
+// NewClientConn performs the handshake on conn and starts reading responses.
+// It fails with ErrAuthRequired if the server requires authentication.
+func NewClientConn(conn net.Conn, prefer ...Encoding) (*ClientConn, error) {
+	return newClientConn(conn, prefer, nil)
+}
+
+// NewClientConnAuth is like NewClientConn, and authenticates with auth if
+// the server asks.
+func NewClientConnAuth(conn net.Conn, auth *ClientAuth, prefer ...Encoding) (*ClientConn, error) {
+	return newClientConn(conn, prefer, auth)
+}
+
+func newClientConn(conn net.Conn, prefer []Encoding, auth *ClientAuth) (*ClientConn, error) {
+	codec, err := ClientHandshake(conn, maxRequestSize, prefer...)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handshake: %w", err)
+	}
+	principal, err := clientAuthenticate(codec, auth, isTLS(conn))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("authenticate: %w", err)
+	}
+	c := &ClientConn{
+		conn:      conn,
+		codec:     codec,
+		principal: principal,
+		streams:   newStreamSet(codec),
+		slots:     make(chan struct{}, maxInFlight),
+		pending:   make(map[uint32]chan result),
+		subs:      make(map[uint32]*Subscription),
+		done:      make(chan struct{}),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// isTLS reports whether conn, or the connection a writeTimeoutConn wraps,
+// is TLS.
+func isTLS(conn net.Conn) bool {
+	if wc, ok := conn.(*writeTimeoutConn); ok {
+		conn = wc.Conn
+	}
+	_, ok := conn.(*tls.Conn)
+	return ok
+}
+
+// Do sends req and waits for its response. It is safe to call from several
+// goroutines; the request's ID is assigned here. A streamed response body
+// is discarded; use DoStream to read it.
+func (c *ClientConn) Do(req *Request) (*Response, error) {
+	resp, body, err := c.DoStream(req)
+	if body != nil {
+		body.Close()
+	}
+	return resp, err
+}
+
+// DoStream is like Do, and also returns the response body if the server
+// streamed one, or nil otherwise. The caller must read it to the end or
+// close it. If req.Stream is set it is uploaded as the request body, while
+// the response is awaited; a server that answers without reading all of
+// it stops the upload.
+func (c *ClientConn) DoStream(req *Request) (*Response, io.ReadCloser, error) {
+	return c.doStream(context.Background(), req, 0, nil)
+}
+
+// doStream sends req and waits for its response until ctx is done or, if
+// readTimeout is set, until readTimeout after the request was written. An
+// abandoned request's upload is aborted and its response dropped when it
+// comes. Errors are *ClientError, naming the step that failed. If sub is
+// set it is registered under the request's ID before the request is sent,
+// so no event can arrive ahead of it.
+func (c *ClientConn) doStream(ctx context.Context, req *Request, readTimeout time.Duration, sub *Subscription) (*Response, io.ReadCloser, error) {
+	select {
+	case c.slots <- struct{}{}:
+	case <-c.done:
+		return nil, nil, c.opError("write", c.Err())
+	case <-ctx.Done():
+		return nil, nil, c.opError("write", ctx.Err())
+	}
+	ch := make(chan result, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		<-c.slots
+		return nil, nil, c.opError("write", err)
+	}
+	c.nextID++
+	if c.nextID == 0 {
+		// Zero is reserved for handshake frames
+		c.nextID++
+	}
+	id := c.nextID
+	c.pending[id] = ch
+	if sub != nil {
+		sub.ID = id
+		c.subs[id] = sub
+	}
+	c.mu.Unlock()
+
+	out := *req
+	out.ID = id
+	var upload *sendStream
+	if out.Stream != nil {
+		upload = c.streams.openSend(id)
+	}
+	if err := c.codec.WriteRequest(&out); err != nil {
+		c.forget(id)
+		if upload != nil {
+			upload.fail(err)
+			upload.finish(err)
+		}
+		<-c.slots
+		return nil, nil, c.opError("write", err)
+	}
+	if upload != nil {
+		go func() {
+			_, err := io.Copy(upload, out.Stream)
+			upload.finish(err)
+		}()
+	}
+
+	var timeout <-chan time.Time
+	if readTimeout > 0 {
+		timer := time.NewTimer(readTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var r result
+	select {
+	case r = <-ch:
+	case <-c.done:
+		// The response may have arrived just before the connection stopped
+		select {
+		case r = <-ch:
+		default:
+			r.err = c.Err()
+		}
+	case <-ctx.Done():
+		return nil, nil, c.abandon(id, ch, upload, ctx.Err())
+	case <-timeout:
+		return nil, nil, c.abandon(id, ch, upload, os.ErrDeadlineExceeded)
+	}
+	if r.err != nil {
+		r.err = c.opError("read", r.err)
+	}
+	if r.body == nil {
+		<-c.slots
+		return r.resp, nil, r.err
+	}
+	// The server holds its slot until the body is sent
+	return r.resp, &responseBody{recvStream: r.body, release: func() { <-c.slots }}, nil
+}
+
+// abandon gives up waiting for the response to id. If the response won the
+// race it is discarded.
+func (c *ClientConn) abandon(id uint32, ch chan result, upload *sendStream, err error) error {
+	c.mu.Lock()
+	_, waiting := c.pending[id]
+	delete(c.pending, id)
+	c.mu.Unlock()
+	if upload != nil {
+		upload.abort(err)
+	}
+	if !waiting {
+		// readLoop has claimed the response and is about to deliver it
+		go func() {
+			if r := <-ch; r.body != nil {
+				r.body.Close()
+			}
+		}()
+	}
+	<-c.slots
+	return c.opError("read", err)
+}
+
+// responseBody frees the request's slot once the body is done with.
+type responseBody struct {
+	*recvStream
+	once    sync.Once
+	release func()
+}
+
+func (b *responseBody) Read(p []byte) (int, error) {
+	n, err := b.recvStream.Read(p)
+	if err != nil {
+		b.once.Do(b.release)
+	}
+	return n, err
+}
+
+func (b *responseBody) Close() error {
+	err := b.recvStream.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// opError wraps err, unless it is nil, as a failure of op on this connection.
+func (c *ClientConn) opError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ClientError{Op: op, Addr: c.conn.RemoteAddr().String(), Err: err}
+}
+
+// Principal returns who the server authenticated the connection as, or ""
+// if it did not ask.
+func (c *ClientConn) Principal() string {
+	return c.principal
+}
+
+// Err returns why the connection stopped, or nil while it is usable.
+func (c *ClientConn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close closes the connection, failing requests and bodies still in flight.
+func (c *ClientConn) Close() error {
+	c.stop(ErrConnClosed)
+	err := c.conn.Close()
+	<-c.done
+	return err
+}
+
+func (c *ClientConn) forget(id uint32) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// stop records why the connection stopped, keeping the first reason, and
+// ends the subscriptions with it.
+func (c *ClientConn) stop(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	for id, sub := range c.subs {
+		delete(c.subs, id)
+		sub.finish(c.err)
+	}
+}
+
+func (c *ClientConn) readLoop() {
+	defer close(c.done)
+	for {
+		f, err := c.codec.readFrame()
+		if err == nil && (f.kind == frameEvent || f.kind == frameSubscriptionEnd) {
+			c.dispatchEvent(f)
+			continue
+		}
+		if err == nil && isStreamFrame(f.kind) {
+			err = c.streams.handle(f)
+			if err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("%w: %v", ErrConnClosed, err)
+			c.stop(err)
+			c.streams.closeAll(err)
+			return
+		}
+
+		resp, err := c.codec.decodeResponse(f)
+		var body *recvStream
+		if f.flags&flagStream != 0 {
+			// Opened before reading on, as the body follows right away
+			body = c.streams.openRecv(f.id)
+			if err != nil {
+				body.Close()
+				body = nil
+			}
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[f.id]
+		delete(c.pending, f.id)
+		c.mu.Unlock()
+		if !ok {
+			log.Printf("Dropping response for unknown request %d", f.id)
+			if body != nil {
+				body.Close()
+			}
+			continue
+		}
+		ch <- result{resp: resp, body: body, err: err}
+	}
+}
@@ -0,0 +1,109 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pipeClient connects a ClientConn to handleConn serving handler.
+func pipeClient(t *testing.T, handler HandlerFunc) *ClientConn {
+	t.Helper()
+	a, b := net.Pipe()
+	go handleConn(b, handler)
+	c, err := NewClientConn(a)
+	if err != nil {
+		t.Fatalf("NewClientConn failed: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClientConnMultiplexesRequests(t *testing.T) {
+	c := pipeClient(t, func(req *Request) *Response {
+		// Later requests finish first, so responses come back out of order
+		n := req.Body["n"].(float64)
+		time.Sleep(time.Duration(10-n) * time.Millisecond)
+		return &Response{Status: 200, Body: map[string]interface{}{"path": req.Path}}
+	})
+
+	var wg sync.WaitGroup
+	for n := 0; n < 10; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path := fmt.Sprintf("/req/%d", n)
+			resp, err := c.Do(&Request{Method: "GET", Path: path, Body: map[string]interface{}{"n": float64(n)}})
+			if err != nil {
+				t.Errorf("Do(%s) failed: %v", path, err)
+				return
+			}
+			if resp.Body["path"] != path {
+				t.Errorf("Do(%s) got the response for %v", path, resp.Body["path"])
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestServerLimitsRequestsInFlight(t *testing.T) {
+	var running, peak atomic.Int32
+	c := pipeClient(t, func(req *Request) *Response {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		return &Response{Status: 200}
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3*maxInFlight; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Do(&Request{Method: "GET", Path: "/"}); err != nil {
+				t.Errorf("Do failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if p := peak.Load(); p > maxInFlight {
+		t.Errorf("Expected at most %d concurrent requests, saw %d", maxInFlight, p)
+	} else if p < 2 {
+		t.Errorf("Expected requests to run concurrently, peak was %d", p)
+	}
+}
+
+func TestClientConnFailsPendingOnClose(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	c := pipeClient(t, func(req *Request) *Response {
+		<-release
+		return &Response{Status: 200}
+	})
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.Do(&Request{Method: "GET", Path: "/slow"})
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+
+	if err := <-errs; !errors.Is(err, ErrConnClosed) {
+		t.Errorf("Expected ErrConnClosed for the pending request, got %v", err)
+	}
+	if _, err := c.Do(&Request{Method: "GET", Path: "/"}); !errors.Is(err, ErrConnClosed) {
+		t.Errorf("Expected ErrConnClosed after Close, got %v", err)
+	}
+}
@@ -0,0 +1,424 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+)
+
+// Every frame starts with a fixed header, big-endian:
+//
+//	magic   [2]byte  "TP"
+//	version uint8
+//	kind    uint8
+//	flags   uint8
+//	id      uint32   request ID, echoed in the response; zero for hellos
+//	length  uint32   payload length
+//
+// A connection opens with a hello exchange. The client sends the number of
+// encoding IDs it accepts, those IDs in order of preference, then the
+// compressions it accepts in the same way. The server answers with the
+// encoding it picked, followed by the compression it picked if any, or an
+// empty payload if there is no common encoding. Request and response
+// payloads then use that encoding; see compression.go for compression.
+//
+// Several requests may be in flight on a connection at once; responses can
+// arrive in any order and are matched to requests by ID. A request or
+// response flagged flagStream is followed by a body in data frames; see
+// stream.go. Subscriptions add pushed event frames; see subscribe.go.
+//
+// Every change to the wire format bumps protocolVersion. Version 1 had a
+// 9-byte header without request IDs, version 2 a hello without
+// compressions, and version 3 requests without a timeout. Peers on
+// different versions fail with ErrVersion.
+const (
+	protocolVersion = 4
+	headerSize      = 13
+	// versionSize is the part of the header every version starts with.
+	versionSize = 3
+)
+
+var protocolMagic = [2]byte{'T', 'P'}
+
+type frameKind uint8
+
+const (
+	frameHello frameKind = iota + 1
+	frameRequest
+	frameResponse
+	frameData
+	frameWindow
+	frameStop
+	frameAbort
+	frameEvent
+	frameSubscriptionEnd
+	frameAuth
+	frameAuthChallenge
+	frameAuthProof
+	frameAuthResult
+)
+
+// Frame flags.
+const (
+	// flagStream marks a request or response whose body follows in data frames.
+	flagStream byte = 1 << iota
+	// flagEnd marks the last data frame of a body.
+	flagEnd
+	// flagCompressed marks a payload compressed with the negotiated scheme.
+	flagCompressed
+	// flagAuthRequired on the server's hello asks the client to
+	// authenticate; see auth.go.
+	flagAuthRequired
+)
+
+var (
+	ErrBadMagic         = errors.New("not a protocol frame")
+	ErrVersion          = errors.New("unsupported protocol version")
+	ErrFrameTooLarge    = errors.New("frame too large")
+	ErrNoCommonEncoding = errors.New("no common payload encoding")
+	ErrUnexpectedFrame  = errors.New("unexpected frame kind")
+	ErrMalformed        = errors.New("malformed payload")
+)
+
+// defaultEncodingOrder is what clients offer when not told otherwise.
+var defaultEncodingOrder = []Encoding{BinaryEncoding, JSONEncoding}
+
+type frame struct {
+	kind    frameKind
+	flags   byte
+	id      uint32
+	payload []byte
+}
+
+// Codec reads and writes frames on one connection with the encoding agreed
+// at handshake. A malformed payload (ErrMalformed) leaves the stream usable;
+// any other read error means the connection must be closed.
+//
+// Writes may come from several goroutines; reads must come from one.
+type Codec struct {
+	r        *bufio.Reader
+	enc      Encoding
+	comp     Compression
+	maxFrame int
+	// authRequired is set on a client codec whose server asked it to
+	// authenticate.
+	authRequired bool
+	// capture, if set, records the requests decoded and responses written.
+	capture *connCapture
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+}
+
+func newCodec(rw io.ReadWriter, maxFrame int) *Codec {
+	return &Codec{
+		r:        bufio.NewReader(rw),
+		w:        bufio.NewWriter(rw),
+		maxFrame: maxFrame,
+	}
+}
+
+// ClientHandshake offers the given encodings, most preferred first, and
+// returns a Codec using the one the server chose. With no encodings it
+// offers binary, then JSON. It also offers gzip and DEFLATE compression.
+func ClientHandshake(rw io.ReadWriter, maxFrame int, prefer ...Encoding) (*Codec, error) {
+	return clientHandshake(rw, maxFrame, prefer, defaultCompressionOrder)
+}
+
+func clientHandshake(rw io.ReadWriter, maxFrame int, prefer []Encoding, comps []Compression) (*Codec, error) {
+	if len(prefer) == 0 {
+		prefer = defaultEncodingOrder
+	}
+	c := newCodec(rw, maxFrame)
+	hello := []byte{byte(len(prefer))}
+	for _, enc := range prefer {
+		hello = append(hello, enc.ID())
+	}
+	for _, comp := range comps {
+		hello = append(hello, byte(comp))
+	}
+	if err := c.writeFrame(frame{kind: frameHello, payload: hello}); err != nil {
+		return nil, err
+	}
+
+	f, err := c.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	if f.kind != frameHello {
+		return nil, fmt.Errorf("%w: %d during handshake", ErrUnexpectedFrame, f.kind)
+	}
+	if len(f.payload) == 0 {
+		return nil, ErrNoCommonEncoding
+	}
+	c.authRequired = f.flags&flagAuthRequired != 0
+	if len(f.payload) > 2 {
+		return nil, fmt.Errorf("%w: hello answer of %d bytes", ErrMalformed, len(f.payload))
+	}
+	for _, enc := range prefer {
+		if enc.ID() == f.payload[0] {
+			c.enc = enc
+		}
+	}
+	if c.enc == nil {
+		return nil, fmt.Errorf("server chose encoding %d, which was not offered", f.payload[0])
+	}
+	if len(f.payload) == 2 {
+		c.comp = Compression(f.payload[1])
+		if !slices.Contains(comps, c.comp) {
+			return nil, fmt.Errorf("server chose compression %v, which was not offered", c.comp)
+		}
+	}
+	return c, nil
+}
+
+// ServerHandshake reads the client's hello and picks the first offered
+// encoding that is registered and the first offered compression it knows.
+func ServerHandshake(rw io.ReadWriter, maxFrame int) (*Codec, error) {
+	return serverHandshake(rw, maxFrame, false)
+}
+
+func serverHandshake(rw io.ReadWriter, maxFrame int, requireAuth bool) (*Codec, error) {
+	c := newCodec(rw, maxFrame)
+	f, err := c.readFrame()
+	if errors.Is(err, ErrVersion) {
+		// Answer in this version, so the client fails with ErrVersion too
+		// instead of seeing the connection drop
+		c.writeFrame(frame{kind: frameHello})
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f.kind != frameHello {
+		return nil, fmt.Errorf("%w: %d during handshake", ErrUnexpectedFrame, f.kind)
+	}
+	if len(f.payload) == 0 || int(f.payload[0]) > len(f.payload)-1 {
+		return nil, fmt.Errorf("%w: hello of %d bytes", ErrMalformed, len(f.payload))
+	}
+	ids, comps := f.payload[1:1+f.payload[0]], f.payload[1+f.payload[0]:]
+
+	for _, id := range ids {
+		if enc, ok := lookupEncoding(id); ok {
+			c.enc = enc
+			break
+		}
+	}
+	if c.enc == nil {
+		c.writeFrame(frame{kind: frameHello})
+		return nil, ErrNoCommonEncoding
+	}
+	answer := frame{kind: frameHello, payload: []byte{c.enc.ID()}}
+	for _, comp := range comps {
+		if Compression(comp).supported() {
+			c.comp = Compression(comp)
+			answer.payload = append(answer.payload, comp)
+			break
+		}
+	}
+	if requireAuth {
+		answer.flags |= flagAuthRequired
+	}
+	return c, c.writeFrame(answer)
+}
+
+// Encoding returns the negotiated payload encoding.
+func (c *Codec) Encoding() Encoding {
+	return c.enc
+}
+
+// Compression returns the negotiated compression, NoCompression if none.
+func (c *Codec) Compression() Compression {
+	return c.comp
+}
+
+// WriteRequest sends req in a frame carrying req.ID. If req.Stream is set,
+// the frame announces a streamed body, which the caller must then send.
+func (c *Codec) WriteRequest(req *Request) error {
+	data, err := c.enc.EncodeRequest(req)
+	if err != nil {
+		return err
+	}
+	f := frame{kind: frameRequest, id: req.ID, payload: data}
+	if req.Stream != nil {
+		f.flags |= flagStream
+	}
+	return c.writeFrame(f)
+}
+
+// ReadRequest reads the next frame as a request. On ErrMalformed or
+// ErrFrameTooLarge the request holds only the frame's ID, so the error can
+// still be answered.
+func (c *Codec) ReadRequest() (*Request, error) {
+	f, err := c.readFrame()
+	if err != nil {
+		if headerRead(err) {
+			return &Request{ID: f.id}, err
+		}
+		return nil, err
+	}
+	return c.decodeRequest(f)
+}
+
+func (c *Codec) decodeRequest(f frame) (*Request, error) {
+	if f.kind != frameRequest {
+		return &Request{ID: f.id}, fmt.Errorf("%w: %w %d", ErrMalformed, ErrUnexpectedFrame, f.kind)
+	}
+	req, err := c.enc.DecodeRequest(f.payload)
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrMalformed, err)
+		if c.capture != nil {
+			c.capture.malformed(f, err)
+		}
+		return &Request{ID: f.id}, err
+	}
+	req.ID = f.id
+	if c.capture != nil {
+		c.capture.request(req, f.flags&flagStream != 0)
+	}
+	return req, nil
+}
+
+// WriteResponse sends resp in a frame carrying resp.ID. If resp.Stream is
+// set, the frame announces a streamed body, which the caller must then send.
+func (c *Codec) WriteResponse(resp *Response) error {
+	if c.capture != nil {
+		c.capture.response(resp)
+	}
+	data, err := c.enc.EncodeResponse(resp)
+	if err != nil {
+		return err
+	}
+	f := frame{kind: frameResponse, id: resp.ID, payload: data}
+	if resp.Stream != nil {
+		f.flags |= flagStream
+	}
+	return c.writeFrame(f)
+}
+
+// ReadResponse reads the next frame as a response. On ErrMalformed or
+// ErrFrameTooLarge the response holds only the frame's ID, so the caller
+// can fail the matching request.
+func (c *Codec) ReadResponse() (*Response, error) {
+	f, err := c.readFrame()
+	if err != nil {
+		if headerRead(err) {
+			return &Response{ID: f.id}, err
+		}
+		return nil, err
+	}
+	return c.decodeResponse(f)
+}
+
+func (c *Codec) decodeResponse(f frame) (*Response, error) {
+	if f.kind != frameResponse {
+		return &Response{ID: f.id}, fmt.Errorf("%w: %w %d", ErrMalformed, ErrUnexpectedFrame, f.kind)
+	}
+	resp, err := c.enc.DecodeResponse(f.payload)
+	if err != nil {
+		return &Response{ID: f.id}, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	resp.ID = f.id
+	return resp, nil
+}
+
+// headerRead reports whether err came after a frame header was read whole,
+// so the frame's ID is known.
+func headerRead(err error) bool {
+	return errors.Is(err, ErrMalformed) || errors.Is(err, ErrFrameTooLarge)
+}
+
+func (c *Codec) writeFrame(f frame) error {
+	if len(f.payload) > c.maxFrame {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(f.payload))
+	}
+	if c.comp != NoCompression && compressible(f.kind) && len(f.payload) >= compressThreshold {
+		data, err := c.comp.compress(f.payload)
+		if err != nil {
+			return err
+		}
+		if len(data) < len(f.payload) {
+			f.payload = data
+			f.flags |= flagCompressed
+		}
+	}
+	var header [headerSize]byte
+	copy(header[:2], protocolMagic[:])
+	header[2] = protocolVersion
+	header[3] = byte(f.kind)
+	header[4] = f.flags
+	binary.BigEndian.PutUint32(header[5:], f.id)
+	binary.BigEndian.PutUint32(header[9:], uint32(len(f.payload)))
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(f.payload); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// readFrame reads one whole frame, decompressing its payload. A clean io.EOF
+// is returned only when the peer closed the connection between frames. With
+// ErrFrameTooLarge the frame's header fields are filled in but the payload
+// is left unread or, if it was compressed, not inflated; with ErrMalformed
+// they are filled in for a payload that would not decompress.
+func (c *Codec) readFrame() (frame, error) {
+	// The version is checked before reading the rest of the header, whose
+	// size depends on it; a shorter header would never complete
+	var header [headerSize]byte
+	if _, err := io.ReadFull(c.r, header[:versionSize]); err != nil {
+		return frame{}, err
+	}
+	if header[0] != protocolMagic[0] || header[1] != protocolMagic[1] {
+		return frame{}, ErrBadMagic
+	}
+	if header[2] != protocolVersion {
+		return frame{}, fmt.Errorf("%w: %d", ErrVersion, header[2])
+	}
+	if _, err := io.ReadFull(c.r, header[versionSize:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return frame{}, err
+	}
+	f := frame{
+		kind:  frameKind(header[3]),
+		flags: header[4],
+		id:    binary.BigEndian.Uint32(header[5:]),
+	}
+	length := binary.BigEndian.Uint32(header[9:])
+	if uint64(length) > uint64(c.maxFrame) {
+		return f, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, length)
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.r, f.payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return frame{}, err
+	}
+	if f.flags&flagCompressed != 0 {
+		if !compressible(f.kind) {
+			return f, fmt.Errorf("%w: compressed frame of kind %d", ErrMalformed, f.kind)
+		}
+		data, err := c.comp.decompress(f.payload, c.maxFrame)
+		if err != nil {
+			return f, err
+		}
+		f.payload = data
+		f.flags &^= flagCompressed
+	}
+	return f, nil
+}
+
+func compressible(kind frameKind) bool {
+	return kind == frameRequest || kind == frameResponse || kind == frameData || kind == frameEvent
+}
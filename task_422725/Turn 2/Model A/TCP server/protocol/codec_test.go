@@ -0,0 +1,205 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// handshake connects a client and server codec over an in-memory pipe.
+func handshake(t *testing.T, prefer ...Encoding) (client, server *Codec) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+
+	errs := make(chan error, 1)
+	go func() {
+		var err error
+		server, err = ServerHandshake(b, maxRequestSize)
+		errs <- err
+	}()
+	client, err := ClientHandshake(a, maxRequestSize, prefer...)
+	if err != nil {
+		t.Fatalf("ClientHandshake failed: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("ServerHandshake failed: %v", err)
+	}
+	return client, server
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	req := &Request{
+		ID:      7,
+		Method:  "POST",
+		Path:    "/items?limit=10",
+		Timeout: 1500 * time.Millisecond,
+		Body: map[string]interface{}{
+			"name":  "widget",
+			"count": float64(3),
+			"price": 9.99,
+			"tags":  []interface{}{"a", true, nil},
+			"meta":  map[string]interface{}{"nested": false},
+		},
+	}
+	resp := &Response{ID: 7, Status: 201, Message: "Created", Body: req.Body}
+
+	for _, enc := range []Encoding{JSONEncoding, BinaryEncoding} {
+		t.Run(enc.Name(), func(t *testing.T) {
+			client, server := handshake(t, enc)
+			if client.Encoding() != enc || server.Encoding() != enc {
+				t.Fatalf("Expected both sides to use %s", enc.Name())
+			}
+
+			go client.WriteRequest(req)
+			gotReq, err := server.ReadRequest()
+			if err != nil {
+				t.Fatalf("ReadRequest failed: %v", err)
+			}
+			if !reflect.DeepEqual(gotReq, req) {
+				t.Errorf("Expected %+v, got %+v", req, gotReq)
+			}
+
+			go server.WriteResponse(resp)
+			gotResp, err := client.ReadResponse()
+			if err != nil {
+				t.Fatalf("ReadResponse failed: %v", err)
+			}
+			if !reflect.DeepEqual(gotResp, resp) {
+				t.Errorf("Expected %+v, got %+v", resp, gotResp)
+			}
+		})
+	}
+}
+
+func TestHandshakePicksFirstSupported(t *testing.T) {
+	unknown := fakeEncoding{id: 200}
+	client, _ := handshake(t, unknown, JSONEncoding, BinaryEncoding)
+	if client.Encoding() != JSONEncoding {
+		t.Errorf("Expected json, got %s", client.Encoding().Name())
+	}
+}
+
+func TestHandshakeWithoutCommonEncoding(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := ServerHandshake(b, maxRequestSize)
+		errs <- err
+	}()
+	if _, err := ClientHandshake(a, maxRequestSize, fakeEncoding{id: 200}); !errors.Is(err, ErrNoCommonEncoding) {
+		t.Errorf("Expected ErrNoCommonEncoding from client, got %v", err)
+	}
+	if err := <-errs; !errors.Is(err, ErrNoCommonEncoding) {
+		t.Errorf("Expected ErrNoCommonEncoding from server, got %v", err)
+	}
+}
+
+func TestServerHandshakeRejectsOldVersion(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	errs := make(chan error, 1)
+	go func() {
+		defer b.Close()
+		_, err := ServerHandshake(b, maxRequestSize)
+		errs <- err
+	}()
+
+	// A version 1 hello: a 9-byte header, then one encoding ID
+	go a.Write([]byte{'T', 'P', 1, byte(frameHello), 0, 0, 0, 0, 2, 1, 1})
+	if _, err := newCodec(a, maxRequestSize).readFrame(); err != nil {
+		t.Errorf("Expected a hello in the current version, got %v", err)
+	}
+	if err := <-errs; !errors.Is(err, ErrVersion) {
+		t.Errorf("Expected ErrVersion from the server, got %v", err)
+	}
+}
+
+func TestReadFrameRejectsBadHeaders(t *testing.T) {
+	valid := func() []byte {
+		var buf bytes.Buffer
+		newCodec(&buf, maxRequestSize).writeFrame(frame{kind: frameRequest, id: 1, payload: []byte("{}")})
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name   string
+		mutate func([]byte) []byte
+		want   error
+	}{
+		{"bad magic", func(b []byte) []byte { b[0] = 'X'; return b }, ErrBadMagic},
+		{"bad version", func(b []byte) []byte { b[2] = 9; return b }, ErrVersion},
+		{"too large", func(b []byte) []byte { b[9] = 0xff; return b }, ErrFrameTooLarge},
+		{"truncated payload", func(b []byte) []byte { return b[:len(b)-1] }, io.ErrUnexpectedEOF},
+		{"truncated header", func(b []byte) []byte { return b[:4] }, io.ErrUnexpectedEOF},
+		{"empty", func(b []byte) []byte { return nil }, io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCodec(bytes.NewBuffer(tt.mutate(valid())), maxRequestSize)
+			if _, err := c.readFrame(); !errors.Is(err, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestBinaryRejectsMalformedPayloads(t *testing.T) {
+	good, err := BinaryEncoding.EncodeRequest(&Request{
+		Method: "GET",
+		Path:   "/x",
+		Body:   map[string]interface{}{"k": "v"},
+	})
+	if err != nil {
+		t.Fatalf("EncodeRequest failed: %v", err)
+	}
+
+	// Every strict prefix is truncated somewhere.
+	for i := 0; i < len(good); i++ {
+		if _, err := BinaryEncoding.DecodeRequest(good[:i]); err == nil {
+			t.Errorf("Expected error decoding %d of %d bytes", i, len(good))
+		}
+	}
+	if _, err := BinaryEncoding.DecodeRequest(append(good, 0)); err == nil {
+		t.Error("Expected error for trailing bytes")
+	}
+
+	// A huge declared array length must not be allocated up front.
+	huge := []byte{0, 0, 0, tagArray, 0xff, 0xff, 0xff, 0xff, 0x0f}
+	if _, err := BinaryEncoding.DecodeRequest(huge); err == nil {
+		t.Error("Expected error for oversized array length")
+	}
+
+	deep := []byte{0, 0, 0}
+	for i := 0; i <= maxValueDepth+1; i++ {
+		deep = append(deep, tagArray, 1)
+	}
+	deep = append(deep, tagNil)
+	if _, err := BinaryEncoding.DecodeRequest(deep); err == nil {
+		t.Error("Expected error for deeply nested value")
+	}
+}
+
+func TestBinaryIsSmallerThanJSON(t *testing.T) {
+	req := &Request{Method: "GET", Path: "/hello", Body: map[string]interface{}{"id": float64(12345), "ok": true}}
+	jsonData, _ := JSONEncoding.EncodeRequest(req)
+	binData, _ := BinaryEncoding.EncodeRequest(req)
+	if len(binData) >= len(jsonData) {
+		t.Errorf("Expected binary (%d bytes) to be smaller than JSON (%d bytes)", len(binData), len(jsonData))
+	}
+}
+
+// fakeEncoding is an encoding the server has never registered.
+type fakeEncoding struct {
+	jsonEncoding
+	id byte
+}
+
+func (f fakeEncoding) ID() byte { return f.id }
@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// compressThreshold is the smallest payload worth compressing. Below it the
+// compression header and CPU cost outweigh the savings.
+const compressThreshold = 1024
+
+// Compression is a payload compression scheme, agreed at handshake like the
+// encoding. Only request, response and data frames are compressed, each on
+// its own, and only when that makes them smaller; compressed frames carry
+// flagCompressed.
+type Compression byte
+
+const (
+	NoCompression Compression = iota
+	Gzip
+	Deflate
+)
+
+// defaultCompressionOrder is what clients offer, most preferred first.
+var defaultCompressionOrder = []Compression{Gzip, Deflate}
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Gzip:
+		return "gzip"
+	case Deflate:
+		return "deflate"
+	}
+	return fmt.Sprintf("compression(%d)", byte(c))
+}
+
+func (c Compression) supported() bool {
+	return c == Gzip || c == Deflate
+}
+
+var (
+	gzipWriters  = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+	flateWriters = sync.Pool{New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}}
+)
+
+func (c Compression) compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	switch c {
+	case Gzip:
+		w := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(w)
+		w.Reset(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case Deflate:
+		w := flateWriters.Get().(*flate.Writer)
+		defer flateWriters.Put(w)
+		w.Reset(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("cannot compress with %v", c)
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress inflates data, failing with ErrFrameTooLarge as soon as the
+// output passes limit, so a small frame cannot expand into a huge one.
+func (c Compression) decompress(data []byte, limit int) ([]byte, error) {
+	var r io.ReadCloser
+	switch c {
+	case Gzip:
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+		}
+		r = gr
+	case Deflate:
+		r = flate.NewReader(bytes.NewReader(data))
+	default:
+		return nil, fmt.Errorf("%w: compressed frame without negotiated compression", ErrMalformed)
+	}
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if len(out) > limit {
+		return nil, fmt.Errorf("%w: decompresses past %d bytes", ErrFrameTooLarge, limit)
+	}
+	return out, nil
+}
@@ -0,0 +1,140 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestHandshakeNegotiatesCompression(t *testing.T) {
+	tests := []struct {
+		offer []Compression
+		want  Compression
+	}{
+		{[]Compression{Gzip, Deflate}, Gzip},
+		{[]Compression{Deflate, Gzip}, Deflate},
+		{[]Compression{Compression(9), Deflate}, Deflate},
+		{nil, NoCompression},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want.String(), func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+
+			servers := make(chan *Codec, 1)
+			go func() {
+				server, _ := ServerHandshake(b, maxRequestSize)
+				servers <- server
+			}()
+			client, err := clientHandshake(a, maxRequestSize, nil, tt.offer)
+			if err != nil {
+				t.Fatalf("clientHandshake failed: %v", err)
+			}
+			server := <-servers
+			if client.Compression() != tt.want || server.Compression() != tt.want {
+				t.Errorf("Expected %v on both sides, got client %v, server %v", tt.want, client.Compression(), server.Compression())
+			}
+		})
+	}
+}
+
+func TestCompressedFrames(t *testing.T) {
+	big := []byte(strings.Repeat(`{"name":"widget","count":3},`, 1000))
+	tests := []struct {
+		name           string
+		comp           Compression
+		kind           frameKind
+		payload        []byte
+		wantCompressed bool
+	}{
+		{"gzip", Gzip, frameRequest, big, true},
+		{"deflate", Deflate, frameData, big, true},
+		{"small", Gzip, frameRequest, []byte(`{"path":"/"}`), false},
+		{"window", Gzip, frameWindow, big[:4], false},
+		{"none", NoCompression, frameResponse, big, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wire bytes.Buffer
+			w := newCodec(&wire, maxRequestSize)
+			w.comp = tt.comp
+			if err := w.writeFrame(frame{kind: tt.kind, id: 3, payload: tt.payload}); err != nil {
+				t.Fatalf("writeFrame failed: %v", err)
+			}
+			if compressed := wire.Bytes()[4]&flagCompressed != 0; compressed != tt.wantCompressed {
+				t.Errorf("Expected compressed=%v, got %v", tt.wantCompressed, compressed)
+			}
+			if tt.wantCompressed && wire.Len() >= len(tt.payload) {
+				t.Errorf("Expected %d bytes to shrink, got %d on the wire", len(tt.payload), wire.Len())
+			}
+
+			r := newCodec(&wire, maxRequestSize)
+			r.comp = tt.comp
+			f, err := r.readFrame()
+			if err != nil {
+				t.Fatalf("readFrame failed: %v", err)
+			}
+			if f.kind != tt.kind || f.id != 3 || f.flags != 0 || !bytes.Equal(f.payload, tt.payload) {
+				t.Errorf("Frame did not round-trip: got kind %d, id %d, flags %d, %d bytes", f.kind, f.id, f.flags, len(f.payload))
+			}
+		})
+	}
+}
+
+func TestReadFrameRejectsBadCompressedPayloads(t *testing.T) {
+	var bomb bytes.Buffer
+	zw := gzip.NewWriter(&bomb)
+	zw.Write(make([]byte, maxRequestSize+1))
+	zw.Close()
+
+	tests := []struct {
+		name    string
+		comp    Compression
+		kind    frameKind
+		payload []byte
+		want    error
+	}{
+		{"bomb", Gzip, frameRequest, bomb.Bytes(), ErrFrameTooLarge},
+		{"corrupt", Gzip, frameRequest, []byte("not gzip at all"), ErrMalformed},
+		{"not negotiated", NoCompression, frameRequest, bomb.Bytes(), ErrMalformed},
+		{"not compressible", Gzip, frameWindow, bomb.Bytes(), ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wire bytes.Buffer
+			newCodec(&wire, maxRequestSize).writeFrame(frame{kind: tt.kind, flags: flagCompressed, id: 5, payload: tt.payload})
+
+			r := newCodec(&wire, maxRequestSize)
+			r.comp = tt.comp
+			f, err := r.readFrame()
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, err)
+			}
+			if f.id != 5 {
+				t.Errorf("Expected the frame ID to be kept, got %d", f.id)
+			}
+		})
+	}
+}
+
+func TestServerAnswersCompressedRequests(t *testing.T) {
+	c := pipeClient(t, func(req *Request) *Response {
+		return &Response{Status: 200, Body: req.Body}
+	})
+	if c.codec.Compression() != Gzip {
+		t.Fatalf("Expected gzip to be negotiated, got %v", c.codec.Compression())
+	}
+
+	body := map[string]interface{}{"text": strings.Repeat("compress me ", 1000)}
+	resp, err := c.Do(&Request{Method: "POST", Path: "/echo", Body: body})
+	if err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+	if resp.Body["text"] != body["text"] {
+		t.Error("Expected the large body to come back intact")
+	}
+}
@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHandleConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	go handleConn(b, newRouter().ServeRequest)
+
+	client, err := ClientHandshake(a, maxRequestSize)
+	if err != nil {
+		t.Fatalf("ClientHandshake failed: %v", err)
+	}
+
+	tests := []struct {
+		req    *Request
+		status int
+	}{
+		{&Request{Method: "GET", Path: "/hello"}, 200},
+		{&Request{Method: "POST", Path: "/items", Body: map[string]interface{}{"n": float64(1)}}, 201},
+		{&Request{Method: "GET", Path: "/items/42"}, 200},
+		{&Request{Method: "DELETE", Path: "/items"}, 405},
+	}
+	for _, tt := range tests {
+		if err := client.WriteRequest(tt.req); err != nil {
+			t.Fatalf("WriteRequest failed: %v", err)
+		}
+		resp, err := client.ReadResponse()
+		if err != nil {
+			t.Fatalf("ReadResponse failed: %v", err)
+		}
+		if resp.Status != tt.status {
+			t.Errorf("%s %s: expected status %d, got %d", tt.req.Method, tt.req.Path, tt.status, resp.Status)
+		}
+	}
+}
+
+func TestHandleConnRecoversFromMalformedPayload(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	go handleConn(b, newRouter().ServeRequest)
+
+	client, err := ClientHandshake(a, maxRequestSize, JSONEncoding)
+	if err != nil {
+		t.Fatalf("ClientHandshake failed: %v", err)
+	}
+
+	if err := client.writeFrame(frame{kind: frameRequest, id: 1, payload: []byte("{not json")}); err != nil {
+		t.Fatalf("writeFrame failed: %v", err)
+	}
+	resp, err := client.ReadResponse()
+	if err != nil {
+		t.Fatalf("ReadResponse failed: %v", err)
+	}
+	if resp.Status != 400 {
+		t.Errorf("Expected 400, got %d", resp.Status)
+	}
+
+	client.WriteRequest(&Request{Method: "GET", Path: "/after"})
+	if resp, err := client.ReadResponse(); err != nil || resp.Status != 200 {
+		t.Errorf("Expected the connection to stay usable, got %+v, %v", resp, err)
+	}
+}
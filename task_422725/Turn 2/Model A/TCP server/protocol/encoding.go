@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Encoding turns requests and responses into frame payloads. Client and
+// server agree on one during the connection handshake.
+type Encoding interface {
+	// ID identifies the encoding on the wire and must be unique.
+	ID() byte
+	Name() string
+	EncodeRequest(req *Request) ([]byte, error)
+	DecodeRequest(data []byte) (*Request, error)
+	EncodeResponse(resp *Response) ([]byte, error)
+	DecodeResponse(data []byte) (*Response, error)
+}
+
+var (
+	// JSONEncoding is the JSON encoding the protocol started with.
+	JSONEncoding Encoding = jsonEncoding{}
+	// BinaryEncoding is a compact, self-describing binary encoding.
+	BinaryEncoding Encoding = binaryEncoding{}
+)
+
+var (
+	encodingsMu sync.RWMutex
+	encodings   = map[byte]Encoding{}
+)
+
+func init() {
+	RegisterEncoding(JSONEncoding)
+	RegisterEncoding(BinaryEncoding)
+}
+
+// RegisterEncoding makes enc available for negotiation. It panics if another
+// encoding already uses the same ID.
+func RegisterEncoding(enc Encoding) {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	if existing, ok := encodings[enc.ID()]; ok {
+		panic(fmt.Sprintf("encoding ID %d already registered by %s", enc.ID(), existing.Name()))
+	}
+	encodings[enc.ID()] = enc
+}
+
+// lookupEncoding returns the registered encoding with the given ID.
+func lookupEncoding(id byte) (Encoding, bool) {
+	encodingsMu.RLock()
+	defer encodingsMu.RUnlock()
+	enc, ok := encodings[id]
+	return enc, ok
+}
+
+type jsonEncoding struct{}
+
+func (jsonEncoding) ID() byte     { return 1 }
+func (jsonEncoding) Name() string { return "json" }
+
+func (jsonEncoding) EncodeRequest(req *Request) ([]byte, error) {
+	return json.Marshal(req)
+}
+
+func (jsonEncoding) DecodeRequest(data []byte) (*Request, error) {
+	req := &Request{}
+	if err := json.Unmarshal(data, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func (jsonEncoding) EncodeResponse(resp *Response) ([]byte, error) {
+	return json.Marshal(resp)
+}
+
+func (jsonEncoding) DecodeResponse(data []byte) (*Response, error) {
+	resp := &Response{}
+	if err := json.Unmarshal(data, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,154 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// defaultGatewayTimeout bounds a forwarded request when the gateway has no
+// Timeout of its own.
+const defaultGatewayTimeout = 30 * time.Second
+
+// Gateway lets HTTP clients use the protocol. Each HTTP request becomes a
+// Request with the same method, path and query string, the JSON object
+// body, if any, as Body, and the time left before the gateway gives up as
+// Timeout. The Response comes back as JSON in the shape of Response, with
+// Status as the HTTP status too. A streamed response is passed on as its
+// raw body instead, flushed as it arrives. SUBSCRIBE and UNSUBSCRIBE are
+// refused with 405: events need a connection that outlives the request.
+//
+// Transport failures come back as 502, timeouts as 504, and a gateway that
+// has been closed answers 503.
+type Gateway struct {
+	Client *Client
+	// Timeout bounds each forwarded request, on top of the HTTP client
+	// going away; zero means defaultGatewayTimeout.
+	Timeout time.Duration
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == MethodSubscribe || r.Method == MethodUnsubscribe {
+		writeGatewayError(w, http.StatusMethodNotAllowed, "Subscriptions Not Supported")
+		return
+	}
+	req := &Request{Method: r.Method, Path: r.URL.RequestURI()}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeGatewayError(w, http.StatusRequestEntityTooLarge, "Request Too Large")
+			return
+		}
+		writeGatewayError(w, http.StatusBadRequest, "Error reading body")
+		return
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &req.Body); err != nil {
+			writeGatewayError(w, http.StatusBadRequest, "Body must be a JSON object")
+			return
+		}
+	}
+
+	timeout := g.Timeout
+	if timeout <= 0 {
+		timeout = defaultGatewayTimeout
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	req.Timeout = time.Until(deadline)
+
+	resp, body, err := g.Client.DoStream(ctx, req)
+	if err != nil {
+		if r.Context().Err() != nil {
+			// The HTTP client gave up; there is nobody to answer
+			return
+		}
+		status, message := gatewayErrorStatus(err)
+		log.Printf("Gateway %s %s -> %d: %v", r.Method, r.URL.Path, status, err)
+		writeGatewayError(w, status, message)
+		return
+	}
+	if body != nil {
+		defer body.Close()
+	}
+	status := resp.Status
+	if status < 100 || status > 599 {
+		log.Printf("Gateway %s %s: upstream sent invalid status %d", r.Method, r.URL.Path, status)
+		writeGatewayError(w, http.StatusBadGateway, "Bad Gateway")
+		return
+	}
+	if body != nil {
+		streamGatewayBody(ctx, w, r, status, body)
+		return
+	}
+	writeGatewayJSON(w, status, resp)
+}
+
+// streamGatewayBody passes a streamed response body on, flushing each chunk
+// so the HTTP client sees it as soon as it arrives. The status is already
+// sent when the body fails, so the HTTP response is aborted instead, and
+// the client sees it cut short rather than complete.
+func streamGatewayBody(ctx context.Context, w http.ResponseWriter, r *http.Request, status int, body io.ReadCloser) {
+	// Closing the body wakes a blocked Read once the gateway gives up
+	stop := context.AfterFunc(ctx, func() { body.Close() })
+	defer stop()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(status)
+	rc := http.NewResponseController(w)
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				// The HTTP client went away
+				return
+			}
+			rc.Flush()
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			if r.Context().Err() != nil {
+				return
+			}
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			log.Printf("Gateway %s %s: error streaming body: %v", r.Method, r.URL.Path, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// gatewayErrorStatus maps a Client error to the HTTP status to answer with.
+func gatewayErrorStatus(err error) (int, string) {
+	var ce *ClientError
+	switch {
+	case errors.Is(err, ErrClientClosed):
+		return http.StatusServiceUnavailable, "Service Unavailable"
+	case errors.As(err, &ce) && ce.Timeout():
+		return http.StatusGatewayTimeout, "Gateway Timeout"
+	default:
+		return http.StatusBadGateway, "Bad Gateway"
+	}
+}
+
+func writeGatewayError(w http.ResponseWriter, status int, message string) {
+	writeGatewayJSON(w, status, &Response{Status: status, Message: message})
+}
+
+func writeGatewayJSON(w http.ResponseWriter, status int, resp *Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error writing gateway response: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package protocol
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGateway(t *testing.T) {
+	srv := newTestServer(t, func(req *Request) *Response {
+		switch req.Path {
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/echo":
+			return &Response{Status: 201, Message: "Created", Body: req.Body}
+		}
+		return &Response{Status: 404, Message: "Not Found"}
+	})
+	up := newTestClient(t, ClientOptions{Addr: srv.ln.Addr().String()})
+
+	// An address nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	ln.Close()
+	down := newTestClient(t, ClientOptions{Addr: ln.Addr().String(), MaxRetries: -1})
+
+	tests := []struct {
+		name     string
+		client   *Client
+		method   string
+		path     string
+		body     string
+		status   int
+		wantBody map[string]interface{}
+	}{
+		{"forwards body", up, "POST", "/echo", `{"name":"widget","count":3}`, 201, map[string]interface{}{"name": "widget", "count": float64(3)}},
+		{"passes status", up, "GET", "/missing", "", 404, nil},
+		{"rejects non-object", up, "POST", "/echo", `[1,2]`, 400, nil},
+		{"upstream down", down, "GET", "/echo", "", 502, nil},
+		{"upstream slow", up, "GET", "/slow", "", 504, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gw := &Gateway{Client: tt.client, Timeout: 50 * time.Millisecond}
+			rec := httptest.NewRecorder()
+			gw.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+
+			if rec.Code != tt.status {
+				t.Fatalf("Expected HTTP %d, got %d: %s", tt.status, rec.Code, rec.Body)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Expected a JSON response, got %q", ct)
+			}
+			var resp Response
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Response is not JSON: %v", err)
+			}
+			if resp.Status != tt.status {
+				t.Errorf("Expected status %d in the body, got %d", tt.status, resp.Status)
+			}
+			if tt.wantBody != nil {
+				for k, v := range tt.wantBody {
+					if resp.Body[k] != v {
+						t.Errorf("Expected body %s=%v, got %v", k, v, resp.Body[k])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestGatewayRejectsOversizedBody(t *testing.T) {
+	gw := &Gateway{Client: NewClient(ClientOptions{Addr: "127.0.0.1:1"})}
+	rec := httptest.NewRecorder()
+	body := `{"data":"` + strings.Repeat("x", maxRequestSize) + `"}`
+	gw.ServeHTTP(rec, httptest.NewRequest("POST", "/echo", strings.NewReader(body)))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413, got %d", rec.Code)
+	}
+}
+
+func TestGatewayRejectsSubscriptions(t *testing.T) {
+	gw := &Gateway{Client: NewClient(ClientOptions{Addr: "127.0.0.1:1"})}
+	for _, method := range []string{MethodSubscribe, MethodUnsubscribe} {
+		rec := httptest.NewRecorder()
+		gw.ServeHTTP(rec, httptest.NewRequest(method, "/events/news", nil))
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected 405 for %s, got %d", method, rec.Code)
+		}
+	}
+}
+
+func TestGatewaySendsTokenOnlyOverTLS(t *testing.T) {
+	tlsAddr, config := startTLSAuthServer(t)
+	plainAddr := startAuthServer(t, 0)
+	auth := &ClientAuth{Token: "s3cret"}
+	tests := []struct {
+		name   string
+		opts   ClientOptions
+		status int
+	}{
+		{"tls", ClientOptions{Addr: tlsAddr, TLS: config, Auth: auth}, 200},
+		{"plaintext", ClientOptions{Addr: plainAddr, Auth: auth, MaxRetries: -1}, 502},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gw := &Gateway{Client: newTestClient(t, tt.opts)}
+			rec := httptest.NewRecorder()
+			gw.ServeHTTP(rec, httptest.NewRequest("GET", "/whoami", nil))
+			if rec.Code != tt.status {
+				t.Fatalf("Expected HTTP %d, got %d: %s", tt.status, rec.Code, rec.Body)
+			}
+			var resp Response
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Response is not JSON: %v", err)
+			}
+			if tt.status == 200 && resp.Body["principal"] != "alice" {
+				t.Errorf("Expected principal alice, got %v", resp.Body["principal"])
+			}
+		})
+	}
+}
+
+func TestGatewayForwardsQueryAndTimeout(t *testing.T) {
+	srv := newTestServer(t, func(req *Request) *Response {
+		return &Response{Status: 200, Body: map[string]interface{}{
+			"path":    req.Path,
+			"limit":   req.Query().Get("limit"),
+			"timeout": float64(req.Timeout),
+		}}
+	})
+	gw := &Gateway{Client: newTestClient(t, ClientOptions{Addr: srv.ln.Addr().String()}), Timeout: time.Second}
+	rec := httptest.NewRecorder()
+	gw.ServeHTTP(rec, httptest.NewRequest("GET", "/items?limit=10", nil))
+
+	var resp Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Response is not JSON: %v", err)
+	}
+	if resp.Body["path"] != "/items?limit=10" || resp.Body["limit"] != "10" {
+		t.Errorf("Expected the query string to be forwarded, got %v", resp.Body)
+	}
+	if timeout, _ := resp.Body["timeout"].(float64); timeout <= 0 || timeout > float64(time.Second) {
+		t.Errorf("Expected the remaining timeout to be forwarded, got %v", resp.Body["timeout"])
+	}
+}
+
+func TestGatewayStreamsResponseBody(t *testing.T) {
+	data := strings.Repeat("chunk", 3*streamChunkSize)
+	srv := newTestServer(t, func(req *Request) *Response {
+		return &Response{Status: 200, Stream: func(w io.Writer) error {
+			_, err := io.WriteString(w, data)
+			return err
+		}}
+	})
+	gw := &Gateway{Client: newTestClient(t, ClientOptions{Addr: srv.ln.Addr().String()})}
+	rec := httptest.NewRecorder()
+	gw.ServeHTTP(rec, httptest.NewRequest("GET", "/download", nil))
+
+	if rec.Code != 200 {
+		t.Fatalf("Expected HTTP 200, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("Expected a raw body, got %q", ct)
+	}
+	if rec.Body.String() != data {
+		t.Errorf("Expected the %d-byte streamed body, got %d bytes", len(data), rec.Body.Len())
+	}
+}
@@ -0,0 +1,129 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strconv"
+)
+
+// The routes of the server in the parent directory, which the tests here
+// run against.
+
+func newRouter() *Router {
+	router := NewRouter()
+	router.Use(Logging, Recover)
+	router.Handle("GET", "/items/:id", itemHandler)
+	router.Handle("GET", "/whoami", whoamiHandler)
+	router.Handle("POST", "/upload", uploadHandler)
+	router.Handle("GET", "/download/:size", downloadHandler)
+	router.Handle("GET", "/*path", getHandler)
+	router.Handle("POST", "/*path", postHandler)
+	return router
+}
+
+func getHandler(req *Request) *Response {
+	return &Response{
+		Status:  200,
+		Message: "OK",
+		Body: map[string]interface{}{
+			"path": req.Path,
+		},
+	}
+}
+
+func itemHandler(req *Request) *Response {
+	return &Response{
+		Status:  200,
+		Message: "OK",
+		Body: map[string]interface{}{
+			"id": req.Params["id"],
+		},
+	}
+}
+
+func whoamiHandler(req *Request) *Response {
+	return &Response{
+		Status:  200,
+		Message: "OK",
+		Body: map[string]interface{}{
+			"addr":      req.RemoteAddr,
+			"identity":  PeerIdentity(req),
+			"principal": req.Principal,
+		},
+	}
+}
+
+// uploadHandler reads a streamed body of any size and reports its length
+// and SHA-256.
+func uploadHandler(req *Request) *Response {
+	if req.Stream == nil {
+		return &Response{Status: 400, Message: "Expected a streamed body"}
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, req.Stream)
+	if err != nil {
+		return &Response{Status: 400, Message: err.Error()}
+	}
+	return &Response{
+		Status:  201,
+		Message: "Created",
+		Body: map[string]interface{}{
+			"bytes":  n,
+			"sha256": hex.EncodeToString(h.Sum(nil)),
+		},
+	}
+}
+
+// downloadHandler streams :size bytes of a repeating pattern.
+func downloadHandler(req *Request) *Response {
+	size, err := strconv.ParseInt(req.Params["size"], 10, 64)
+	if err != nil || size < 0 {
+		return &Response{Status: 400, Message: "Invalid size"}
+	}
+	return &Response{
+		Status:  200,
+		Message: "OK",
+		Stream: func(w io.Writer) error {
+			_, err := io.CopyN(w, &patternReader{}, size)
+			return err
+		},
+	}
+}
+
+// patternReader yields the bytes 0 to 255 over and over.
+type patternReader struct {
+	next byte
+}
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.next
+		r.next++
+	}
+	return len(p), nil
+}
+
+// addEventRoutes lets clients subscribe to and publish on paths under
+// /events.
+func addEventRoutes(router *Router, broker *Broker) {
+	router.Handle(MethodSubscribe, "/events/*topic", func(req *Request) *Response {
+		return &Response{Status: 200, Message: "OK"}
+	})
+	router.Handle("POST", "/events/*topic", func(req *Request) *Response {
+		n := broker.Publish(req.Path, req.Body)
+		return &Response{
+			Status:  202,
+			Message: "Accepted",
+			Body:    map[string]interface{}{"delivered": n},
+		}
+	})
+}
+
+func postHandler(req *Request) *Response {
+	return &Response{
+		Status:  201,
+		Message: "Created",
+		Body:    req.Body,
+	}
+}
@@ -0,0 +1,52 @@
+package protocol
+
+import (
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// Logging logs every request with its status and how long it took.
+func Logging(next HandlerFunc) HandlerFunc {
+	return func(req *Request) *Response {
+		start := time.Now()
+		resp := next(req)
+		status := 0
+		if resp != nil {
+			status = resp.Status
+		}
+		log.Printf("%s %s -> %d (%v)", req.Method, req.Path, status, time.Since(start))
+		return resp
+	}
+}
+
+// Recover turns a panicking handler into a 500 response, so one bad request
+// does not take down the server.
+func Recover(next HandlerFunc) HandlerFunc {
+	return func(req *Request) (resp *Response) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Panic handling %s %s: %v\n%s", req.Method, req.Path, r, debug.Stack())
+				resp = &Response{Status: 500, Message: "Internal Server Error"}
+			}
+		}()
+		return next(req)
+	}
+}
+
+// RequireAuth rejects requests for which authorize returns an error with a
+// 401, before they reach the handler.
+func RequireAuth(authorize func(req *Request) error) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(req *Request) *Response {
+			if err := authorize(req); err != nil {
+				return &Response{
+					Status:  401,
+					Message: "Unauthorized",
+					Body:    map[string]interface{}{"error": err.Error()},
+				}
+			}
+			return next(req)
+		}
+	}
+}
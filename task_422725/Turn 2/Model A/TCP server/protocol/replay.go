@@ -0,0 +1,257 @@
+package protocol
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplayOptions says where and how to replay a capture.
+type ReplayOptions struct {
+	Addr string
+	Auth *ClientAuth
+	// TLS, if set, makes the replay dial Addr over TLS.
+	TLS *tls.Config
+	// Fast sends each request as soon as the one before it on its
+	// connection is answered, instead of at its captured time.
+	Fast bool
+}
+
+// ReplayDiff is a replayed request whose response differs from the
+// captured one, or that failed.
+type ReplayDiff struct {
+	Conn    uint64
+	Request *Request
+	Want    *Response
+	Got     *Response
+	Err     error
+}
+
+func (d *ReplayDiff) String() string {
+	prefix := fmt.Sprintf("conn %d #%d %s %s", d.Conn, d.Request.ID, d.Request.Method, d.Request.Path)
+	if d.Err != nil {
+		return fmt.Sprintf("%s: %v", prefix, d.Err)
+	}
+	var lines []string
+	if d.Want.Status != d.Got.Status {
+		lines = append(lines, fmt.Sprintf("  status: %d -> %d", d.Want.Status, d.Got.Status))
+	}
+	if d.Want.Message != d.Got.Message {
+		lines = append(lines, fmt.Sprintf("  message: %q -> %q", d.Want.Message, d.Got.Message))
+	}
+	want, got := normalizeBody(d.Want.Body), normalizeBody(d.Got.Body)
+	keys := make(map[string]struct{})
+	for k := range want {
+		keys[k] = struct{}{}
+	}
+	for k := range got {
+		keys[k] = struct{}{}
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		w, inWant := want[k]
+		g, inGot := got[k]
+		switch {
+		case !inGot:
+			lines = append(lines, fmt.Sprintf("  body.%s: %v -> missing", k, w))
+		case !inWant:
+			lines = append(lines, fmt.Sprintf("  body.%s: missing -> %v", k, g))
+		case !reflect.DeepEqual(w, g):
+			lines = append(lines, fmt.Sprintf("  body.%s: %v -> %v", k, w, g))
+		}
+	}
+	return prefix + ":\n" + strings.Join(lines, "\n")
+}
+
+// ReplayReport is the outcome of a replay.
+type ReplayReport struct {
+	// Sent counts the requests replayed, including any whose connection
+	// failed, and Skipped those that could not be: malformed ones,
+	// streamed bodies and subscriptions.
+	Sent    int
+	Skipped int
+	Diffs   []*ReplayDiff
+}
+
+// replayCall is a captured request and the response it got, if the
+// capture has one.
+type replayCall struct {
+	at   time.Duration // since the capture began
+	req  *Request
+	want *Response
+}
+
+// Replay re-sends the requests in a capture to opts.Addr, one connection
+// for each captured connection, and compares the responses with the
+// captured ones. Only status, message and body are compared; a request
+// whose response was never captured is sent but not compared. Each
+// connection is dialed when its first request is due; if that fails, its
+// requests are reported as diffs with the error.
+func Replay(ctx context.Context, entries []CaptureEntry, opts ReplayOptions) (*ReplayReport, error) {
+	report := &ReplayReport{}
+	conns := make(map[uint64][]*replayCall)
+	var order []uint64
+	// Responses match the outstanding request with their ID on their
+	// connection; IDs are reused once answered
+	pending := make(map[uint64]map[uint32]*replayCall)
+	var start time.Time
+	for i := range entries {
+		e := &entries[i]
+		if start.IsZero() {
+			start = e.Time
+		}
+		switch {
+		case e.Request != nil:
+			if e.Stream || e.Request.Method == MethodSubscribe || e.Request.Method == MethodUnsubscribe {
+				report.Skipped++
+				continue
+			}
+			e.Request.ID = e.ID
+			call := &replayCall{at: e.Time.Sub(start), req: e.Request}
+			if _, ok := conns[e.Conn]; !ok {
+				order = append(order, e.Conn)
+				pending[e.Conn] = make(map[uint32]*replayCall)
+			}
+			conns[e.Conn] = append(conns[e.Conn], call)
+			pending[e.Conn][e.ID] = call
+		case e.Response != nil:
+			if call := pending[e.Conn][e.ID]; call != nil {
+				call.want = e.Response
+				delete(pending[e.Conn], e.ID)
+			}
+		case e.Error != "":
+			report.Skipped++
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	begin := time.Now()
+	for _, id := range order {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			replayConn(ctx, opts, id, conns[id], begin, func(d *ReplayDiff) {
+				mu.Lock()
+				defer mu.Unlock()
+				report.Sent++
+				if d != nil {
+					report.Diffs = append(report.Diffs, d)
+				}
+			})
+		}()
+	}
+	wg.Wait()
+
+	// Diffs come in the order the requests were captured
+	captured := make(map[*Request]int)
+	for i := range entries {
+		if entries[i].Request != nil {
+			captured[entries[i].Request] = i
+		}
+	}
+	sort.Slice(report.Diffs, func(i, j int) bool {
+		return captured[report.Diffs[i].Request] < captured[report.Diffs[j].Request]
+	})
+	return report, ctx.Err()
+}
+
+func dialReplay(ctx context.Context, opts ReplayOptions) (*ClientConn, error) {
+	conn, err := dialAddr(ctx, opts.Addr, opts.TLS)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientConnAuth(conn, opts.Auth)
+}
+
+// replayConn sends one captured connection's requests on a connection of
+// its own, calling done with each one's diff, or nil if it matched.
+func replayConn(ctx context.Context, opts ReplayOptions, id uint64, calls []*replayCall, begin time.Time, done func(*ReplayDiff)) {
+	var c *ClientConn
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		if c != nil {
+			c.Close()
+		}
+	}()
+	for i, call := range calls {
+		if !opts.Fast {
+			// Requests go out at their captured times whether or not earlier
+			// ones were answered, so overlapping requests overlap again
+			select {
+			case <-time.After(time.Until(begin.Add(call.at))):
+			case <-ctx.Done():
+				return
+			}
+		}
+		if c == nil {
+			// Dialed only now, so a connection whose first request comes
+			// late is not closed as idle before it is used
+			var err error
+			if c, err = dialReplay(ctx, opts); err != nil {
+				for _, call := range calls[i:] {
+					done(&ReplayDiff{Conn: id, Request: call.req, Want: call.want, Err: fmt.Errorf("connecting: %w", err)})
+				}
+				return
+			}
+		}
+		if opts.Fast {
+			done(replayOne(ctx, c, id, call))
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done(replayOne(ctx, c, id, call))
+		}()
+	}
+}
+
+func replayOne(ctx context.Context, c *ClientConn, id uint64, call *replayCall) *ReplayDiff {
+	// The client picks its own ID, so send a copy
+	req := *call.req
+	resp, body, err := c.doStream(ctx, &req, 0, nil)
+	if body != nil {
+		body.Close()
+	}
+	if err != nil {
+		return &ReplayDiff{Conn: id, Request: call.req, Want: call.want, Err: err}
+	}
+	want := call.want
+	if want == nil {
+		return nil
+	}
+	if want.Status != resp.Status || want.Message != resp.Message ||
+		!reflect.DeepEqual(normalizeBody(want.Body), normalizeBody(resp.Body)) {
+		return &ReplayDiff{Conn: id, Request: call.req, Want: want, Got: resp}
+	}
+	return nil
+}
+
+// normalizeBody puts a body in the form JSON decodes it to, so bodies that
+// crossed different encodings compare equal.
+func normalizeBody(body map[string]interface{}) map[string]interface{} {
+	if body == nil {
+		return nil
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return body
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return body
+	}
+	return out
+}
@@ -0,0 +1,63 @@
+// Package protocol implements a framed request/response protocol over TCP
+// and other transports: the wire codec, a server with routing, a pooled
+// client, streamed bodies, subscriptions, authentication and traffic capture.
+package protocol
+
+import (
+	"crypto/tls"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type Request struct {
+	// ID is carried in the frame header and matches the response to it.
+	ID     uint32                 `json:"-"`
+	Method string                 `json:"method"`
+	Path   string                 `json:"path"`
+	Body   map[string]interface{} `json:"body,omitempty"`
+
+	// Timeout is how long the client will wait for the response, or zero
+	// if it did not say. A handler can use it to give up on work whose
+	// result nobody will see.
+	Timeout time.Duration `json:"timeout,omitempty"`
+
+	// Params holds the path parameters of the matched route.
+	Params map[string]string `json:"-"`
+	// RemoteAddr is the address of the client that sent the request.
+	RemoteAddr string `json:"-"`
+	// TLS describes the connection when it uses TLS, including any
+	// verified client certificate; see PeerIdentity.
+	TLS *tls.ConnectionState `json:"-"`
+	// Principal is who the connection authenticated as, when the server
+	// has a Verifier.
+	Principal string `json:"-"`
+	// Stream is a body of any size sent after the request, or nil. A
+	// client sets it to upload; a handler reads it.
+	Stream io.Reader `json:"-"`
+}
+
+// Query parses the query string the request's Path may end in. Routing
+// ignores the query string.
+func (r *Request) Query() url.Values {
+	_, query, _ := strings.Cut(r.Path, "?")
+	values, _ := url.ParseQuery(query)
+	return values
+}
+
+type Response struct {
+	ID      uint32                 `json:"-"`
+	Status  int                    `json:"status"`
+	Message string                 `json:"message"`
+	Body    map[string]interface{} `json:"body,omitempty"`
+
+	// Stream, when a handler sets it, is called once the response is sent
+	// to write a body of any size after it. An error aborts the body.
+	Stream func(w io.Writer) error `json:"-"`
+}
+
+const (
+	maxRequestSize = 1024 * 1024 // 1MB limit
+	maxInFlight    = 16          // concurrent requests per connection
+)
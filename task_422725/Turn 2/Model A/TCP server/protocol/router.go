@@ -0,0 +1,186 @@
+package protocol
+
+import (
+	"slices"
+	"strings"
+)
+
+// HandlerFunc answers a single request.
+type HandlerFunc func(req *Request) *Response
+
+// Middleware wraps a handler with behaviour shared across routes.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Chain wraps h in mw, the first middleware being the outermost.
+func Chain(h HandlerFunc, mw ...Middleware) HandlerFunc {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// Router dispatches requests by method and path pattern. Patterns are made
+// of slash-separated segments, each of which is one of:
+//
+//	items    matches the literal segment
+//	:id      matches any one segment, available as req.Params["id"]
+//	*rest    matches the remaining segments, possibly none; only allowed last
+//
+// When several patterns match, literal segments win over parameters and
+// parameters over wildcards. A path that matches no pattern gets a 404, and
+// one that matches only under other methods gets a 405.
+type Router struct {
+	root       node
+	middleware []Middleware
+}
+
+type node struct {
+	static   map[string]*node
+	param    *node
+	wildcard *node
+	// name is the parameter or wildcard name when this is such a node.
+	name     string
+	handlers map[string]HandlerFunc
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Use adds middleware run for every request, including 404s and 405s.
+func (r *Router) Use(mw ...Middleware) {
+	r.middleware = append(r.middleware, mw...)
+}
+
+// Handle registers h for method and pattern, wrapped in route-specific mw.
+// It panics on a malformed or duplicate pattern, since routes are fixed at
+// startup.
+func (r *Router) Handle(method, pattern string, h HandlerFunc, mw ...Middleware) {
+	n := &r.root
+	segments := splitPath(pattern)
+	for i, seg := range segments {
+		switch {
+		case strings.HasPrefix(seg, ":"):
+			if n.param == nil {
+				n.param = &node{name: seg[1:]}
+			} else if n.param.name != seg[1:] {
+				panic("router: conflicting parameter names :" + n.param.name + " and " + seg + " in " + pattern)
+			}
+			n = n.param
+		case strings.HasPrefix(seg, "*"):
+			if i != len(segments)-1 {
+				panic("router: wildcard must be the last segment in " + pattern)
+			}
+			if n.wildcard == nil {
+				n.wildcard = &node{name: seg[1:]}
+			} else if n.wildcard.name != seg[1:] {
+				panic("router: conflicting wildcard names *" + n.wildcard.name + " and " + seg + " in " + pattern)
+			}
+			n = n.wildcard
+		default:
+			if n.static == nil {
+				n.static = make(map[string]*node)
+			}
+			child, ok := n.static[seg]
+			if !ok {
+				child = &node{}
+				n.static[seg] = child
+			}
+			n = child
+		}
+	}
+	if n.handlers == nil {
+		n.handlers = make(map[string]HandlerFunc)
+	}
+	if _, ok := n.handlers[method]; ok {
+		panic("router: duplicate route " + method + " " + pattern)
+	}
+	n.handlers[method] = Chain(h, mw...)
+}
+
+// ServeRequest routes req through the router's middleware to its handler.
+func (r *Router) ServeRequest(req *Request) *Response {
+	return Chain(r.dispatch, r.middleware...)(req)
+}
+
+func (r *Router) dispatch(req *Request) *Response {
+	var allowed []string
+	var resp *Response
+	path, _, _ := strings.Cut(req.Path, "?")
+	handled := r.root.match(splitPath(path), map[string]string{}, func(n *node, params map[string]string) bool {
+		h, ok := n.handlers[req.Method]
+		if !ok {
+			for method := range n.handlers {
+				allowed = append(allowed, method)
+			}
+			return false
+		}
+		req.Params = params
+		resp = h(req)
+		return true
+	})
+	if handled {
+		return resp
+	}
+	if len(allowed) > 0 {
+		slices.Sort(allowed)
+		return &Response{
+			Status:  405,
+			Message: "Method Not Allowed",
+			Body:    map[string]interface{}{"allow": strings.Join(slices.Compact(allowed), ", ")},
+		}
+	}
+	return &Response{Status: 404, Message: "Not Found"}
+}
+
+// match calls visit for every node with handlers that matches segments, most
+// specific first, until visit returns true.
+func (n *node) match(segments []string, params map[string]string, visit func(*node, map[string]string) bool) bool {
+	if len(segments) == 0 {
+		if n.handlers != nil && visit(n, params) {
+			return true
+		}
+		// A trailing wildcard also matches nothing at all.
+		if n.wildcard != nil && n.wildcard.handlers != nil {
+			return visit(n.wildcard, with(params, n.wildcard.name, ""))
+		}
+		return false
+	}
+
+	if child, ok := n.static[segments[0]]; ok {
+		if child.match(segments[1:], params, visit) {
+			return true
+		}
+	}
+	if n.param != nil {
+		if n.param.match(segments[1:], with(params, n.param.name, segments[0]), visit) {
+			return true
+		}
+	}
+	if n.wildcard != nil && n.wildcard.handlers != nil {
+		return visit(n.wildcard, with(params, n.wildcard.name, strings.Join(segments, "/")))
+	}
+	return false
+}
+
+// with returns a copy of params with key set, leaving params untouched for
+// other branches of the search.
+func with(params map[string]string, key, value string) map[string]string {
+	out := make(map[string]string, len(params)+1)
+	for k, v := range params {
+		out[k] = v
+	}
+	out[key] = value
+	return out
+}
+
+// splitPath splits a path into its non-empty segments.
+func splitPath(path string) []string {
+	var segments []string
+	for _, seg := range strings.Split(path, "/") {
+		if seg != "" {
+			segments = append(segments, seg)
+		}
+	}
+	return segments
+}
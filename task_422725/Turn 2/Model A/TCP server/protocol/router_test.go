@@ -0,0 +1,141 @@
+package protocol
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// echoRoute answers with the name of the route and the parameters it saw.
+func echoRoute(name string) HandlerFunc {
+	return func(req *Request) *Response {
+		body := map[string]interface{}{"route": name}
+		for k, v := range req.Params {
+			body[k] = v
+		}
+		return &Response{Status: 200, Body: body}
+	}
+}
+
+func TestRouterMatching(t *testing.T) {
+	r := NewRouter()
+	r.Handle("GET", "/users", echoRoute("list"))
+	r.Handle("POST", "/users", echoRoute("create"))
+	r.Handle("GET", "/users/me", echoRoute("me"))
+	r.Handle("GET", "/users/:id", echoRoute("user"))
+	r.Handle("GET", "/users/:id/posts/:post", echoRoute("post"))
+	r.Handle("GET", "/files/*path", echoRoute("files"))
+
+	tests := []struct {
+		method, path string
+		status       int
+		body         map[string]interface{}
+	}{
+		{"GET", "/users", 200, map[string]interface{}{"route": "list"}},
+		{"POST", "/users/", 200, map[string]interface{}{"route": "create"}},
+		{"GET", "/users/me", 200, map[string]interface{}{"route": "me"}},
+		{"GET", "/users/42", 200, map[string]interface{}{"route": "user", "id": "42"}},
+		{"GET", "/users/42?fields=name", 200, map[string]interface{}{"route": "user", "id": "42"}},
+		{"GET", "/users/42/posts/7", 200, map[string]interface{}{"route": "post", "id": "42", "post": "7"}},
+		{"GET", "/files/a/b/c.txt", 200, map[string]interface{}{"route": "files", "path": "a/b/c.txt"}},
+		{"GET", "/files", 200, map[string]interface{}{"route": "files", "path": ""}},
+		{"DELETE", "/users", 405, map[string]interface{}{"allow": "GET, POST"}},
+		{"POST", "/users/me", 405, map[string]interface{}{"allow": "GET"}},
+		{"GET", "/nope", 404, nil},
+		{"GET", "/users/42/comments", 404, nil},
+	}
+	for _, tt := range tests {
+		resp := r.ServeRequest(&Request{Method: tt.method, Path: tt.path})
+		if resp.Status != tt.status || !reflect.DeepEqual(resp.Body, tt.body) {
+			t.Errorf("%s %s: expected %d %v, got %d %v", tt.method, tt.path, tt.status, tt.body, resp.Status, resp.Body)
+		}
+	}
+}
+
+func TestRouterFallsBackToLessSpecificRoute(t *testing.T) {
+	r := NewRouter()
+	r.Handle("POST", "/users/me", echoRoute("me"))
+	r.Handle("GET", "/users/:id", echoRoute("user"))
+
+	// The literal route exists but not for GET, so the parameter route answers.
+	resp := r.ServeRequest(&Request{Method: "GET", Path: "/users/me"})
+	if resp.Status != 200 || resp.Body["route"] != "user" {
+		t.Errorf("Expected the parameter route, got %d %v", resp.Status, resp.Body)
+	}
+}
+
+func TestRouterRejectsBadPatterns(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+	}{
+		{"duplicate", []string{"/a/:id", "/a/:id"}},
+		{"wildcard not last", []string{"/a/*rest/b"}},
+		{"conflicting params", []string{"/a/:id", "/a/:name/b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("Expected Handle to panic")
+				}
+			}()
+			r := NewRouter()
+			for _, p := range tt.patterns {
+				r.Handle("GET", p, echoRoute(p))
+			}
+		})
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(req *Request) *Response {
+				calls = append(calls, name)
+				return next(req)
+			}
+		}
+	}
+
+	r := NewRouter()
+	r.Use(trace("global"))
+	r.Handle("GET", "/x", echoRoute("x"), trace("route"))
+	r.ServeRequest(&Request{Method: "GET", Path: "/x"})
+	r.ServeRequest(&Request{Method: "GET", Path: "/missing"})
+
+	want := []string{"global", "route", "global"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("Expected %v, got %v", want, calls)
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	r := NewRouter()
+	r.Use(Recover)
+	r.Handle("GET", "/boom", func(req *Request) *Response { panic("boom") })
+
+	if resp := r.ServeRequest(&Request{Method: "GET", Path: "/boom"}); resp.Status != 500 {
+		t.Errorf("Expected 500, got %d", resp.Status)
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	auth := RequireAuth(func(req *Request) error {
+		if req.Body["token"] != "secret" {
+			return errors.New("bad token")
+		}
+		return nil
+	})
+	r := NewRouter()
+	r.Handle("POST", "/admin", echoRoute("admin"), auth)
+
+	if resp := r.ServeRequest(&Request{Method: "POST", Path: "/admin"}); resp.Status != 401 {
+		t.Errorf("Expected 401 without a token, got %d", resp.Status)
+	}
+	ok := &Request{Method: "POST", Path: "/admin", Body: map[string]interface{}{"token": "secret"}}
+	if resp := r.ServeRequest(ok); resp.Status != 200 {
+		t.Errorf("Expected 200 with the token, got %d", resp.Status)
+	}
+}
@@ -0,0 +1,571 @@
+package protocol
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Server defaults, used for zero fields of Server.
+const (
+	handshakeTimeout    = 5 * time.Second
+	defaultFrameTimeout = 10 * time.Second
+	DefaultIdleTimeout  = 2 * time.Minute
+)
+
+// Bounds of the wait before accepting again after a temporary error.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// ErrServerClosed is returned by Serve once Shutdown or Close is called.
+var ErrServerClosed = errors.New("server closed")
+
+// aLongTimeAgo is a deadline in the past, used to wake a blocked read.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// Server serves the protocol on any number of listeners.
+type Server struct {
+	Handler HandlerFunc
+	// Broker, if set, delivers events to subscriptions the handler accepts.
+	Broker *Broker
+	// Verifier, if set, makes every connection authenticate before its
+	// first request; handlers see who as Request.Principal.
+	Verifier Verifier
+	// AuthTimeout is how long a connection may take to authenticate.
+	AuthTimeout time.Duration
+	// AllowPlaintextTokens accepts bearer tokens on connections without
+	// TLS, where anyone on the path can read and replay them. Without it
+	// such connections must authenticate with an HMAC key.
+	AllowPlaintextTokens bool
+	// TLSConfig, if set, makes ListenAndServe serve TLS.
+	TLSConfig *tls.Config
+	// MaxConns caps the open connections; once reached, Serve stops
+	// accepting until one closes. Zero means no limit.
+	MaxConns int
+	// ReadTimeout bounds reading one frame once its first byte arrives,
+	// so a stalled peer cannot hold a half-read frame forever.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds each write to a connection; a peer that stops
+	// reading fails the write and the connection is closed. Zero means
+	// defaultWriteTimeout.
+	WriteTimeout time.Duration
+	// IdleTimeout closes a connection with no requests in flight and no
+	// subscriptions that sends nothing for this long. Busy connections are
+	// never closed as idle.
+	IdleTimeout time.Duration
+	// Capture, if set, records every request and response; see Replay.
+	Capture *Capture
+
+	inShutdown atomic.Bool
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[*serverConn]struct{}
+	sem        chan struct{}
+	done       chan struct{} // closed by Shutdown and Close
+	connsDone  chan struct{} // signalled as connections close
+}
+
+// ListenAndServe listens on addr and serves until the server is shut down.
+// The address may name a transport other than TCP, as in
+// "unix:/run/app.sock" or "udp:host:port".
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	if s.TLSConfig != nil {
+		ln = tls.NewListener(ln, s.TLSConfig)
+	}
+	log.Printf("Listening on %s %s", ln.Addr().Network(), ln.Addr())
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln until the server is shut down, when it
+// returns ErrServerClosed. It closes ln.
+func (s *Server) Serve(ln net.Listener) error {
+	if !s.track(ln) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer s.untrack(ln)
+
+	var delay time.Duration // how long to wait after a failed accept
+	for {
+		if s.MaxConns > 0 {
+			select {
+			case s.sem <- struct{}{}:
+			case <-s.done:
+				return ErrServerClosed
+			}
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.MaxConns > 0 {
+				<-s.sem
+			}
+			if s.inShutdown.Load() {
+				return ErrServerClosed
+			}
+			if retryAccept(err) {
+				// Back off as net/http does, so running out of file
+				// descriptors does not spin or stop the server
+				delay = min(max(2*delay, minAcceptDelay), maxAcceptDelay)
+				log.Printf("Error accepting: %v; retrying in %v", err, delay)
+				select {
+				case <-time.After(delay):
+				case <-s.done:
+					return ErrServerClosed
+				}
+				continue
+			}
+			return err
+		}
+		delay = 0
+		sc := &serverConn{srv: s, conn: conn}
+		if !s.trackConn(sc) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go sc.serve()
+	}
+}
+
+// retryAccept reports whether an accept error is worth waiting out: a
+// timeout, or running short of descriptors, memory or buffers.
+func retryAccept(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// Shutdown stops accepting connections, ends subscriptions, closes idle
+// connections, and waits for requests in flight to finish, including their
+// streamed bodies. New requests on open connections get 503. If ctx ends first, the remaining
+// connections are closed and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdown()
+	for {
+		s.mu.Lock()
+		n := len(s.conns)
+		for sc := range s.conns {
+			sc.endSubscriptions(ReasonShutdown, "server shutting down")
+			sc.wakeIfIdle()
+		}
+		s.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-s.connsDone:
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		}
+	}
+}
+
+// Close closes all listeners and connections at once.
+func (s *Server) Close() error {
+	s.shutdown()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sc := range s.conns {
+		sc.conn.Close()
+	}
+	return nil
+}
+
+func (s *Server) shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	if s.inShutdown.Swap(true) {
+		return
+	}
+	close(s.done)
+	for ln := range s.listeners {
+		ln.Close()
+	}
+}
+
+// init creates the server's bookkeeping; s.mu must be held.
+func (s *Server) init() {
+	if s.done != nil {
+		return
+	}
+	s.listeners = make(map[net.Listener]struct{})
+	s.conns = make(map[*serverConn]struct{})
+	s.sem = make(chan struct{}, max(s.MaxConns, 0))
+	s.done = make(chan struct{})
+	s.connsDone = make(chan struct{}, 1)
+}
+
+func (s *Server) track(ln net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	if s.inShutdown.Load() {
+		return false
+	}
+	s.listeners[ln] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(ln net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ln.Close()
+	delete(s.listeners, ln)
+}
+
+func (s *Server) trackConn(sc *serverConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	if s.inShutdown.Load() {
+		return false
+	}
+	s.conns[sc] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackConn(sc *serverConn) {
+	s.mu.Lock()
+	delete(s.conns, sc)
+	s.mu.Unlock()
+	if s.MaxConns > 0 {
+		<-s.sem
+	}
+	select {
+	case s.connsDone <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Server) readTimeout() time.Duration {
+	if s.ReadTimeout > 0 {
+		return s.ReadTimeout
+	}
+	return defaultFrameTimeout
+}
+
+func (s *Server) writeTimeout() time.Duration {
+	if s.WriteTimeout > 0 {
+		return s.WriteTimeout
+	}
+	return defaultWriteTimeout
+}
+
+func (s *Server) authTimeout() time.Duration {
+	if s.AuthTimeout > 0 {
+		return s.AuthTimeout
+	}
+	return defaultAuthTimeout
+}
+
+func (s *Server) idleTimeout() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+// closeOnWriteErrorConn closes the connection when a write fails. The codec
+// cannot recover from a partly written frame, and closing ends the read loop
+// and fails handlers still waiting to write, so Shutdown is not held up by a
+// peer that stopped reading.
+type closeOnWriteErrorConn struct {
+	writeTimeoutConn
+}
+
+func (c *closeOnWriteErrorConn) Write(p []byte) (int, error) {
+	n, err := c.writeTimeoutConn.Write(p)
+	if err != nil {
+		c.Close()
+	}
+	return n, err
+}
+
+// handleConn serves one connection with a server of default settings.
+func handleConn(conn net.Conn, handler HandlerFunc) {
+	sc := &serverConn{srv: &Server{Handler: handler}, conn: conn}
+	sc.serve()
+}
+
+// serverConn is one connection being served.
+type serverConn struct {
+	srv  *Server
+	conn net.Conn
+
+	// mu guards active, subs and the read deadline, so a handler finishing
+	// during shutdown can wake the read loop without racing it.
+	mu     sync.Mutex
+	active int // requests in flight
+	subs   map[uint32]*subscription
+}
+
+// serve reads requests and runs up to maxInFlight of them at once,
+// answering 503 beyond that. Responses are written as handlers finish,
+// tagged with the request's ID. The read loop never waits on a handler, so
+// it can keep feeding streamed bodies to the handlers reading them.
+func (sc *serverConn) serve() {
+	conn := sc.conn
+	defer conn.Close()
+	if sc.srv.conns != nil {
+		defer sc.srv.untrackConn(sc)
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	var state *tls.ConnectionState
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			log.Printf("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+		cs := tc.ConnectionState()
+		state = &cs
+	}
+
+	wc := &closeOnWriteErrorConn{writeTimeoutConn{Conn: conn, timeout: sc.srv.writeTimeout()}}
+	codec, err := serverHandshake(wc, maxRequestSize, sc.srv.Verifier != nil)
+	if err != nil {
+		log.Printf("Handshake failed: %v", err)
+		return
+	}
+	var principal string
+	if sc.srv.Verifier != nil {
+		conn.SetDeadline(time.Now().Add(sc.srv.authTimeout()))
+		principal, err = serverAuthenticate(codec, sc.srv.Verifier, state != nil || sc.srv.AllowPlaintextTokens)
+		if err != nil {
+			log.Printf("Authentication from %s failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	if sc.srv.Capture != nil {
+		codec.capture = sc.srv.Capture.conn(conn.RemoteAddr().String())
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	streams := newStreamSet(codec)
+	// Runs before wg.Wait, so handlers blocked on a body see the connection go
+	defer streams.closeAll(ErrConnClosed)
+	defer sc.endSubscriptions(ReasonShutdown, "connection closing")
+
+	for {
+		if !sc.awaitFrame(codec) {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(sc.srv.readTimeout()))
+		f, err := codec.readFrame()
+		if err != nil {
+			switch {
+			case errors.Is(err, io.EOF):
+				log.Println("Connection closed")
+				return
+			case errors.Is(err, ErrFrameTooLarge):
+				// The payload is unread or was a decompression bomb, so give up
+				sendResponse(codec, f.id, 413, "Request Too Large")
+			case errors.Is(err, ErrMalformed) && f.kind == frameRequest:
+				// A request that would not decompress was still read whole
+				log.Printf("Error parsing request: %v", err)
+				if err := rejectRequest(codec, f, 400, "Bad Request"); err != nil {
+					return
+				}
+				continue
+			}
+			log.Printf("Error reading request: %v", err)
+			return
+		}
+		if isStreamFrame(f.kind) {
+			if err := streams.handle(f); err != nil {
+				log.Printf("Error handling stream frame: %v", err)
+				return
+			}
+			continue
+		}
+
+		req, err := codec.decodeRequest(f)
+		if err != nil {
+			// The frame was read whole, so the connection is still usable
+			log.Printf("Error parsing request: %v", err)
+			if err := rejectRequest(codec, f, 400, "Bad Request"); err != nil {
+				return
+			}
+			continue
+		}
+		if req.Method == MethodUnsubscribe {
+			if err := sc.unsubscribe(codec, req); err != nil {
+				return
+			}
+			continue
+		}
+		if reject := sc.begin(); reject != "" {
+			if err := rejectRequest(codec, f, 503, reject); err != nil {
+				return
+			}
+			continue
+		}
+
+		req.RemoteAddr = conn.RemoteAddr().String()
+		req.TLS = state
+		req.Principal = principal
+		var body *recvStream
+		if f.flags&flagStream != 0 {
+			body = streams.openRecv(req.ID)
+			req.Stream = body
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer sc.end()
+			if req.Method == MethodSubscribe {
+				sc.serveSubscribe(codec, &wg, req, body)
+				return
+			}
+			serveRequest(codec, streams, sc.srv.Handler, req, body)
+		}()
+	}
+}
+
+// awaitFrame waits for the next frame to start arriving. It reports false
+// when the connection should close instead: the peer went away, it was idle
+// for too long, or the server is shutting down and nothing is in flight.
+func (sc *serverConn) awaitFrame(codec *Codec) bool {
+	for {
+		sc.mu.Lock()
+		if sc.srv.inShutdown.Load() && sc.active == 0 {
+			sc.mu.Unlock()
+			return false
+		}
+		sc.conn.SetReadDeadline(time.Now().Add(sc.srv.idleTimeout()))
+		sc.mu.Unlock()
+
+		_, err := codec.r.Peek(1)
+		if err == nil {
+			return true
+		}
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("Error reading request: %v", err)
+			} else {
+				log.Println("Connection closed")
+			}
+			return false
+		}
+		sc.mu.Lock()
+		busy := sc.active > 0 || len(sc.subs) > 0
+		sc.mu.Unlock()
+		if !busy {
+			if !sc.srv.inShutdown.Load() {
+				log.Printf("Closing idle connection from %s", sc.conn.RemoteAddr())
+			}
+			return false
+		}
+	}
+}
+
+// begin counts a new request in, or returns why it must be refused.
+func (sc *serverConn) begin() string {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	switch {
+	case sc.srv.inShutdown.Load():
+		return "Shutting Down"
+	case sc.active >= maxInFlight:
+		return "Too Many Requests"
+	}
+	sc.active++
+	return ""
+}
+
+// end counts a request out, waking the read loop if it was the last one
+// the connection was kept open for.
+func (sc *serverConn) end() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.active--
+	if sc.active == 0 && sc.srv.inShutdown.Load() {
+		sc.conn.SetReadDeadline(aLongTimeAgo)
+	}
+}
+
+// wakeIfIdle interrupts the read loop of a connection with nothing in
+// flight, so it notices the shutdown.
+func (sc *serverConn) wakeIfIdle() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.active == 0 {
+		sc.conn.SetReadDeadline(aLongTimeAgo)
+	}
+}
+
+// serveRequest runs handler and writes its response, streaming the
+// response body if it has one.
+func serveRequest(codec *Codec, streams *streamSet, handler HandlerFunc, req *Request, body *recvStream) {
+	resp := handler(req)
+	if body != nil {
+		// Whatever the handler left unread is not wanted
+		body.Close()
+	}
+	if resp == nil {
+		resp = &Response{Status: 500, Message: "Internal Server Error"}
+	}
+	// Copy so a handler may return a shared response
+	out := *resp
+	out.ID = req.ID
+
+	var stream *sendStream
+	if out.Stream != nil {
+		stream = streams.openSend(out.ID)
+	}
+	if err := codec.WriteResponse(&out); err != nil {
+		log.Printf("Error writing response: %v", err)
+		if stream != nil {
+			stream.fail(err)
+			stream.finish(err)
+		}
+		return
+	}
+	if stream != nil {
+		err := out.Stream(stream)
+		if err != nil && !errors.Is(err, ErrStreamStopped) {
+			log.Printf("Error streaming response to %s %s: %v", req.Method, req.Path, err)
+		}
+		stream.finish(err)
+	}
+}
+
+// rejectRequest answers the request in f without running a handler, and
+// stops its body if one was announced.
+func rejectRequest(codec *Codec, f frame, status int, message string) error {
+	if f.flags&flagStream != 0 {
+		if err := codec.writeFrame(frame{kind: frameStop, id: f.id}); err != nil {
+			return err
+		}
+	}
+	return sendResponse(codec, f.id, status, message)
+}
+
+func sendResponse(codec *Codec, id uint32, status int, message string) error {
+	return codec.WriteResponse(&Response{ID: id, Status: status, Message: message})
+}
@@ -0,0 +1,269 @@
+package protocol
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startServer runs srv on a loopback port and returns its address and the
+// error Serve returned, once it does.
+func startServer(t *testing.T, srv *Server) (string, <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String(), served
+}
+
+func dialServer(t *testing.T, addr string) *ClientConn {
+	t.Helper()
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	addr, _ := startServer(t, &Server{
+		Handler: func(req *Request) *Response {
+			if req.Path == "/slow" {
+				time.Sleep(150 * time.Millisecond)
+			}
+			return &Response{Status: 200}
+		},
+		IdleTimeout: 50 * time.Millisecond,
+	})
+	c := dialServer(t, addr)
+
+	// The deadline moves with each frame, so a chatty client outlives it
+	for i := 0; i < 5; i++ {
+		if _, err := c.Do(&Request{Method: "GET", Path: "/"}); err != nil {
+			t.Fatalf("Do %d failed: %v", i, err)
+		}
+		time.Sleep(25 * time.Millisecond)
+	}
+	// A request in flight keeps the connection open however long it takes
+	if _, err := c.Do(&Request{Method: "GET", Path: "/slow"}); err != nil {
+		t.Fatalf("Expected a slow request to outlive the idle timeout, got %v", err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if err := c.Err(); !errors.Is(err, ErrConnClosed) {
+		t.Errorf("Expected the idle connection to be closed, got %v", err)
+	}
+}
+
+func TestServerReadTimeoutForPartialFrame(t *testing.T) {
+	addr, _ := startServer(t, &Server{
+		Handler:     newRouter().ServeRequest,
+		ReadTimeout: 50 * time.Millisecond,
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	if _, err := ClientHandshake(conn, maxRequestSize); err != nil {
+		t.Fatalf("ClientHandshake failed: %v", err)
+	}
+
+	// Half a header, then nothing
+	conn.Write([]byte{'T', 'P', protocolVersion})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	var ne net.Error
+	if err == nil || errors.As(err, &ne) && ne.Timeout() {
+		t.Errorf("Expected the server to close the connection, got %v", err)
+	}
+}
+
+func TestServerMaxConns(t *testing.T) {
+	srv := &Server{Handler: newRouter().ServeRequest, MaxConns: 1}
+	addr, _ := startServer(t, srv)
+	first := dialServer(t, addr)
+	if _, err := first.Do(&Request{Method: "GET", Path: "/"}); err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+
+	client := newTestClient(t, ClientOptions{Addr: addr, ConnectTimeout: 100 * time.Millisecond, MaxRetries: -1})
+	_, err := client.Do(context.Background(), &Request{Method: "GET", Path: "/"})
+	var ce *ClientError
+	if !errors.As(err, &ce) || ce.Op != "connect" || !ce.Timeout() {
+		t.Fatalf("Expected the second connection to wait past its connect timeout, got %v", err)
+	}
+
+	first.Close()
+	client = newTestClient(t, ClientOptions{Addr: addr, ConnectTimeout: time.Second})
+	if _, err := client.Do(context.Background(), &Request{Method: "GET", Path: "/"}); err != nil {
+		t.Errorf("Expected a connection once the first closed, got %v", err)
+	}
+}
+
+func TestServerShutdownDrainsInFlight(t *testing.T) {
+	started := make(chan struct{})
+	srv := &Server{Handler: func(req *Request) *Response {
+		if req.Path == "/slow" {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+		}
+		return &Response{Status: 200}
+	}}
+	addr, served := startServer(t, srv)
+	busy := dialServer(t, addr)
+	idle := dialServer(t, addr)
+
+	slow := make(chan error, 1)
+	go func() {
+		resp, err := busy.Do(&Request{Method: "GET", Path: "/slow"})
+		if err == nil && resp.Status != 200 {
+			err = errors.New(resp.Message)
+		}
+		slow <- err
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+
+	if resp, err := busy.Do(&Request{Method: "GET", Path: "/"}); err != nil || resp.Status != 503 {
+		t.Errorf("Expected 503 for a new request while draining, got %+v, %v", resp, err)
+	}
+	if err := <-slow; err != nil {
+		t.Errorf("Expected the in-flight request to finish, got %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Expected Serve to return ErrServerClosed, got %v", err)
+	}
+	if err := idle.Err(); !errors.Is(err, ErrConnClosed) {
+		t.Errorf("Expected the idle connection to be closed, got %v", err)
+	}
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Error("Expected new connections to be refused after shutdown")
+	}
+}
+
+func TestServerShutdownContextExpires(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	srv := &Server{Handler: func(req *Request) *Response {
+		close(started)
+		<-release
+		return &Response{Status: 200}
+	}}
+	addr, _ := startServer(t, srv)
+	c := dialServer(t, addr)
+
+	pending := make(chan error, 1)
+	go func() {
+		_, err := c.Do(&Request{Method: "GET", Path: "/stuck"})
+		pending <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected Shutdown to give up with the context, got %v", err)
+	}
+	if err := <-pending; !errors.Is(err, ErrConnClosed) {
+		t.Errorf("Expected the stuck request's connection to be closed, got %v", err)
+	}
+}
+
+func TestServerWriteTimeoutClosesStuckConnection(t *testing.T) {
+	// Random data, so compression cannot shrink the responses
+	data := make([]byte, 300*1024)
+	rand.Read(data)
+	body := map[string]interface{}{"data": base64.StdEncoding.EncodeToString(data)}
+	handled := make(chan struct{}, 64)
+	srv := &Server{
+		Handler: func(req *Request) *Response {
+			handled <- struct{}{}
+			return &Response{Status: 200, Body: body}
+		},
+		WriteTimeout: 50 * time.Millisecond,
+	}
+	addr, _ := startServer(t, srv)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.(*net.TCPConn).SetReadBuffer(4096)
+	codec, err := ClientHandshake(conn, maxRequestSize)
+	if err != nil {
+		t.Fatalf("ClientHandshake failed: %v", err)
+	}
+	// Ask for far more than the socket buffers hold and never read it
+	for i := 1; i <= 64; i++ {
+		if err := codec.WriteRequest(&Request{ID: uint32(i), Method: "GET", Path: "/"}); err != nil {
+			t.Fatalf("WriteRequest failed: %v", err)
+		}
+	}
+	for i := 0; i < maxInFlight; i++ {
+		<-handled
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Expected the stuck connection to be closed so Shutdown finishes, got %v", err)
+	}
+}
+
+// flakyListener fails its first accepts with errs before accepting for real.
+type flakyListener struct {
+	net.Listener
+	errs chan error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	select {
+	case err := <-l.errs:
+		return nil, err
+	default:
+		return l.Listener.Accept()
+	}
+}
+
+func TestServerRetriesTemporaryAcceptErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	errs := make(chan error, 2)
+	errs <- &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	errs <- &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.ECONNABORTED)}
+	srv := &Server{Handler: newRouter().ServeRequest}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(&flakyListener{Listener: ln, errs: errs}) }()
+	t.Cleanup(func() { srv.Close() })
+
+	c := dialServer(t, ln.Addr().String())
+	if resp, err := c.Do(&Request{Method: "GET", Path: "/after"}); err != nil || resp.Status != 200 {
+		t.Fatalf("Expected the server to keep serving, got %+v, %v", resp, err)
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("Serve returned: %v", err)
+	default:
+	}
+}
@@ -0,0 +1,356 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A streamed body follows its request or response frame as data frames with
+// the same ID, the last one flagged flagEnd. Each direction of each request
+// is flow controlled separately: a sender may have at most streamWindow
+// bytes that the receiver has not yet read, and the receiver grants more
+// with window frames as it reads. This bounds the memory a body takes on
+// either side, whatever its size.
+//
+// A receiver that stops reading early sends a stop frame, and a sender that
+// cannot finish a body sends an abort frame with the reason.
+const (
+	streamChunkSize = 32 << 10
+	streamWindow    = 256 << 10
+)
+
+var (
+	// ErrStreamStopped is returned by writes to a body the peer stopped reading.
+	ErrStreamStopped = errors.New("stream stopped by peer")
+	// ErrStreamAborted is returned by reads of a body the peer gave up sending.
+	ErrStreamAborted = errors.New("stream aborted by peer")
+
+	errWindowExceeded = errors.New("peer sent more than the stream window")
+)
+
+func isStreamFrame(kind frameKind) bool {
+	switch kind {
+	case frameData, frameWindow, frameStop, frameAbort:
+		return true
+	}
+	return false
+}
+
+// streamSet tracks the bodies being streamed in each direction on one
+// connection, keyed by request ID.
+type streamSet struct {
+	codec *Codec
+
+	mu   sync.Mutex
+	recv map[uint32]*recvStream
+	send map[uint32]*sendStream
+	err  error
+}
+
+func newStreamSet(codec *Codec) *streamSet {
+	return &streamSet{
+		codec: codec,
+		recv:  make(map[uint32]*recvStream),
+		send:  make(map[uint32]*sendStream),
+	}
+}
+
+// openRecv starts receiving the body for id. It must be called before the
+// next frame is read, since the body's data may follow immediately.
+func (s *streamSet) openRecv(id uint32) *recvStream {
+	rs := &recvStream{set: s, id: id}
+	rs.ready = sync.NewCond(&rs.mu)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		rs.err = s.err
+		return rs
+	}
+	s.recv[id] = rs
+	return rs
+}
+
+// openSend starts sending a body for id. It must be called before the frame
+// announcing the body is written, so no window update is missed.
+func (s *streamSet) openSend(id uint32) *sendStream {
+	ss := &sendStream{set: s, id: id, window: streamWindow}
+	ss.credit = sync.NewCond(&ss.mu)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		ss.err = s.err
+		return ss
+	}
+	s.send[id] = ss
+	return ss
+}
+
+// handle applies a data, window, stop or abort frame. Frames for bodies
+// that are no longer tracked are dropped, since they can cross a stop or
+// abort on the wire. An error means the peer broke the protocol.
+func (s *streamSet) handle(f frame) error {
+	s.mu.Lock()
+	rs := s.recv[f.id]
+	ss := s.send[f.id]
+	switch {
+	case f.kind == frameData && f.flags&flagEnd != 0, f.kind == frameAbort:
+		delete(s.recv, f.id)
+	case f.kind == frameStop:
+		delete(s.send, f.id)
+	}
+	s.mu.Unlock()
+
+	switch f.kind {
+	case frameData:
+		if rs != nil {
+			return rs.push(f.payload, f.flags&flagEnd != 0)
+		}
+	case frameWindow:
+		if len(f.payload) != 4 {
+			return fmt.Errorf("%w: window update of %d bytes", ErrMalformed, len(f.payload))
+		}
+		if ss != nil {
+			ss.grant(int(binary.BigEndian.Uint32(f.payload)))
+		}
+	case frameStop:
+		if ss != nil {
+			ss.fail(ErrStreamStopped)
+		}
+	case frameAbort:
+		if rs != nil {
+			rs.fail(fmt.Errorf("%w: %s", ErrStreamAborted, f.payload))
+		}
+	}
+	return nil
+}
+
+// closeAll fails every body in both directions, as the connection is gone.
+func (s *streamSet) closeAll(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	recv, send := s.recv, s.send
+	s.recv, s.send = map[uint32]*recvStream{}, map[uint32]*sendStream{}
+	s.mu.Unlock()
+
+	for _, rs := range recv {
+		rs.fail(err)
+	}
+	for _, ss := range send {
+		ss.fail(err)
+	}
+}
+
+func (s *streamSet) forgetRecv(id uint32, rs *recvStream) {
+	s.mu.Lock()
+	if s.recv[id] == rs {
+		delete(s.recv, id)
+	}
+	s.mu.Unlock()
+}
+
+func (s *streamSet) forgetSend(id uint32, ss *sendStream) {
+	s.mu.Lock()
+	if s.send[id] == ss {
+		delete(s.send, id)
+	}
+	s.mu.Unlock()
+}
+
+// recvStream is the receiving end of a body. Read returns the data in order
+// and io.EOF once the sender ends the body.
+type recvStream struct {
+	set *streamSet
+	id  uint32
+
+	mu       sync.Mutex
+	ready    *sync.Cond
+	chunks   [][]byte
+	buffered int  // bytes received but not yet read
+	unacked  int  // bytes read but not yet granted back to the sender
+	ended    bool // the last chunk has arrived
+	closed   bool // the reader gave up
+	err      error
+}
+
+func (rs *recvStream) push(data []byte, end bool) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.closed {
+		return nil
+	}
+	if rs.buffered+rs.unacked+len(data) > streamWindow {
+		return errWindowExceeded
+	}
+	if len(data) > 0 {
+		rs.chunks = append(rs.chunks, data)
+		rs.buffered += len(data)
+	}
+	rs.ended = rs.ended || end
+	rs.ready.Broadcast()
+	return nil
+}
+
+func (rs *recvStream) fail(err error) {
+	rs.mu.Lock()
+	if rs.err == nil && !rs.ended {
+		rs.err = err
+	}
+	rs.ready.Broadcast()
+	rs.mu.Unlock()
+}
+
+func (rs *recvStream) Read(p []byte) (int, error) {
+	rs.mu.Lock()
+	for len(rs.chunks) == 0 && !rs.ended && !rs.closed && rs.err == nil {
+		rs.ready.Wait()
+	}
+	if rs.closed {
+		rs.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	if len(rs.chunks) == 0 {
+		err := rs.err
+		if rs.ended {
+			err = io.EOF
+		}
+		rs.mu.Unlock()
+		return 0, err
+	}
+
+	n := copy(p, rs.chunks[0])
+	if n == len(rs.chunks[0]) {
+		rs.chunks[0] = nil
+		rs.chunks = rs.chunks[1:]
+	} else {
+		rs.chunks[0] = rs.chunks[0][n:]
+	}
+	rs.buffered -= n
+	rs.unacked += n
+	var grant int
+	if rs.unacked >= streamChunkSize && !rs.ended {
+		grant, rs.unacked = rs.unacked, 0
+	}
+	rs.mu.Unlock()
+
+	if grant > 0 {
+		var payload [4]byte
+		binary.BigEndian.PutUint32(payload[:], uint32(grant))
+		if err := rs.set.codec.writeFrame(frame{kind: frameWindow, id: rs.id, payload: payload[:]}); err != nil {
+			rs.fail(err)
+		}
+	}
+	return n, nil
+}
+
+// Close discards the rest of the body. If the sender has not finished, it is
+// told to stop.
+func (rs *recvStream) Close() error {
+	rs.mu.Lock()
+	if rs.closed {
+		rs.mu.Unlock()
+		return nil
+	}
+	rs.closed = true
+	rs.chunks = nil
+	stop := !rs.ended && rs.err == nil
+	rs.ready.Broadcast()
+	rs.mu.Unlock()
+
+	rs.set.forgetRecv(rs.id, rs)
+	if stop {
+		return rs.set.codec.writeFrame(frame{kind: frameStop, id: rs.id})
+	}
+	return nil
+}
+
+// sendStream is the sending end of a body. Write blocks while the receiver
+// has a full window of unread data.
+type sendStream struct {
+	set *streamSet
+	id  uint32
+
+	mu     sync.Mutex
+	credit *sync.Cond
+	window int
+	err    error
+}
+
+func (ss *sendStream) grant(n int) {
+	ss.mu.Lock()
+	ss.window += n
+	ss.credit.Broadcast()
+	ss.mu.Unlock()
+}
+
+func (ss *sendStream) fail(err error) {
+	ss.mu.Lock()
+	if ss.err == nil {
+		ss.err = err
+	}
+	ss.credit.Broadcast()
+	ss.mu.Unlock()
+}
+
+func (ss *sendStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		ss.mu.Lock()
+		for ss.window == 0 && ss.err == nil {
+			ss.credit.Wait()
+		}
+		if ss.err != nil {
+			err := ss.err
+			ss.mu.Unlock()
+			return written, err
+		}
+		n := min(len(p), ss.window, streamChunkSize)
+		ss.window -= n
+		ss.mu.Unlock()
+
+		if err := ss.set.codec.writeFrame(frame{kind: frameData, id: ss.id, payload: p[:n]}); err != nil {
+			ss.fail(err)
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// abort gives up on the body with err as the reason, telling the receiver
+// unless the body was already stopped or failed. A Write in progress
+// returns err.
+func (ss *sendStream) abort(err error) {
+	ss.set.forgetSend(ss.id, ss)
+	ss.mu.Lock()
+	failed := ss.err
+	if failed == nil {
+		ss.err = err
+	}
+	ss.credit.Broadcast()
+	ss.mu.Unlock()
+	if failed == nil {
+		ss.set.codec.writeFrame(frame{kind: frameAbort, id: ss.id, payload: []byte(err.Error())})
+	}
+}
+
+// finish ends the body: normally if err is nil, or by aborting it with err
+// as the reason. It is a no-op for a body the receiver stopped.
+func (ss *sendStream) finish(err error) error {
+	ss.set.forgetSend(ss.id, ss)
+	ss.mu.Lock()
+	failed := ss.err
+	ss.mu.Unlock()
+	if failed != nil {
+		return failed
+	}
+	if err != nil {
+		return ss.set.codec.writeFrame(frame{kind: frameAbort, id: ss.id, payload: []byte(err.Error())})
+	}
+	return ss.set.codec.writeFrame(frame{kind: frameData, flags: flagEnd, id: ss.id})
+}
@@ -0,0 +1,178 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveRouter serves handler on a loopback TCP port and returns a client.
+func serveRouter(t *testing.T, handler HandlerFunc) *ClientConn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleConn(conn, handler)
+		}
+	}()
+
+	c, err := Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestStreamUpload(t *testing.T) {
+	c := serveRouter(t, newRouter().ServeRequest)
+
+	const size = 8 << 20
+	want := sha256.New()
+	io.CopyN(want, &patternReader{}, size)
+
+	resp, err := c.Do(&Request{Method: "POST", Path: "/upload", Stream: io.LimitReader(&patternReader{}, size)})
+	if err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+	if resp.Status != 201 {
+		t.Fatalf("Expected 201, got %d %s", resp.Status, resp.Message)
+	}
+	if resp.Body["bytes"] != float64(size) {
+		t.Errorf("Expected %d bytes, got %v", size, resp.Body["bytes"])
+	}
+	if resp.Body["sha256"] != hex.EncodeToString(want.Sum(nil)) {
+		t.Errorf("Upload hash mismatch: %v", resp.Body["sha256"])
+	}
+}
+
+func TestStreamDownload(t *testing.T) {
+	c := serveRouter(t, newRouter().ServeRequest)
+
+	const size = 8<<20 + 123
+	resp, body, err := c.DoStream(&Request{Method: "GET", Path: "/download/8388731"})
+	if err != nil {
+		t.Fatalf("DoStream failed: %v", err)
+	}
+	if resp.Status != 200 || body == nil {
+		t.Fatalf("Expected a streamed 200, got %d with body %v", resp.Status, body)
+	}
+	got := sha256.New()
+	n, err := io.Copy(got, body)
+	if err != nil {
+		t.Fatalf("Reading body failed: %v", err)
+	}
+	want := sha256.New()
+	io.CopyN(want, &patternReader{}, size)
+	if n != size || !bytes.Equal(got.Sum(nil), want.Sum(nil)) {
+		t.Errorf("Expected %d matching bytes, got %d", size, n)
+	}
+}
+
+func TestStreamUnreadUploadIsStopped(t *testing.T) {
+	c := serveRouter(t, func(req *Request) *Response {
+		return &Response{Status: 413, Message: "Not reading that"}
+	})
+
+	// Far more than a window: the upload must be stopped, not left blocked
+	resp, err := c.Do(&Request{Method: "POST", Path: "/x", Stream: io.LimitReader(&patternReader{}, 64<<20)})
+	if err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+	if resp.Status != 413 {
+		t.Errorf("Expected 413, got %d", resp.Status)
+	}
+	if resp, err := c.Do(&Request{Method: "GET", Path: "/"}); err != nil || resp.Status != 413 {
+		t.Errorf("Expected the connection to stay usable, got %+v, %v", resp, err)
+	}
+}
+
+func TestStreamAbortReachesReader(t *testing.T) {
+	c := serveRouter(t, func(req *Request) *Response {
+		return &Response{Status: 200, Stream: func(w io.Writer) error {
+			w.Write([]byte("partial"))
+			return errors.New("disk on fire")
+		}}
+	})
+
+	_, body, err := c.DoStream(&Request{Method: "GET", Path: "/"})
+	if err != nil {
+		t.Fatalf("DoStream failed: %v", err)
+	}
+	data, err := io.ReadAll(body)
+	if !errors.Is(err, ErrStreamAborted) {
+		t.Errorf("Expected ErrStreamAborted, got %v", err)
+	}
+	if string(data) != "partial" {
+		t.Errorf("Expected the data sent before the abort, got %q", data)
+	}
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	n chan int
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	w.n <- len(p)
+	return len(p), nil
+}
+
+func TestSendStreamWaitsForWindow(t *testing.T) {
+	out := countingWriter{n: make(chan int, 1024)}
+	streams := newStreamSet(newCodec(struct {
+		io.Reader
+		io.Writer
+	}{nil, out}, maxRequestSize))
+	ss := streams.openSend(1)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ss.Write(make([]byte, 2*streamWindow))
+		done <- err
+	}()
+
+	// Only a window's worth of data goes out before the receiver grants more
+	full := streamWindow + streamWindow/streamChunkSize*headerSize
+	sent := 0
+	for sent < full {
+		select {
+		case n := <-out.n:
+			sent += n
+		case <-time.After(time.Second):
+			t.Fatalf("Expected a full window to be sent, got %d bytes", sent)
+		}
+	}
+	select {
+	case n := <-out.n:
+		t.Fatalf("Expected the sender to wait for the window, but it sent %d more bytes", n)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	ss.grant(streamWindow)
+	if err := <-done; err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+}
+
+func TestRecvStreamRejectsWindowOverrun(t *testing.T) {
+	streams := newStreamSet(newCodec(&bytes.Buffer{}, maxRequestSize))
+	streams.openRecv(1)
+	err := streams.handle(frame{kind: frameData, id: 1, payload: make([]byte, streamWindow+1)})
+	if !errors.Is(err, errWindowExceeded) {
+		t.Errorf("Expected errWindowExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,410 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// A client subscribes to a path with a SUBSCRIBE request, which goes
+// through the handler like any other so routes and middleware decide who
+// may subscribe to what. If the handler answers 200 and the server has a
+// Broker, events published on the path are pushed to the client in event
+// frames carrying the SUBSCRIBE request's ID, until an UNSUBSCRIBE request
+// with that ID in its body as "subscription".
+//
+// A subscription ends with an end frame giving an EndReason and a message;
+// no events follow it. Each subscriber has a buffer of subscriberBuffer
+// events, and one that falls that far behind, or stops reading for longer
+// than Server.WriteTimeout, is disconnected as a slow consumer rather than
+// allowed to hold up the publisher or the connection's other writers.
+const (
+	MethodSubscribe   = "SUBSCRIBE"
+	MethodUnsubscribe = "UNSUBSCRIBE"
+	// MethodEvent is the method of the Request carried by an event frame.
+	MethodEvent = "EVENT"
+
+	subscriberBuffer = 64
+	maxSubscriptions = 64 // per connection
+)
+
+// EndReason says why a subscription ended.
+type EndReason byte
+
+const (
+	ReasonUnsubscribed EndReason = iota + 1
+	ReasonSlowConsumer
+	ReasonShutdown
+)
+
+func (r EndReason) String() string {
+	switch r {
+	case ReasonUnsubscribed:
+		return "unsubscribed"
+	case ReasonSlowConsumer:
+		return "slow consumer"
+	case ReasonShutdown:
+		return "shutdown"
+	}
+	return fmt.Sprintf("reason(%d)", byte(r))
+}
+
+// SubscriptionError is why a subscription ended, as the server reported it
+// or, for ReasonSlowConsumer, as the client decided when its own buffer
+// filled.
+type SubscriptionError struct {
+	Reason  EndReason
+	Message string
+}
+
+func (e *SubscriptionError) Error() string {
+	return fmt.Sprintf("subscription ended: %v: %s", e.Reason, e.Message)
+}
+
+// Broker fans events out to the subscribers of each path.
+type Broker struct {
+	mu   sync.RWMutex
+	subs map[string]map[*subscription]struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[string]map[*subscription]struct{})}
+}
+
+// Publish sends body to every subscriber of path and returns how many got
+// it. It never blocks: subscribers whose buffer is full are ended instead.
+func (b *Broker) Publish(path string, body map[string]interface{}) int {
+	ev := &Request{Method: MethodEvent, Path: path, Body: body}
+	var slow []*subscription
+	delivered := 0
+	b.mu.RLock()
+	for sub := range b.subs[path] {
+		select {
+		case sub.events <- ev:
+			delivered++
+		default:
+			slow = append(slow, sub)
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, sub := range slow {
+		log.Printf("Ending subscription %d to %s: slow consumer", sub.id, path)
+		sub.end(ReasonSlowConsumer, fmt.Sprintf("more than %d events behind", subscriberBuffer))
+	}
+	return delivered
+}
+
+func (b *Broker) add(sub *subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-sub.done:
+		return
+	default:
+	}
+	if b.subs[sub.path] == nil {
+		b.subs[sub.path] = make(map[*subscription]struct{})
+	}
+	b.subs[sub.path][sub] = struct{}{}
+}
+
+func (b *Broker) remove(sub *subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs[sub.path], sub)
+	if len(b.subs[sub.path]) == 0 {
+		delete(b.subs, sub.path)
+	}
+}
+
+// subscription is the server's side of one subscription. Its writer
+// goroutine is the only one writing its frames, so the end frame is always
+// the last.
+type subscription struct {
+	sc     *serverConn
+	codec  *Codec
+	id     uint32
+	path   string
+	events chan *Request
+
+	once    sync.Once
+	done    chan struct{}
+	reason  EndReason
+	message string
+}
+
+// end stops the subscription; the first reason given is the one sent.
+func (s *subscription) end(reason EndReason, message string) {
+	s.once.Do(func() {
+		s.reason, s.message = reason, message
+		// Closed first, so Broker.add cannot re-add an ended subscription
+		close(s.done)
+		s.sc.srv.Broker.remove(s)
+		s.sc.forgetSubscription(s)
+	})
+}
+
+func (s *subscription) run() {
+	for {
+		// An ended subscription sends nothing more, even if events are queued
+		select {
+		case <-s.done:
+			s.writeEnd()
+			return
+		default:
+		}
+		select {
+		case ev := <-s.events:
+			data, err := s.codec.enc.EncodeRequest(ev)
+			if err == nil {
+				err = s.codec.writeFrame(frame{kind: frameEvent, id: s.id, payload: data})
+			}
+			if err != nil {
+				// The failed write, a timeout included, closed the connection
+				log.Printf("Error sending event to subscription %d: %v", s.id, err)
+				s.end(ReasonShutdown, "connection failed")
+			}
+		case <-s.done:
+			s.writeEnd()
+			return
+		}
+	}
+}
+
+// writeEnd sends the end frame. A slow consumer's connection is closed
+// after it: the client has already missed events, and leaving it open
+// would let it hold up the connection's other writers.
+func (s *subscription) writeEnd() {
+	payload := append([]byte{byte(s.reason)}, s.message...)
+	s.codec.writeFrame(frame{kind: frameSubscriptionEnd, id: s.id, payload: payload})
+	if s.reason == ReasonSlowConsumer {
+		s.sc.conn.Close()
+	}
+}
+
+// serveSubscribe runs the handler for a SUBSCRIBE request and, if it
+// accepts, starts pushing events once the response is sent.
+func (sc *serverConn) serveSubscribe(codec *Codec, wg *sync.WaitGroup, req *Request, body *recvStream) {
+	var resp *Response
+	if sc.srv.Broker == nil {
+		resp = &Response{Status: 501, Message: "Subscriptions Not Supported"}
+	} else {
+		resp = sc.srv.Handler(req)
+	}
+	if body != nil {
+		body.Close()
+	}
+	if resp == nil {
+		resp = &Response{Status: 500, Message: "Internal Server Error"}
+	}
+
+	var sub *subscription
+	if resp.Status == 200 {
+		sub = &subscription{
+			sc:     sc,
+			codec:  codec,
+			id:     req.ID,
+			path:   req.Path,
+			events: make(chan *Request, subscriberBuffer),
+			done:   make(chan struct{}),
+		}
+		sc.mu.Lock()
+		switch {
+		case sc.srv.inShutdown.Load():
+			resp, sub = &Response{Status: 503, Message: "Shutting Down"}, nil
+		case len(sc.subs) >= maxSubscriptions:
+			resp, sub = &Response{Status: 503, Message: "Too Many Subscriptions"}, nil
+		case sc.subs[sub.id] != nil:
+			resp, sub = &Response{Status: 409, Message: "Subscription ID In Use"}, nil
+		default:
+			if sc.subs == nil {
+				sc.subs = make(map[uint32]*subscription)
+			}
+			sc.subs[sub.id] = sub
+		}
+		sc.mu.Unlock()
+	}
+
+	// Added before answering, so every event published after the client
+	// sees the 200 reaches it; the writer starts after the answer, so the
+	// 200 still comes first
+	if sub != nil {
+		sc.srv.Broker.add(sub)
+	}
+	// A subscription's answer has no body; events take its place
+	out := *resp
+	out.ID = req.ID
+	out.Stream = nil
+	if err := codec.WriteResponse(&out); err != nil {
+		log.Printf("Error writing response: %v", err)
+		if sub != nil {
+			sub.end(ReasonShutdown, "connection failed")
+		}
+		return
+	}
+	if sub == nil {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sub.run()
+	}()
+}
+
+// unsubscribe answers an UNSUBSCRIBE request for one of the connection's
+// subscriptions.
+func (sc *serverConn) unsubscribe(codec *Codec, req *Request) error {
+	id, ok := req.Body["subscription"].(float64)
+	sc.mu.Lock()
+	sub := sc.subs[uint32(id)]
+	sc.mu.Unlock()
+	if !ok || sub == nil {
+		return sendResponse(codec, req.ID, 404, "No Such Subscription")
+	}
+	sub.end(ReasonUnsubscribed, "unsubscribed by client")
+	return sendResponse(codec, req.ID, 200, "OK")
+}
+
+func (sc *serverConn) forgetSubscription(sub *subscription) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.subs[sub.id] == sub {
+		delete(sc.subs, sub.id)
+	}
+}
+
+// endSubscriptions ends every subscription on the connection.
+func (sc *serverConn) endSubscriptions(reason EndReason, message string) {
+	sc.mu.Lock()
+	subs := make([]*subscription, 0, len(sc.subs))
+	for _, sub := range sc.subs {
+		subs = append(subs, sub)
+	}
+	sc.mu.Unlock()
+	for _, sub := range subs {
+		sub.end(reason, message)
+	}
+}
+
+// Event is a pushed event received by a Subscription.
+type Event struct {
+	Path string
+	Body map[string]interface{}
+}
+
+// Subscription is the client's side of a subscription. Events arrive on
+// Events, which is closed when the subscription ends; Err then says why.
+type Subscription struct {
+	ID     uint32
+	Path   string
+	Events <-chan *Event
+
+	conn   *ClientConn
+	events chan *Event
+	once   sync.Once
+	err    error
+}
+
+// Subscribe subscribes to events published on path. Events must be read
+// promptly: if subscriberBuffer of them are waiting, the subscription ends
+// with ReasonSlowConsumer and the connection is closed, as the server does.
+func (c *ClientConn) Subscribe(ctx context.Context, path string) (*Subscription, error) {
+	sub := &Subscription{Path: path, conn: c, events: make(chan *Event, subscriberBuffer)}
+	sub.Events = sub.events
+	resp, body, err := c.doStream(ctx, &Request{Method: MethodSubscribe, Path: path}, 0, sub)
+	if body != nil {
+		body.Close()
+	}
+	if err == nil && resp.Status != 200 {
+		err = fmt.Errorf("subscribe %s: %d %s", path, resp.Status, resp.Message)
+	}
+	if err != nil {
+		c.forgetSubscription(sub)
+		return nil, err
+	}
+	return sub, nil
+}
+
+// Unsubscribe ends the subscription. Events already received may still be
+// read from Events until it is closed.
+func (s *Subscription) Unsubscribe(ctx context.Context) error {
+	resp, _, err := s.conn.doStream(ctx, &Request{
+		Method: MethodUnsubscribe,
+		Path:   s.Path,
+		Body:   map[string]interface{}{"subscription": float64(s.ID)},
+	}, 0, nil)
+	if err != nil {
+		return err
+	}
+	if resp.Status != 200 && resp.Status != 404 {
+		return fmt.Errorf("unsubscribe %s: %d %s", s.Path, resp.Status, resp.Message)
+	}
+	return nil
+}
+
+// Err returns why the subscription ended, or nil while it is active.
+// After an UNSUBSCRIBE it is a *SubscriptionError with ReasonUnsubscribed.
+func (s *Subscription) Err() error {
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
+	return s.err
+}
+
+// finish ends the subscription with err; c.mu must be held.
+func (s *Subscription) finish(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.events)
+	})
+}
+
+func (c *ClientConn) forgetSubscription(sub *Subscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subs[sub.ID] == sub {
+		delete(c.subs, sub.ID)
+	}
+}
+
+// dispatchEvent hands an event or end frame to its subscription. It never
+// blocks the read loop: a subscription whose buffer is full is ended and the
+// connection closed.
+func (c *ClientConn) dispatchEvent(f frame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sub := c.subs[f.id]
+	if sub == nil {
+		return
+	}
+	if f.kind == frameSubscriptionEnd {
+		delete(c.subs, f.id)
+		end := &SubscriptionError{}
+		if len(f.payload) > 0 {
+			end.Reason, end.Message = EndReason(f.payload[0]), string(f.payload[1:])
+		}
+		sub.finish(end)
+		return
+	}
+
+	ev, err := c.codec.enc.DecodeRequest(f.payload)
+	if err != nil {
+		log.Printf("Dropping malformed event for subscription %d: %v", f.id, err)
+		return
+	}
+	select {
+	case sub.events <- &Event{Path: ev.Path, Body: ev.Body}:
+	default:
+		delete(c.subs, f.id)
+		end := &SubscriptionError{Reason: ReasonSlowConsumer, Message: "client buffer full"}
+		sub.finish(end)
+		// Disconnect, as the server does with a slow consumer; the read
+		// loop sees the close and fails everything else on the connection
+		if c.err == nil {
+			c.err = fmt.Errorf("%w: %v", ErrConnClosed, end)
+		}
+		c.conn.Close()
+	}
+}
@@ -0,0 +1,255 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startEventServer serves the default routes with event support.
+func startEventServer(t *testing.T) (*Server, *Broker, string) {
+	t.Helper()
+	broker := NewBroker()
+	router := newRouter()
+	addEventRoutes(router, broker)
+	srv := &Server{Handler: router.ServeRequest, Broker: broker}
+	addr, _ := startServer(t, srv)
+	return srv, broker, addr
+}
+
+// nextEvent waits briefly for an event or the end of the subscription.
+func nextEvent(t *testing.T, sub *Subscription) (*Event, bool) {
+	t.Helper()
+	select {
+	case ev, ok := <-sub.Events:
+		return ev, ok
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for an event")
+		return nil, false
+	}
+}
+
+func TestSubscribeReceivesEventsUntilUnsubscribe(t *testing.T) {
+	_, _, addr := startEventServer(t)
+	subscriber := dialServer(t, addr)
+	publisher := dialServer(t, addr)
+	ctx := context.Background()
+
+	sub, err := subscriber.Subscribe(ctx, "/events/news")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		resp, err := publisher.Do(&Request{Method: "POST", Path: "/events/news", Body: map[string]interface{}{"n": float64(i)}})
+		if err != nil || resp.Body["delivered"] != float64(1) {
+			t.Fatalf("Expected the event to reach one subscriber, got %+v, %v", resp, err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		ev, ok := nextEvent(t, sub)
+		if !ok {
+			t.Fatalf("Subscription ended early: %v", sub.Err())
+		}
+		if ev.Path != "/events/news" || ev.Body["n"] != float64(i) {
+			t.Errorf("Expected event %d on /events/news, got %+v", i, ev)
+		}
+	}
+
+	// Other paths and other connections' requests are unaffected
+	if resp, err := subscriber.Do(&Request{Method: "GET", Path: "/items/1"}); err != nil || resp.Status != 200 {
+		t.Errorf("Expected requests to keep working alongside events, got %+v, %v", resp, err)
+	}
+
+	if err := sub.Unsubscribe(ctx); err != nil {
+		t.Fatalf("Unsubscribe failed: %v", err)
+	}
+	if _, ok := nextEvent(t, sub); ok {
+		t.Fatal("Expected Events to be closed after unsubscribing")
+	}
+	var se *SubscriptionError
+	if !errors.As(sub.Err(), &se) || se.Reason != ReasonUnsubscribed {
+		t.Errorf("Expected ReasonUnsubscribed, got %v", sub.Err())
+	}
+	resp, err := publisher.Do(&Request{Method: "POST", Path: "/events/news"})
+	if err != nil || resp.Body["delivered"] != float64(0) {
+		t.Errorf("Expected no subscribers left, got %+v, %v", resp, err)
+	}
+}
+
+func TestSubscribeRejected(t *testing.T) {
+	_, _, addr := startEventServer(t)
+	plainAddr, _ := startServer(t, &Server{Handler: newRouter().ServeRequest})
+
+	tests := []struct {
+		name string
+		addr string
+		path string
+	}{
+		{"no route", addr, "/items/1"},
+		{"no broker", plainAddr, "/events/news"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dialServer(t, tt.addr)
+			if _, err := c.Subscribe(context.Background(), tt.path); err == nil {
+				t.Error("Expected Subscribe to fail")
+			}
+			c.mu.Lock()
+			n := len(c.subs)
+			c.mu.Unlock()
+			if n != 0 {
+				t.Errorf("Expected the failed subscription to be forgotten, %d left", n)
+			}
+		})
+	}
+}
+
+func TestSlowSubscriberIsDisconnected(t *testing.T) {
+	broker := NewBroker()
+	router := newRouter()
+	addEventRoutes(router, broker)
+	a, b := net.Pipe()
+	defer a.Close()
+	sc := &serverConn{srv: &Server{Handler: router.ServeRequest, Broker: broker}, conn: b}
+	go sc.serve()
+
+	client, err := ClientHandshake(a, maxRequestSize)
+	if err != nil {
+		t.Fatalf("ClientHandshake failed: %v", err)
+	}
+	client.WriteRequest(&Request{ID: 1, Method: MethodSubscribe, Path: "/events/firehose"})
+	if resp, err := client.ReadResponse(); err != nil || resp.Status != 200 {
+		t.Fatalf("Expected the subscription to be accepted, got %+v, %v", resp, err)
+	}
+
+	// Nothing reads the pipe, so the first event blocks and the rest queue up
+	delivered := 0
+	for i := 0; i < subscriberBuffer+2; i++ {
+		delivered += broker.Publish("/events/firehose", nil)
+	}
+	if delivered > subscriberBuffer+1 {
+		t.Fatalf("Expected the subscriber to be cut off, but %d events were queued", delivered)
+	}
+	if n := broker.Publish("/events/firehose", nil); n != 0 {
+		t.Errorf("Expected the slow subscriber to be removed, got %d deliveries", n)
+	}
+
+	for {
+		f, err := client.readFrame()
+		if err != nil {
+			t.Fatalf("readFrame failed: %v", err)
+		}
+		if f.kind == frameSubscriptionEnd {
+			if EndReason(f.payload[0]) != ReasonSlowConsumer {
+				t.Errorf("Expected ReasonSlowConsumer, got %v", EndReason(f.payload[0]))
+			}
+			break
+		}
+		if f.kind != frameEvent || f.id != 1 {
+			t.Fatalf("Expected only events for subscription 1, got kind %d id %d", f.kind, f.id)
+		}
+	}
+	if _, err := client.readFrame(); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected the connection to be closed after the end frame, got %v", err)
+	}
+}
+
+func TestStuckSubscriberIsDisconnected(t *testing.T) {
+	broker := NewBroker()
+	router := newRouter()
+	addEventRoutes(router, broker)
+	a, b := net.Pipe()
+	defer a.Close()
+	srv := &Server{Handler: router.ServeRequest, Broker: broker, WriteTimeout: 50 * time.Millisecond}
+	sc := &serverConn{srv: srv, conn: b}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		sc.serve()
+	}()
+
+	client, err := ClientHandshake(a, maxRequestSize)
+	if err != nil {
+		t.Fatalf("ClientHandshake failed: %v", err)
+	}
+	client.WriteRequest(&Request{ID: 1, Method: MethodSubscribe, Path: "/events/firehose"})
+	if resp, err := client.ReadResponse(); err != nil || resp.Status != 200 {
+		t.Fatalf("Expected the subscription to be accepted, got %+v, %v", resp, err)
+	}
+
+	// Well within the buffer, but nothing reads the pipe, so the write times out
+	broker.Publish("/events/firehose", nil)
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the connection to be closed once the event write timed out")
+	}
+	if n := broker.Publish("/events/firehose", nil); n != 0 {
+		t.Errorf("Expected the stuck subscriber to be removed, got %d deliveries", n)
+	}
+}
+
+func TestClientDisconnectsWhenItFallsBehind(t *testing.T) {
+	_, broker, addr := startEventServer(t)
+	subscriber := dialServer(t, addr)
+	sub, err := subscriber.Subscribe(context.Background(), "/events/news")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	// Fill the client's buffer, then overflow it by one
+	for i := 0; i < subscriberBuffer; i++ {
+		broker.Publish("/events/news", nil)
+	}
+	for deadline := time.Now().Add(time.Second); len(sub.Events) < subscriberBuffer; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d buffered events, got %d", subscriberBuffer, len(sub.Events))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	broker.Publish("/events/news", nil)
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		broker.mu.RLock()
+		n := len(broker.subs["/events/news"])
+		broker.mu.RUnlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the server to drop the subscription once the client disconnected")
+		}
+	}
+	var se *SubscriptionError
+	if !errors.As(sub.Err(), &se) || se.Reason != ReasonSlowConsumer {
+		t.Errorf("Expected ReasonSlowConsumer, got %v", sub.Err())
+	}
+	if err := subscriber.Err(); !errors.Is(err, ErrConnClosed) {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestShutdownEndsSubscriptions(t *testing.T) {
+	srv, _, addr := startEventServer(t)
+	c := dialServer(t, addr)
+	sub, err := c.Subscribe(context.Background(), "/events/news")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if _, ok := nextEvent(t, sub); ok {
+		t.Fatal("Expected Events to be closed by the shutdown")
+	}
+	var se *SubscriptionError
+	if !errors.As(sub.Err(), &se) || se.Reason != ReasonShutdown {
+		t.Errorf("Expected ReasonShutdown, got %v", sub.Err())
+	}
+}
@@ -0,0 +1,185 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often certificate files are checked for changes.
+// Checks happen on handshakes, so an idle server does no work.
+const certCheckInterval = 5 * time.Second
+
+// TLSFiles names the PEM files for one side of a TLS connection. Any of them
+// may be empty: a server needs a certificate and key, and a client only
+// needs them for mutual TLS. CAFile is the bundle that peer certificates are
+// verified against; for a server, setting it requires client certificates.
+type TLSFiles struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+// CertReloader holds the certificate and CA pool loaded from TLSFiles and
+// reloads them when the files change, so certificates can be rotated without
+// a restart. A failed reload is logged and the previous files stay in use.
+type CertReloader struct {
+	files      TLSFiles
+	checkEvery time.Duration
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	pool      *x509.CertPool
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+}
+
+// NewCertReloader loads files, checking that a certificate comes with its key.
+func NewCertReloader(files TLSFiles) (*CertReloader, error) {
+	if (files.CertFile == "") != (files.KeyFile == "") {
+		return nil, errors.New("certificate and key files must be given together")
+	}
+	r := &CertReloader{files: files, checkEvery: certCheckInterval}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// current returns the certificate and CA pool, reloading them first if the
+// files changed since the last check.
+func (r *CertReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.lastCheck) >= r.checkEvery {
+		r.lastCheck = time.Now()
+		if r.changed() {
+			if err := r.loadLocked(); err != nil {
+				log.Printf("Error reloading TLS files, keeping previous: %v", err)
+			} else {
+				log.Println("Reloaded TLS certificates")
+			}
+		}
+	}
+	return r.cert, r.pool
+}
+
+func (r *CertReloader) load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.loadLocked()
+}
+
+func (r *CertReloader) loadLocked() error {
+	modTimes, err := r.stat()
+	if err != nil {
+		return err
+	}
+	var cert *tls.Certificate
+	if r.files.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+	var pool *x509.CertPool
+	if r.files.CAFile != "" {
+		pem, err := os.ReadFile(r.files.CAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.files.CAFile)
+		}
+	}
+	r.cert, r.pool, r.modTimes = cert, pool, modTimes
+	return nil
+}
+
+func (r *CertReloader) stat() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, path := range []string{r.files.CertFile, r.files.KeyFile, r.files.CAFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[path] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+func (r *CertReloader) changed() bool {
+	modTimes, err := r.stat()
+	if err != nil {
+		log.Printf("Error checking TLS files: %v", err)
+		return false
+	}
+	for path, t := range modTimes {
+		if !t.Equal(r.modTimes[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServerConfig returns a TLS config that picks up reloaded files on every
+// new connection. With a CA file, clients must present a certificate it
+// signed.
+func (r *CertReloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.current()
+			if cert == nil {
+				return nil, errors.New("no server certificate configured")
+			}
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+			}
+			if pool != nil {
+				cfg.ClientCAs = pool
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// ClientConfig returns a TLS config for dialing serverName. The client
+// certificate, if any, is reloaded as it changes; the CA pool is the one
+// loaded when ClientConfig was called, and nil means the system roots.
+func (r *CertReloader) ClientConfig(serverName string) *tls.Config {
+	_, pool := r.current()
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		RootCAs:    pool,
+	}
+	if r.files.CertFile != "" {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		}
+	}
+	return cfg
+}
+
+// PeerIdentity returns the common name of the verified client certificate,
+// or "" if the request did not come over mutual TLS.
+func PeerIdentity(req *Request) string {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return req.TLS.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,213 @@
+package protocol
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a throwaway certificate authority for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir()}
+	writePEM(t, ca.path("ca.pem"), "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) path(name string) string {
+	return filepath.Join(ca.dir, name)
+}
+
+// issue writes a certificate for commonName, signed by the CA, to
+// <name>.pem and <name>-key.pem, and returns their paths.
+func (ca *testCA) issue(t *testing.T, name, commonName string, usage x509.ExtKeyUsage) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey failed: %v", err)
+	}
+	certFile, keyFile = ca.path(name+".pem"), ca.path(name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+}
+
+// serveTLS serves the default router over TLS on a loopback port.
+func serveTLS(t *testing.T, config *tls.Config) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	handler := newRouter().ServeRequest
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleConn(conn, handler)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestMutualTLSExposesPeerIdentity(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "server", "server", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, "client", "alice", x509.ExtKeyUsageClientAuth)
+
+	server, err := NewCertReloader(TLSFiles{CertFile: serverCert, KeyFile: serverKey, CAFile: ca.path("ca.pem")})
+	if err != nil {
+		t.Fatalf("NewCertReloader failed: %v", err)
+	}
+	addr := serveTLS(t, server.ServerConfig())
+
+	client, err := NewCertReloader(TLSFiles{CertFile: clientCert, KeyFile: clientKey, CAFile: ca.path("ca.pem")})
+	if err != nil {
+		t.Fatalf("NewCertReloader failed: %v", err)
+	}
+	c, err := DialTLS(addr, client.ClientConfig("localhost"))
+	if err != nil {
+		t.Fatalf("DialTLS failed: %v", err)
+	}
+	defer c.Close()
+
+	resp, err := c.Do(&Request{Method: "GET", Path: "/whoami"})
+	if err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+	if resp.Body["identity"] != "alice" {
+		t.Errorf("Expected identity alice, got %v", resp.Body["identity"])
+	}
+}
+
+func TestMutualTLSRejectsClientWithoutCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "server", "server", x509.ExtKeyUsageServerAuth)
+	server, err := NewCertReloader(TLSFiles{CertFile: serverCert, KeyFile: serverKey, CAFile: ca.path("ca.pem")})
+	if err != nil {
+		t.Fatalf("NewCertReloader failed: %v", err)
+	}
+	addr := serveTLS(t, server.ServerConfig())
+
+	client, err := NewCertReloader(TLSFiles{CAFile: ca.path("ca.pem")})
+	if err != nil {
+		t.Fatalf("NewCertReloader failed: %v", err)
+	}
+	// With TLS 1.3 the server's rejection surfaces on the first read, so
+	// the failure may come from the handshake or from the first request.
+	c, err := DialTLS(addr, client.ClientConfig("localhost"))
+	if err == nil {
+		defer c.Close()
+		_, err = c.Do(&Request{Method: "GET", Path: "/whoami"})
+	}
+	if err == nil {
+		t.Fatal("Expected a client without a certificate to be rejected")
+	}
+}
+
+func TestCertReloaderPicksUpRotatedCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "server", "first", x509.ExtKeyUsageServerAuth)
+	server, err := NewCertReloader(TLSFiles{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("NewCertReloader failed: %v", err)
+	}
+	server.checkEvery = 0
+	addr := serveTLS(t, server.ServerConfig())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	serverName := func() string {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	if got := serverName(); got != "first" {
+		t.Fatalf("Expected the first certificate, got %q", got)
+	}
+
+	// Rotate in place, making sure the modification time moves on
+	ca.issue(t, "server", "second", x509.ExtKeyUsageServerAuth)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	if got := serverName(); got != "second" {
+		t.Errorf("Expected the rotated certificate, got %q", got)
+	}
+
+	// A broken rotation keeps serving the last good certificate
+	os.WriteFile(certFile, []byte("garbage"), 0o600)
+	later = later.Add(time.Second)
+	os.Chtimes(certFile, later, later)
+	if got := serverName(); got != "second" {
+		t.Errorf("Expected the last good certificate after a bad reload, got %q", got)
+	}
+}
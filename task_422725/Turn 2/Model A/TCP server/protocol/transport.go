@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Transport carries the protocol's byte stream between client and server.
+// The same handlers serve every transport.
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+}
+
+var (
+	// TCPTransport is plain TCP, used for addresses without a prefix.
+	TCPTransport Transport = netTransport("tcp")
+	// UnixTransport uses Unix domain sockets, for clients on the same host.
+	// A socket file left behind by a server that died is replaced.
+	UnixTransport Transport = unixTransport{}
+	// UDPTransport runs the protocol over UDP datagrams; see udp.go.
+	UDPTransport Transport = udpTransport{}
+)
+
+var (
+	transportsMu sync.RWMutex
+	transports   = map[string]Transport{}
+)
+
+func init() {
+	RegisterTransport("tcp", TCPTransport)
+	RegisterTransport("unix", UnixTransport)
+	RegisterTransport("udp", UDPTransport)
+}
+
+// RegisterTransport makes t available for addresses written "scheme:addr".
+// It panics if the scheme is taken.
+func RegisterTransport(scheme string, t Transport) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	if _, ok := transports[scheme]; ok {
+		panic(fmt.Sprintf("transport %q already registered", scheme))
+	}
+	transports[scheme] = t
+}
+
+// lookupTransport splits an address such as "unix:/run/app.sock" or
+// "udp:host:port" into its transport and the address for it. An address
+// without a registered prefix, such as "host:port", is TCP.
+func lookupTransport(addr string) (Transport, string) {
+	if scheme, rest, ok := strings.Cut(addr, ":"); ok {
+		transportsMu.RLock()
+		t, ok := transports[scheme]
+		transportsMu.RUnlock()
+		if ok {
+			return t, rest
+		}
+	}
+	return TCPTransport, addr
+}
+
+// listen listens on addr with its transport.
+func listen(addr string) (net.Listener, error) {
+	t, taddr := lookupTransport(addr)
+	return t.Listen(taddr)
+}
+
+// dialAddr connects to addr with its transport, then over TLS if config is
+// set.
+func dialAddr(ctx context.Context, addr string, config *tls.Config) (net.Conn, error) {
+	t, taddr := lookupTransport(addr)
+	conn, err := t.Dial(ctx, taddr)
+	if err != nil || config == nil {
+		return conn, err
+	}
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(taddr); err == nil {
+			config = config.Clone()
+			config.ServerName = host
+		}
+	}
+	tc := tls.Client(conn, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// netTransport is a stream network the net package supports directly.
+type netTransport string
+
+func (n netTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen(string(n), addr)
+}
+
+func (n netTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, string(n), addr)
+}
+
+type unixTransport struct{}
+
+func (unixTransport) Listen(path string) (net.Listener, error) {
+	ln, err := net.Listen("unix", path)
+	if errors.Is(err, syscall.EADDRINUSE) && staleSocket(path) {
+		os.Remove(path)
+		ln, err = net.Listen("unix", path)
+	}
+	return ln, err
+}
+
+func (unixTransport) Dial(ctx context.Context, path string) (net.Conn, error) {
+	return netTransport("unix").Dial(ctx, path)
+}
+
+// staleSocket reports whether path is a socket nobody is listening on.
+func staleSocket(path string) bool {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return errors.Is(err, syscall.ECONNREFUSED)
+	}
+	conn.Close()
+	return false
+}
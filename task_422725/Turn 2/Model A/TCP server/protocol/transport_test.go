@@ -0,0 +1,132 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startServerOn runs srv on addr, which names its transport, and returns
+// the address to dial.
+func startServerOn(t *testing.T, srv *Server, addr string) string {
+	t.Helper()
+	ln, err := listen(addr)
+	if err != nil {
+		t.Fatalf("listen %s failed: %v", addr, err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	if scheme, _, _ := strings.Cut(addr, ":"); scheme == "unix" || scheme == "udp" {
+		return scheme + ":" + ln.Addr().String()
+	}
+	return ln.Addr().String()
+}
+
+// socketPath returns a Unix socket path short enough for the OS limit.
+func socketPath(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "tp")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "s.sock")
+}
+
+func TestLookupTransport(t *testing.T) {
+	tests := []struct {
+		addr string
+		want Transport
+		rest string
+	}{
+		{"localhost:8080", TCPTransport, "localhost:8080"},
+		{":8080", TCPTransport, ":8080"},
+		{"[::1]:8080", TCPTransport, "[::1]:8080"},
+		{"tcp:localhost:8080", TCPTransport, "localhost:8080"},
+		{"unix:/run/app.sock", UnixTransport, "/run/app.sock"},
+		{"udp:localhost:8080", UDPTransport, "localhost:8080"},
+	}
+	for _, tt := range tests {
+		got, rest := lookupTransport(tt.addr)
+		if got != tt.want || rest != tt.rest {
+			t.Errorf("%s: expected %T %q, got %T %q", tt.addr, tt.want, tt.rest, got, rest)
+		}
+	}
+}
+
+func TestTransports(t *testing.T) {
+	tests := []struct {
+		name string
+		addr string
+	}{
+		{"tcp", "127.0.0.1:0"},
+		{"unix", "unix:" + socketPath(t)},
+		{"udp", "udp:127.0.0.1:0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startServerOn(t, &Server{Handler: newRouter().ServeRequest}, tt.addr)
+			client := newTestClient(t, ClientOptions{Addr: addr})
+			ctx := context.Background()
+
+			resp, err := client.Do(ctx, &Request{Method: "POST", Path: "/items", Body: map[string]interface{}{"name": "widget"}})
+			if err != nil {
+				t.Fatalf("Do failed: %v", err)
+			}
+			if resp.Status != 201 || resp.Body["name"] != "widget" {
+				t.Errorf("Expected 201 echoing the body, got %+v", resp)
+			}
+
+			// Far more than a datagram or a stream window each way
+			const size = 1 << 20
+			want := sha256.New()
+			io.CopyN(want, &patternReader{}, size)
+			c := dialServer(t, addr)
+			resp, err = c.Do(&Request{Method: "POST", Path: "/upload", Stream: io.LimitReader(&patternReader{}, size)})
+			if err != nil {
+				t.Fatalf("Upload failed: %v", err)
+			}
+			if resp.Body["sha256"] != hex.EncodeToString(want.Sum(nil)) {
+				t.Errorf("Upload hash mismatch: %v", resp.Body)
+			}
+
+			resp, body, err := c.DoStream(&Request{Method: "GET", Path: "/download/1048576"})
+			if err != nil {
+				t.Fatalf("Download failed: %v", err)
+			}
+			got := sha256.New()
+			n, err := io.Copy(got, body)
+			if err != nil || n != size || !bytes.Equal(got.Sum(nil), want.Sum(nil)) {
+				t.Errorf("Expected %d matching bytes, got %d, %v", size, n, err)
+			}
+		})
+	}
+}
+
+func TestUnixTransportReplacesStaleSocket(t *testing.T) {
+	path := socketPath(t)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	// As if the server died without cleaning up
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	ln, err = UnixTransport.Listen(path)
+	if err != nil {
+		t.Fatalf("Expected the stale socket to be replaced, got %v", err)
+	}
+	defer ln.Close()
+
+	if _, err := UnixTransport.Listen(path); err == nil {
+		t.Error("Expected a socket in use not to be replaced")
+	}
+}
@@ -0,0 +1,679 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// The UDP transport carries the protocol's byte stream over datagrams, so
+// frames, streams and request IDs work exactly as over TCP. Each connection
+// splits what is written into numbered segments small enough to avoid IP
+// fragmentation; the receiver reassembles them in order, drops segments it
+// has already seen, and acknowledges cumulatively. The sender resends the
+// oldest unacknowledged segment with exponential backoff and gives up with
+// ErrPeerUnreachable after udpMaxRetries.
+//
+// Every packet starts with
+//
+//	type     1 byte
+//	conn ID  4 bytes, chosen by the client
+//	seq      4 bytes: the segment number, or for an ack the next expected
+//
+// A client opens with syn, answered by synack. Data and fin segments are
+// numbered from 0 in each direction, and fin ends the sender's stream. A
+// packet for a connection the receiver does not know is answered with rst.
+const (
+	udpHeaderSize    = 9
+	maxDatagram      = 1200
+	maxSegmentSize   = maxDatagram - udpHeaderSize
+	udpSendWindow    = 64 // unacknowledged segments
+	udpRecvWindow    = 2 * udpSendWindow
+	udpInitialRTO    = 100 * time.Millisecond
+	udpMaxRTO        = time.Second
+	udpMaxRetries    = 8
+	udpTick          = 20 * time.Millisecond
+	udpLinger        = 2 * time.Second // for the fin to be acknowledged
+	udpAcceptBacklog = 128
+	// maxUDPBuffered bounds received bytes not yet read. The protocol's
+	// stream windows and in-flight cap keep a well-behaved peer far below.
+	maxUDPBuffered = 16 << 20
+)
+
+const (
+	pktSyn byte = iota + 1
+	pktSynAck
+	pktData
+	pktAck
+	pktFin
+	pktRst
+)
+
+var (
+	// ErrPeerUnreachable is returned once a UDP peer stops acknowledging.
+	ErrPeerUnreachable = errors.New("udp: peer stopped acknowledging")
+	// ErrConnReset is returned once a UDP peer says it does not know the
+	// connection, such as after it restarted.
+	ErrConnReset = errors.New("udp: connection reset by peer")
+)
+
+func udpPacket(kind byte, id, seq uint32, payload []byte) []byte {
+	b := make([]byte, udpHeaderSize, udpHeaderSize+len(payload))
+	b[0] = kind
+	binary.BigEndian.PutUint32(b[1:], id)
+	binary.BigEndian.PutUint32(b[5:], seq)
+	return append(b, payload...)
+}
+
+func parseUDPPacket(b []byte) (kind byte, id, seq uint32, payload []byte, ok bool) {
+	if len(b) < udpHeaderSize || b[0] < pktSyn || b[0] > pktRst {
+		return 0, 0, 0, nil, false
+	}
+	return b[0], binary.BigEndian.Uint32(b[1:]), binary.BigEndian.Uint32(b[5:]), b[udpHeaderSize:], true
+}
+
+// rto is how long to wait for an ack after sending a segment tries times.
+func rto(tries int) time.Duration {
+	return min(udpInitialRTO<<tries, udpMaxRTO)
+}
+
+type udpTransport struct{}
+
+func (udpTransport) Listen(addr string) (net.Listener, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	l := &udpListener{
+		pc:     pc,
+		accept: make(chan *udpConn, udpAcceptBacklog),
+		conns:  make(map[udpKey]*udpConn),
+		done:   make(chan struct{}),
+	}
+	go l.readLoop()
+	return l, nil
+}
+
+func (udpTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	send := func(b []byte) error {
+		_, err := pc.Write(b)
+		return err
+	}
+	c := newUDPConn(rand.Uint32(), pc.LocalAddr(), raddr, send, func() { pc.Close() })
+	established := make(chan struct{})
+	c.established = established
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, err := pc.Read(buf)
+			if err != nil {
+				// A refused syn shows up here; once connected, lost
+				// packets are the retransmission's business
+				if errors.Is(err, net.ErrClosed) || !c.isEstablished() {
+					c.fail(err)
+					return
+				}
+				continue
+			}
+			kind, id, seq, payload, ok := parseUDPPacket(buf[:n])
+			if ok && id == c.id {
+				c.handle(kind, seq, payload)
+			}
+		}
+	}()
+
+	syn := udpPacket(pktSyn, c.id, 0, nil)
+	for tries := 0; ; tries++ {
+		if tries > udpMaxRetries {
+			c.fail(ErrPeerUnreachable)
+		}
+		c.send(syn)
+		timer := time.NewTimer(rto(tries))
+		select {
+		case <-established:
+			timer.Stop()
+			return c, nil
+		case <-c.done:
+			timer.Stop()
+			return nil, c.err
+		case <-ctx.Done():
+			timer.Stop()
+			c.fail(ctx.Err())
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+type udpKey struct {
+	addr string
+	id   uint32
+}
+
+// udpListener accepts UDP connections, all sharing its socket. The socket
+// stays open after Close until the last connection is done with it.
+type udpListener struct {
+	pc     *net.UDPConn
+	accept chan *udpConn
+
+	mu     sync.Mutex
+	conns  map[udpKey]*udpConn
+	closed bool
+	done   chan struct{} // closed by Close
+}
+
+func (l *udpListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "udp", Addr: l.pc.LocalAddr(), Err: net.ErrClosed}
+	}
+}
+
+func (l *udpListener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	idle := len(l.conns) == 0
+	l.mu.Unlock()
+
+	// Connections never accepted are closed like a TCP backlog
+	for {
+		select {
+		case c := <-l.accept:
+			c.Close()
+			continue
+		default:
+		}
+		break
+	}
+	if idle {
+		return l.pc.Close()
+	}
+	return nil
+}
+
+func (l *udpListener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+func (l *udpListener) forget(key udpKey) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.conns, key)
+	if l.closed && len(l.conns) == 0 {
+		l.pc.Close()
+	}
+}
+
+func (l *udpListener) readLoop() {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := l.pc.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		kind, id, seq, payload, ok := parseUDPPacket(buf[:n])
+		if !ok {
+			continue
+		}
+		key := udpKey{addr.String(), id}
+		send := func(b []byte) error {
+			_, err := l.pc.WriteToUDP(b, addr)
+			return err
+		}
+
+		l.mu.Lock()
+		c := l.conns[key]
+		// A full backlog drops the syn; the client will send it again
+		if c == nil && kind == pktSyn && !l.closed && len(l.accept) < cap(l.accept) {
+			c = newUDPConn(id, l.pc.LocalAddr(), addr, send, func() { l.forget(key) })
+			l.conns[key] = c
+			l.accept <- c
+		}
+		l.mu.Unlock()
+
+		switch {
+		case c == nil:
+			if kind != pktSyn && kind != pktRst {
+				send(udpPacket(pktRst, id, 0, nil))
+			}
+		case kind == pktSyn:
+			// Also answers a repeated syn whose synack was lost
+			send(udpPacket(pktSynAck, id, 0, nil))
+		default:
+			c.handle(kind, seq, payload)
+		}
+	}
+}
+
+// segment is a data or fin segment awaiting its ack, or received out of
+// order.
+type segment struct {
+	kind    byte
+	seq     uint32
+	payload []byte
+	sent    time.Time
+	tries   int
+}
+
+// udpConn is one UDP connection, reliable and ordered.
+type udpConn struct {
+	id            uint32
+	local, remote net.Addr
+	send          func([]byte) error
+	onClose       func() // releases the socket, once the connection is done
+
+	// established, for a dialing client, is closed by the synack.
+	established chan struct{}
+
+	writeMu sync.Mutex // keeps each Write's segments together
+
+	mu       sync.Mutex
+	nextSeq  uint32 // next segment to send
+	sendBase uint32 // oldest unacknowledged segment
+	unacked  map[uint32]*segment
+	recvNext uint32 // next segment to deliver
+	early    map[uint32]*segment
+	inbuf    []byte
+	eof      bool // the peer's fin was delivered
+	closing  bool // Close was called
+	linger   time.Time
+	err      error
+
+	readable chan struct{}
+	writable chan struct{}
+	closed   chan struct{} // closed by Close
+	done     chan struct{} // closed once nothing more is sent or received
+	doneOnce sync.Once
+
+	readDeadline, writeDeadline connDeadline
+}
+
+func newUDPConn(id uint32, local, remote net.Addr, send func([]byte) error, onClose func()) *udpConn {
+	c := &udpConn{
+		id:            id,
+		local:         local,
+		remote:        remote,
+		send:          send,
+		onClose:       onClose,
+		unacked:       make(map[uint32]*segment),
+		early:         make(map[uint32]*segment),
+		readable:      make(chan struct{}, 1),
+		writable:      make(chan struct{}, 1),
+		closed:        make(chan struct{}),
+		done:          make(chan struct{}),
+		readDeadline:  makeConnDeadline(),
+		writeDeadline: makeConnDeadline(),
+	}
+	go c.retransmitLoop()
+	return c
+}
+
+func (c *udpConn) isEstablished() bool {
+	select {
+	case <-c.established:
+		return true
+	default:
+		return c.established == nil
+	}
+}
+
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// handle processes a packet from the peer.
+func (c *udpConn) handle(kind byte, seq uint32, payload []byte) {
+	switch kind {
+	case pktSynAck:
+		c.mu.Lock()
+		if !c.isEstablished() {
+			close(c.established)
+		}
+		c.mu.Unlock()
+	case pktData, pktFin:
+		c.send(udpPacket(pktAck, c.id, c.receive(kind, seq, payload), nil))
+	case pktAck:
+		c.acked(seq)
+	case pktRst:
+		c.fail(ErrConnReset)
+	}
+}
+
+// receive stores a segment, delivers what is now in order, and returns the
+// next segment wanted. Segments already delivered or buffered, or too far
+// ahead, are dropped.
+func (c *udpConn) receive(kind byte, seq uint32, payload []byte) uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seq-c.recvNext >= udpRecvWindow || c.early[seq] != nil {
+		return c.recvNext
+	}
+	c.early[seq] = &segment{kind: kind, seq: seq, payload: append([]byte(nil), payload...)}
+	for s := c.early[c.recvNext]; s != nil; s = c.early[c.recvNext] {
+		delete(c.early, c.recvNext)
+		c.recvNext++
+		switch {
+		case c.eof:
+		case s.kind == pktFin:
+			c.eof = true
+		case !c.closing:
+			// After Close, data is acknowledged but thrown away
+			c.inbuf = append(c.inbuf, s.payload...)
+		}
+	}
+	if len(c.inbuf) > maxUDPBuffered {
+		c.setErr(errors.New("udp: peer sent too much unread data"))
+		go c.teardown()
+	}
+	wake(c.readable)
+	return c.recvNext
+}
+
+// acked handles the peer having everything before next.
+func (c *udpConn) acked(next uint32) {
+	c.mu.Lock()
+	if next-c.sendBase > c.nextSeq-c.sendBase {
+		// Acknowledges something never sent
+		c.mu.Unlock()
+		return
+	}
+	for ; c.sendBase != next; c.sendBase++ {
+		delete(c.unacked, c.sendBase)
+	}
+	finished := c.closing && len(c.unacked) == 0
+	c.mu.Unlock()
+	wake(c.writable)
+	if finished {
+		c.teardown()
+	}
+}
+
+func (c *udpConn) retransmitLoop() {
+	ticker := time.NewTicker(udpTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			c.retransmit(now)
+		}
+	}
+}
+
+// retransmit resends the oldest unacknowledged segment if its ack is
+// overdue. Only the oldest is resent: the cumulative ack for it also
+// covers whatever the peer received after it.
+func (c *udpConn) retransmit(now time.Time) {
+	c.mu.Lock()
+	if c.closing && now.After(c.linger) {
+		c.mu.Unlock()
+		c.teardown()
+		return
+	}
+	seg := c.unacked[c.sendBase]
+	if seg == nil || now.Sub(seg.sent) < rto(seg.tries) {
+		c.mu.Unlock()
+		return
+	}
+	if seg.tries >= udpMaxRetries {
+		c.mu.Unlock()
+		c.fail(ErrPeerUnreachable)
+		return
+	}
+	seg.tries++
+	seg.sent = now
+	pkt := udpPacket(seg.kind, c.id, seg.seq, seg.payload)
+	c.mu.Unlock()
+	c.send(pkt)
+}
+
+// queue sends a segment once the window has room for it.
+func (c *udpConn) queue(kind byte, payload []byte) error {
+	for {
+		select {
+		case <-c.writeDeadline.wait():
+			return os.ErrDeadlineExceeded
+		default:
+		}
+		c.mu.Lock()
+		switch {
+		case c.closing:
+			c.mu.Unlock()
+			return net.ErrClosed
+		case c.err != nil:
+			err := c.err
+			c.mu.Unlock()
+			return err
+		case c.nextSeq-c.sendBase < udpSendWindow:
+			pkt := c.enqueue(kind, payload)
+			c.mu.Unlock()
+			c.send(pkt)
+			return nil
+		}
+		c.mu.Unlock()
+		select {
+		case <-c.writable:
+		case <-c.writeDeadline.wait():
+			return os.ErrDeadlineExceeded
+		case <-c.closed:
+		case <-c.done:
+		}
+	}
+}
+
+// enqueue numbers a segment and returns its packet; c.mu must be held.
+func (c *udpConn) enqueue(kind byte, payload []byte) []byte {
+	seg := &segment{kind: kind, seq: c.nextSeq, payload: append([]byte(nil), payload...), sent: time.Now()}
+	c.unacked[seg.seq] = seg
+	c.nextSeq++
+	return udpPacket(kind, c.id, seg.seq, seg.payload)
+}
+
+func (c *udpConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	n := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxSegmentSize)]
+		if err := c.queue(pktData, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func (c *udpConn) Read(p []byte) (int, error) {
+	for {
+		select {
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		default:
+		}
+		c.mu.Lock()
+		switch {
+		case c.closing:
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		case len(c.inbuf) > 0:
+			n := copy(p, c.inbuf)
+			c.inbuf = c.inbuf[n:]
+			if len(c.inbuf) == 0 {
+				c.inbuf = nil
+			}
+			c.mu.Unlock()
+			return n, nil
+		case c.eof:
+			c.mu.Unlock()
+			return 0, io.EOF
+		case c.err != nil:
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		c.mu.Unlock()
+		select {
+		case <-c.readable:
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closed:
+		case <-c.done:
+		}
+	}
+}
+
+// Close sends a fin after whatever is queued and returns at once. The
+// connection lingers until the fin is acknowledged, or for udpLinger.
+func (c *udpConn) Close() error {
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	c.closing = true
+	close(c.closed)
+	c.inbuf = nil
+	if c.err != nil {
+		c.mu.Unlock()
+		c.teardown()
+		return nil
+	}
+	c.linger = time.Now().Add(udpLinger)
+	pkt := c.enqueue(pktFin, nil)
+	c.mu.Unlock()
+	c.send(pkt)
+	return nil
+}
+
+// setErr records why the connection failed, keeping the first reason;
+// c.mu must be held.
+func (c *udpConn) setErr(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+func (c *udpConn) fail(err error) {
+	c.mu.Lock()
+	c.setErr(err)
+	c.mu.Unlock()
+	c.teardown()
+}
+
+func (c *udpConn) teardown() {
+	c.doneOnce.Do(func() {
+		close(c.done)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+}
+
+func (c *udpConn) LocalAddr() net.Addr  { return c.local }
+func (c *udpConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *udpConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *udpConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *udpConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// connDeadline is a deadline as a channel, closed once it passes.
+type connDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeConnDeadline() connDeadline {
+	return connDeadline{cancel: make(chan struct{})}
+}
+
+// set moves the deadline; the zero time means none.
+func (d *connDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer fired, or is firing; wait for it to close cancel
+		<-d.cancel
+	}
+	d.timer = nil
+
+	expired := isClosed(d.cancel)
+	if t.IsZero() {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !expired {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel closed once the deadline passes.
+func (d *connDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,150 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyPair joins two UDP connections over a link that drops, duplicates
+// and reorders packets.
+func lossyPair(t *testing.T, seed uint64) (*udpConn, *udpConn) {
+	t.Helper()
+	var mu sync.Mutex
+	rng := rand.New(rand.NewPCG(seed, seed))
+	var a, b *udpConn
+	link := func(to **udpConn) func([]byte) error {
+		return func(pkt []byte) error {
+			mu.Lock()
+			drop, dup := rng.Float64() < 0.1, rng.Float64() < 0.1
+			delay := time.Duration(rng.IntN(5)) * time.Millisecond
+			mu.Unlock()
+			if drop {
+				return nil
+			}
+			deliver := func() {
+				kind, _, seq, payload, _ := parseUDPPacket(pkt)
+				(*to).handle(kind, seq, payload)
+			}
+			time.AfterFunc(delay, deliver)
+			if dup {
+				time.AfterFunc(2*delay, deliver)
+			}
+			return nil
+		}
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	a = newUDPConn(1, addr, addr, link(&b), nil)
+	b = newUDPConn(1, addr, addr, link(&a), nil)
+	t.Cleanup(func() {
+		a.fail(net.ErrClosed)
+		b.fail(net.ErrClosed)
+	})
+	return a, b
+}
+
+func TestUDPConnOverLossyLink(t *testing.T) {
+	a, b := lossyPair(t, 42)
+	want := make([]byte, 64<<10)
+	io.ReadFull(&patternReader{}, want)
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := a.Write(want)
+		if err == nil {
+			err = a.Close()
+		}
+		written <- err
+	}()
+
+	b.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Expected %d bytes in order, got %d that differ", len(want), len(got))
+	}
+	if err := <-written; err != nil {
+		t.Errorf("Write failed: %v", err)
+	}
+}
+
+func TestUDPConnDeadline(t *testing.T) {
+	a, _ := lossyPair(t, 1)
+	a.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := a.Read(make([]byte, 1))
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+
+	// Clearing the deadline lets reads block again until data comes
+	a.SetReadDeadline(time.Time{})
+	read := make(chan error, 1)
+	go func() {
+		_, err := a.Read(make([]byte, 1))
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		t.Fatalf("Expected Read to block, got %v", err)
+	case <-time.After(30 * time.Millisecond):
+	}
+	a.SetReadDeadline(aLongTimeAgo)
+	if err := <-read; !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("Expected a past deadline to wake Read, got %v", err)
+	}
+}
+
+func TestUDPConnResetByRestartedServer(t *testing.T) {
+	ln, err := UDPTransport.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr := ln.Addr().String()
+	c, err := UDPTransport.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+
+	// The server goes away without a word and comes back knowing nothing
+	sc.(*udpConn).fail(errors.New("crashed"))
+	ln.Close()
+	ln, err = UDPTransport.Listen(addr)
+	if err != nil {
+		t.Fatalf("Listen again failed: %v", err)
+	}
+	defer ln.Close()
+
+	c.Write([]byte("hello"))
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, ErrConnReset) {
+		t.Errorf("Expected ErrConnReset, got %v", err)
+	}
+}
+
+func TestUDPDialUnreachable(t *testing.T) {
+	// Nothing listens there, so the syn is refused
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+
+	if _, err := Dial("udp:" + addr); err == nil {
+		t.Error("Expected Dial to fail")
+	}
+}
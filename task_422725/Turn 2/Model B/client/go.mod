@@ -0,0 +1,7 @@
+module client
+
+go 1.23
+
+require tcpserver v0.0.0
+
+replace tcpserver => "../../Model A/TCP server"
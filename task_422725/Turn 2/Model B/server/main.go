@@ -1,116 +1,85 @@
-package main  
-import (  
-    "bufio"
-    "encoding/json"
-    "fmt"
-    "log"
-    "net"
-    "strconv"
-    "time"
-)
+package main
 
-type Request struct {    
-    Method string `json:"method"`
-    Path   string `json:"path"`
-}
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
 
-type Response struct {
-    Status int    `json:"status"`
-    Body    string `json:"body"`
-}
+	"tcpserver/protocol"
+)
 
 const (
-    maxMessageSize = 1024 * 1024 // 1MB
-    readTimeout    = time.Second * 5
+	maxMessageSize = 1024 * 1024 // 1MB
+	readTimeout    = time.Second * 5
 )
 
 func serveTCP(listenAddr string) {
-    log.Printf("Listening on %s", listenAddr)
-    ln, err := net.Listen("tcp", listenAddr)
-    if err != nil {
-        log.Fatalf("Error listening: %v", err)
-    }
-    defer ln.Close()
-    for {
-        conn, err := ln.Accept()
-        if err != nil {
-            log.Printf("Error accepting: %v", err)
-            continue
-        }
-        go handleConn(conn)
-    }
+	log.Printf("Listening on %s", listenAddr)
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		log.Fatalf("Error listening: %v", err)
+	}
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Error accepting: %v", err)
+			continue
+		}
+		go handleConn(conn)
+	}
 }
 
+// handleConn answers the requests on conn, framed by protocol.Codec, until
+// the client goes away or sends nothing for readTimeout.
 func handleConn(conn net.Conn) {
-    defer conn.Close()
-    conn.SetReadDeadline(time.Now().Add(readTimeout))
-    for {
-        if err := handleMessage(conn); err != nil {
-            log.Printf("Error handling message: %v", err)
-            break
-        }
-    }
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	codec, err := protocol.ServerHandshake(conn, maxMessageSize)
+	if err != nil {
+		log.Printf("Error in handshake: %v", err)
+		return
+	}
+	for {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		if err := handleMessage(codec); err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("Error handling message: %v", err)
+			}
+			break
+		}
+	}
 }
 
-func handleMessage(conn net.Conn) error {
-    // Read message length
-    lengthBytes := make([]byte, 4)
-    _, err := conn.Read(lengthBytes)
-    if err != nil {
-        return err
-    }
-    msgLength, err := strconv.Atoi(string(lengthBytes))
-    if err != nil {
-        return err
-    }
-    if msgLength > maxMessageSize {
-        return fmt.Errorf("message too large: %d bytes", msgLength)
-    }
-    // Read message body
-    msgBuf := make([]byte, msgLength)
-    _, err = conn.Read(msgBuf)
-    if err != nil {
-        return err
-    }
-    // Parse the JSON request
-    var req Request
-    if err := json.Unmarshal(msgBuf, &req); err != nil {
-        log.Printf("Error parsing request: %v", err)
-        return sendResponse(conn, 500, "Invalid request JSON")
-    }
-    log.Printf("Received request: %+v", req)
-    resp := makeResponse(req)
-    return sendResponse(conn, resp.Status, resp.Body)
+func handleMessage(codec *protocol.Codec) error {
+	req, err := codec.ReadRequest()
+	if errors.Is(err, protocol.ErrMalformed) || errors.Is(err, protocol.ErrFrameTooLarge) {
+		// The frame was read whole, so the connection stays usable
+		log.Printf("Error parsing request: %v", err)
+		return sendResponse(codec, req.ID, 400, "Invalid request")
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Received request: %+v", req)
+	resp := makeResponse(req)
+	return sendResponse(codec, req.ID, resp.Status, resp.Message)
 }
 
-func makeResponse(req Request) Response {
-    return Response{
-        Status: 200,
-        Body:   fmt.Sprintf("Hello from path: %s!", req.Path),
-    }
+func makeResponse(req *protocol.Request) *protocol.Response {
+	return &protocol.Response{
+		Status:  200,
+		Message: fmt.Sprintf("Hello from path: %s!", req.Path),
+	}
 }
 
-func sendResponse(conn net.Conn, status int, body string) error {
-    resp := Response{
-        Status: status,
-        Body:   body,
-    }
-    resBytes, err := json.Marshal(resp)
-    if err != nil {
-        return err
-    }
-    // Send response length
-    lengthBytes := []byte(strconv.Itoa(len(resBytes)))
-    if _, err := conn.Write(lengthBytes); err != nil {
-        return err
-    }
-    // Send response body
-    if _, err := conn.Write(resBytes); err != nil {
-        return err
-    }
-    return nil
+func sendResponse(codec *protocol.Codec, id uint32, status int, message string) error {
+	return codec.WriteResponse(&protocol.Response{ID: id, Status: status, Message: message})
 }
 
 func main() {
-    serveTCP(":8080")
-}
\ No newline at end of file
+	serveTCP(":8080")
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed under the systemd
+// socket activation protocol.
+const listenFDsStart = 3
+
+// Environment variables used to hand off to a new binary during an upgrade,
+// alongside the standard LISTEN_FDS and LISTEN_FDNAMES.
+const (
+	envUpgradeReadyFD   = "UPGRADE_READY_FD"
+	envUpgradeHandoffFD = "UPGRADE_HANDOFF_FD"
+)
+
+// listenersFromEnv returns the listeners passed under the socket activation
+// protocol, keyed by their LISTEN_FDNAMES entry. Descriptors are numbered
+// from firstFD. A LISTEN_PID naming another process means the variables are
+// not for us; an unset LISTEN_PID is accepted, since a parent handing over
+// its sockets during an upgrade cannot know the child's PID before exec.
+func listenersFromEnv(getenv func(string) string, firstFD int) (map[string]net.Listener, error) {
+	listeners := make(map[string]net.Listener)
+	count := getenv("LISTEN_FDS")
+	if count == "" {
+		return listeners, nil
+	}
+	if pid := getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return listeners, nil
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", count)
+	}
+	var names []string
+	if fdNames := getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("fd%d", i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(firstFD+i), name)
+		ln, err := net.FileListener(f)
+		// FileListener dups the descriptor, so the original is closed either way.
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited listener %s: %w", name, err)
+		}
+		listeners[name] = ln
+	}
+	return listeners, nil
+}
+
+// sdNotify sends a state string such as "READY=1" to the service manager.
+// It does nothing when NOTIFY_SOCKET is not set.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if strings.HasPrefix(addr, "@") {
+		// Abstract socket namespace.
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// listenerSet hands out listeners, preferring ones inherited from systemd or
+// from a parent process, and can pass them on to a new copy of the binary.
+type listenerSet struct {
+	mu        sync.Mutex
+	inherited map[string]net.Listener
+	active    map[string]net.Listener
+	names     []string
+	upgrading bool
+	upgraded  bool
+}
+
+// newListenerSet collects the listeners passed to this process and clears the
+// activation variables so they are not passed on by accident.
+func newListenerSet() (*listenerSet, error) {
+	inherited, err := listenersFromEnv(os.Getenv, listenFDsStart)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(key)
+	}
+	for name := range inherited {
+		log.Printf("Inherited listener %s", name)
+	}
+	return &listenerSet{
+		inherited: inherited,
+		active:    make(map[string]net.Listener),
+	}, nil
+}
+
+// Listen returns the inherited listener called name, or a new TCP listener on
+// addr. Without one called name it takes the only inherited listener, or else
+// the first one passed without a name, since a unit that does not set
+// FileDescriptorName passes its socket as the unit name or unnamed.
+func (s *listenerSet) Listen(name, addr string) (net.Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := name
+	_, ok := s.inherited[key]
+	if !ok {
+		if key, ok = s.fallback(); ok {
+			log.Printf("Using inherited listener %s for %s", key, name)
+		}
+	}
+	ln := s.inherited[key]
+	if ok {
+		delete(s.inherited, key)
+	} else {
+		var err error
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	if _, seen := s.active[name]; !seen {
+		s.names = append(s.names, name)
+	}
+	s.active[name] = ln
+	return ln, nil
+}
+
+// fallback picks the inherited listener to use for a name none has: the only
+// one left, or else the lowest numbered one passed without a name. Callers
+// hold s.mu.
+func (s *listenerSet) fallback() (string, bool) {
+	if len(s.inherited) == 1 {
+		for key := range s.inherited {
+			return key, true
+		}
+	}
+	best, found := -1, false
+	for key := range s.inherited {
+		i, err := strconv.Atoi(strings.TrimPrefix(key, "fd"))
+		if err != nil || !strings.HasPrefix(key, "fd") {
+			continue
+		}
+		if !found || i < best {
+			best, found = i, true
+		}
+	}
+	return fmt.Sprintf("fd%d", best), found
+}
+
+// Upgrade starts a new copy of the running binary with the active listeners,
+// and waits up to timeout for it to report that it started. The child serves
+// the listeners from then on, alongside this process until it stops
+// accepting; the listening sockets stay open throughout, so no connection is
+// refused. The child waits for the handoff file to be closed, at the latest
+// when this process exits, only before taking over state such as the task
+// checkpoint.
+//
+// On success the caller must stop accepting, drain, and close the returned
+// handoff file, which tells the child, whose PID is returned, to take over.
+func (s *listenerSet) Upgrade(timeout time.Duration) (pid int, handoff *os.File, err error) {
+	s.mu.Lock()
+	if s.upgrading || s.upgraded {
+		s.mu.Unlock()
+		return 0, nil, errors.New("upgrade already in progress or done")
+	}
+	s.upgrading = true
+	var files []*os.File
+	for _, name := range s.names {
+		f, err := listenerFile(s.active[name])
+		if err != nil {
+			s.upgrading = false
+			s.mu.Unlock()
+			closeAll(files)
+			return 0, nil, fmt.Errorf("listener %s: %w", name, err)
+		}
+		files = append(files, f)
+	}
+	names := append([]string(nil), s.names...)
+	s.mu.Unlock()
+
+	defer func() {
+		closeAll(files)
+		s.mu.Lock()
+		s.upgrading = false
+		s.upgraded = err == nil
+		s.mu.Unlock()
+	}()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer readyR.Close()
+	handoffR, handoffW, err := os.Pipe()
+	if err != nil {
+		readyW.Close()
+		return 0, nil, err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		readyW.Close()
+		handoffR.Close()
+		handoffW.Close()
+		return 0, nil, err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyW, handoffR)
+	cmd.Env = append(upgradeEnv(os.Environ()),
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		envUpgradeReadyFD+"="+strconv.Itoa(listenFDsStart+len(files)),
+		envUpgradeHandoffFD+"="+strconv.Itoa(listenFDsStart+len(files)+1),
+	)
+	err = cmd.Start()
+	// The child holds its own copies of the pipe ends it needs.
+	readyW.Close()
+	handoffR.Close()
+	if err != nil {
+		handoffW.Close()
+		return 0, nil, err
+	}
+	go cmd.Wait()
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 2)
+		_, err := io.ReadFull(readyR, buf)
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(timeout):
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		handoffW.Close()
+		return 0, nil, fmt.Errorf("new process did not start: %w", err)
+	}
+	log.Printf("New process %d started, handing over", cmd.Process.Pid)
+	return cmd.Process.Pid, handoffW, nil
+}
+
+// upgradeEnv drops the handoff variables of a previous upgrade from env.
+func upgradeEnv(env []string) []string {
+	var out []string
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		switch key {
+		case "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", envUpgradeReadyFD, envUpgradeHandoffFD:
+			continue
+		}
+		out = append(out, kv)
+	}
+	return out
+}
+
+// listenerFile returns a duplicate of the socket behind ln, for passing to
+// another process.
+func listenerFile(ln net.Listener) (*os.File, error) {
+	filer, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("%T has no file to pass on", ln)
+	}
+	return filer.File()
+}
+
+func closeAll(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// upgradeChild reports whether this process was started by Upgrade.
+func upgradeChild() bool {
+	return os.Getenv(envUpgradeHandoffFD) != ""
+}
+
+// confirmStarted tells the parent of an upgrade that this process started.
+func confirmStarted() error {
+	f, err := upgradeFile(envUpgradeReadyFD)
+	if f == nil || err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write([]byte("ok"))
+	return err
+}
+
+// waitForParent blocks until the parent of an upgrade has shut down and
+// closed the handoff file.
+func waitForParent() error {
+	f, err := upgradeFile(envUpgradeHandoffFD)
+	if f == nil || err != nil {
+		return err
+	}
+	defer f.Close()
+	log.Println("Waiting for the previous process to drain")
+	_, err = io.Copy(io.Discard, f)
+	return err
+}
+
+// upgradeFile opens the descriptor named by an upgrade environment variable.
+func upgradeFile(key string) (*os.File, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil, nil
+	}
+	os.Unsetenv(key)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", key, v)
+	}
+	return os.NewFile(uintptr(fd), key), nil
+}
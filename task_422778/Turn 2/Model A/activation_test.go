@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestMain doubles as the new process started by TestUpgradeHandsOverListener:
+// it serves one connection on the inherited listener without waiting for the
+// parent to let go.
+func TestMain(m *testing.M) {
+	if upgradeChild() {
+		os.Exit(runUpgradeChild())
+	}
+	os.Exit(m.Run())
+}
+
+func runUpgradeChild() int {
+	listeners, err := newListenerSet()
+	if err != nil {
+		return 1
+	}
+	ln, err := listeners.Listen("http", "")
+	if err != nil {
+		return 1
+	}
+	if err := confirmStarted(); err != nil {
+		return 1
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		return 1
+	}
+	conn.Write([]byte("child " + strconv.Itoa(os.Getpid()) + "\n"))
+	conn.Close()
+	if err := waitForParent(); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// dupListenerFD returns a duplicate descriptor for ln, as a service manager
+// would pass it.
+func dupListenerFD(t *testing.T, ln net.Listener) int {
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File failed: %v", err)
+	}
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatalf("Dup failed: %v", err)
+	}
+	return fd
+}
+
+func TestListenersFromEnv(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	env := map[string]string{
+		"LISTEN_FDS":     "1",
+		"LISTEN_FDNAMES": "http",
+		"LISTEN_PID":     strconv.Itoa(os.Getpid()),
+	}
+	listeners, err := listenersFromEnv(func(k string) string { return env[k] }, dupListenerFD(t, ln))
+	if err != nil {
+		t.Fatalf("listenersFromEnv failed: %v", err)
+	}
+	inherited, ok := listeners["http"]
+	if !ok {
+		t.Fatalf("Expected an http listener, got %v", listeners)
+	}
+	defer inherited.Close()
+	if inherited.Addr().String() != ln.Addr().String() {
+		t.Errorf("Expected inherited listener on %s, got %s", ln.Addr(), inherited.Addr())
+	}
+}
+
+func TestListenersFromEnvIgnoresOtherPID(t *testing.T) {
+	env := map[string]string{
+		"LISTEN_FDS": "1",
+		"LISTEN_PID": strconv.Itoa(os.Getpid() + 1),
+	}
+	listeners, err := listenersFromEnv(func(k string) string { return env[k] }, 1000)
+	if err != nil || len(listeners) != 0 {
+		t.Errorf("Expected no listeners for another process, got %v, %v", listeners, err)
+	}
+}
+
+func TestListenerSetPrefersInherited(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	s := &listenerSet{
+		inherited: map[string]net.Listener{"http": ln},
+		active:    make(map[string]net.Listener),
+	}
+
+	got, err := s.Listen("http", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if got != ln {
+		t.Errorf("Expected the inherited listener, got one on %s", got.Addr())
+	}
+}
+
+func TestListenerSetFallsBackToUnnamed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	// A socket unit without FileDescriptorName sets no LISTEN_FDNAMES.
+	env := map[string]string{
+		"LISTEN_FDS": "1",
+		"LISTEN_PID": strconv.Itoa(os.Getpid()),
+	}
+	inherited, err := listenersFromEnv(func(k string) string { return env[k] }, dupListenerFD(t, ln))
+	if err != nil {
+		t.Fatalf("listenersFromEnv failed: %v", err)
+	}
+	s := &listenerSet{inherited: inherited, active: make(map[string]net.Listener)}
+
+	// The address is taken, so only the inherited listener can satisfy it.
+	got, err := s.Listen("http", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer got.Close()
+	if got.Addr().String() != ln.Addr().String() {
+		t.Errorf("Expected the inherited listener on %s, got one on %s", ln.Addr(), got.Addr())
+	}
+	if _, ok := s.active["http"]; !ok {
+		t.Errorf("Expected the listener to be handed over as http, got %v", s.active)
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	sock, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("ListenUnixgram failed: %v", err)
+	}
+	defer sock.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("sdNotify failed: %v", err)
+	}
+	buf := make([]byte, 64)
+	sock.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := sock.Read(buf)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if got := string(buf[:n]); got != "READY=1" {
+		t.Errorf("Expected READY=1, got %q", got)
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("Expected sdNotify without a socket to do nothing, got %v", err)
+	}
+}
+
+// pipeListener is a listener with no file behind it.
+type pipeListener struct{ net.Listener }
+
+func TestUpgradeRejectsListenerWithoutFile(t *testing.T) {
+	s := &listenerSet{
+		active: map[string]net.Listener{"http": pipeListener{}},
+		names:  []string{"http"},
+	}
+	if _, _, err := s.Upgrade(time.Second); err == nil {
+		t.Fatal("Expected an upgrade to fail for a listener without a file")
+	}
+	if s.upgrading || s.upgraded {
+		t.Error("Expected the failed upgrade to leave the set as it was")
+	}
+}
+
+func TestUpgradeHandsOverListener(t *testing.T) {
+	s := &listenerSet{inherited: make(map[string]net.Listener), active: make(map[string]net.Listener)}
+	ln, err := s.Listen("http", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr := ln.Addr().String()
+
+	pid, handoff, err := s.Upgrade(5 * time.Second)
+	if err != nil {
+		t.Fatalf("Upgrade failed: %v", err)
+	}
+	if _, _, err := s.Upgrade(time.Second); err == nil {
+		t.Error("Expected a second upgrade to be rejected")
+	}
+
+	// Once this process stops accepting, the child serves new connections
+	// before the handoff file is closed.
+	defer handoff.Close()
+	ln.Close()
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatalf("Dial during handoff failed: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if want := "child " + strconv.Itoa(pid) + "\n"; line != want {
+		t.Errorf("Expected %q, got %q", want, line)
+	}
+}
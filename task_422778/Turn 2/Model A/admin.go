@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+)
+
+// maxWorkers bounds how far the pool can be scaled at runtime.
+const maxWorkers = 64
+
+// Config is the runtime configuration reloaded on SIGHUP.
+type Config struct {
+	Workers int  `json:"workers"`
+	Paused  bool `json:"paused"`
+}
+
+var defaultConfig = Config{Workers: 3}
+
+// loadConfig reads the JSON config at path. A missing file yields defaultConfig.
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if cfg.Workers < 0 || cfg.Workers > maxWorkers {
+		return cfg, fmt.Errorf("workers must be between 0 and %d, got %d", maxWorkers, cfg.Workers)
+	}
+	return cfg, nil
+}
+
+// admin controls the worker pool at runtime through signals and HTTP:
+//
+//	SIGHUP               reload the config file
+//	SIGUSR1 / SIGUSR2    scale up / down by one worker
+//	POST /admin/pause    stop taking new tasks
+//	POST /admin/resume   take tasks again
+//	POST /admin/scale?workers=N
+//	POST /admin/reload
+//	POST /admin/upgrade  hand the listeners to a new copy of the binary
+//
+// The endpoints do not authenticate callers; register them only on a mux
+// served to trusted clients, such as one on a loopback address.
+type admin struct {
+	pool       *workerPool
+	configPath string
+	upgrade    func() error
+
+	sigs chan os.Signal
+	done chan struct{}
+}
+
+func (a *admin) Start(ctx context.Context) error {
+	a.sigs = make(chan os.Signal, 1)
+	a.done = make(chan struct{})
+	signal.Notify(a.sigs, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+	go a.handleSignals()
+	return nil
+}
+
+func (a *admin) Stop(ctx context.Context) error {
+	signal.Stop(a.sigs)
+	close(a.sigs)
+	select {
+	case <-a.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *admin) handleSignals() {
+	defer close(a.done)
+	for sig := range a.sigs {
+		var err error
+		switch sig {
+		case syscall.SIGHUP:
+			log.Println("Received SIGHUP, reloading config")
+			err = a.reload()
+		case syscall.SIGUSR1:
+			err = a.scale(a.pool.Size() + 1)
+		case syscall.SIGUSR2:
+			err = a.scale(a.pool.Size() - 1)
+		}
+		if err != nil {
+			log.Printf("Error handling %v: %v", sig, err)
+		}
+	}
+}
+
+// reload reads the config file and applies it to the pool.
+func (a *admin) reload() error {
+	cfg, err := loadConfig(a.configPath)
+	if err != nil {
+		return err
+	}
+	return a.apply(cfg)
+}
+
+func (a *admin) apply(cfg Config) error {
+	if cfg.Paused {
+		a.pool.Pause()
+	} else {
+		a.pool.Resume()
+	}
+	return a.scale(cfg.Workers)
+}
+
+func (a *admin) scale(n int) error {
+	if n < 0 || n > maxWorkers {
+		return fmt.Errorf("workers must be between 0 and %d, got %d", maxWorkers, n)
+	}
+	log.Printf("Scaling to %d workers", n)
+	return a.pool.Resize(n)
+}
+
+func (a *admin) register(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/pause", a.post(func(r *http.Request) error {
+		a.pool.Pause()
+		return nil
+	}))
+	mux.HandleFunc("/admin/resume", a.post(func(r *http.Request) error {
+		a.pool.Resume()
+		return nil
+	}))
+	mux.HandleFunc("/admin/reload", a.post(func(r *http.Request) error {
+		return a.reload()
+	}))
+	mux.HandleFunc("/admin/scale", a.post(func(r *http.Request) error {
+		n, err := strconv.Atoi(r.URL.Query().Get("workers"))
+		if err != nil {
+			return fmt.Errorf("invalid workers parameter: %w", err)
+		}
+		return a.scale(n)
+	}))
+	mux.HandleFunc("/admin/upgrade", a.post(func(r *http.Request) error {
+		if a.upgrade == nil {
+			return errors.New("upgrade not supported")
+		}
+		log.Println("Upgrading to a new process")
+		return a.upgrade()
+	}))
+}
+
+// post wraps an admin action as a POST-only handler.
+func (a *admin) post(action func(r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := action(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	cfg, err := loadConfig(filepath.Join(dir, "missing.json"))
+	if err != nil || cfg != defaultConfig {
+		t.Errorf("Expected defaults for a missing file, got %+v, %v", cfg, err)
+	}
+
+	path := filepath.Join(dir, "config.json")
+	os.WriteFile(path, []byte(`{"workers": 5, "paused": true}`), 0o644)
+	cfg, err = loadConfig(path)
+	if err != nil || cfg.Workers != 5 || !cfg.Paused {
+		t.Errorf("Unexpected config %+v, %v", cfg, err)
+	}
+
+	os.WriteFile(path, []byte(`{"workers": 1000}`), 0o644)
+	if _, err := loadConfig(path); err == nil {
+		t.Error("Expected an error for too many workers")
+	}
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	p, _ := newTestPool(t, 1, RestartPolicy{}, func(ctx context.Context, id int, task *Task) error {
+		return nil
+	})
+	defer p.Stop(context.Background())
+
+	a := &admin{pool: p}
+	mux := http.NewServeMux()
+	a.register(mux)
+	post := func(path string) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+		return rec.Code
+	}
+
+	if code := post("/admin/pause"); code != http.StatusOK || !p.Paused() {
+		t.Errorf("Pause: got %d, paused=%v", code, p.Paused())
+	}
+	if code := post("/admin/resume"); code != http.StatusOK || p.Paused() {
+		t.Errorf("Resume: got %d, paused=%v", code, p.Paused())
+	}
+	if code := post("/admin/scale?workers=3"); code != http.StatusOK {
+		t.Fatalf("Scale: got %d", code)
+	}
+	waitFor(t, func() bool { return p.Running() == 3 })
+	if code := post("/admin/scale?workers=-1"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a negative count, got %d", code)
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/pause", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// health serves the liveness, readiness and status endpoints.
+//
+// It is also a supervised component that depends on the HTTP server: it is
+// started last, marking the service ready, and stopped first, failing
+// readiness and waiting out grace so load balancers stop routing before
+// the server and workers begin to drain.
+type health struct {
+	pool    *workerPool
+	queue   *TaskQueue
+	grace   time.Duration
+	started time.Time
+
+	ready    atomic.Bool
+	draining atomic.Bool
+}
+
+// serviceStatus is the body of /status.
+type serviceStatus struct {
+	State         string         `json:"state"`
+	Uptime        string         `json:"uptime"`
+	Paused        bool           `json:"paused"`
+	TargetWorkers int            `json:"target_workers"`
+	Pending       int            `json:"pending_tasks"`
+	Running       int            `json:"running_tasks"`
+	Dead          int            `json:"dead_tasks"`
+	Workers       []WorkerStatus `json:"workers"`
+}
+
+func (h *health) Start(ctx context.Context) error {
+	h.ready.Store(true)
+	return nil
+}
+
+func (h *health) Stop(ctx context.Context) error {
+	h.ready.Store(false)
+	h.draining.Store(true)
+	log.Printf("Readiness failing, waiting %v before draining", h.grace)
+	select {
+	case <-time.After(h.grace):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *health) register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", h.handleHealthz)
+	mux.HandleFunc("/readyz", h.handleReadyz)
+	mux.HandleFunc("/status", h.handleStatus)
+}
+
+// poolFailed reports whether the worker pool gave up restarting workers.
+func (h *health) poolFailed() bool {
+	select {
+	case <-h.pool.Failed():
+		return true
+	default:
+		return false
+	}
+}
+
+func (h *health) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if h.poolFailed() {
+		http.Error(w, "worker pool failed", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (h *health) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case h.draining.Load():
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+	case !h.ready.Load():
+		http.Error(w, "starting", http.StatusServiceUnavailable)
+	case h.poolFailed():
+		http.Error(w, "worker pool failed", http.StatusServiceUnavailable)
+	case h.pool.Running() == 0:
+		http.Error(w, "no workers running", http.StatusServiceUnavailable)
+	default:
+		fmt.Fprintln(w, "ready")
+	}
+}
+
+func (h *health) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := serviceStatus{
+		State:         "running",
+		Paused:        h.pool.Paused(),
+		TargetWorkers: h.pool.Size(),
+		Workers:       h.pool.Status(),
+	}
+	switch {
+	case h.draining.Load():
+		status.State = "draining"
+	case !h.ready.Load():
+		status.State = "starting"
+	case h.poolFailed():
+		status.State = "failed"
+	}
+	status.Uptime = time.Since(h.started).Round(time.Second).String()
+	status.Pending, status.Running = h.queue.Len()
+	status.Dead = len(h.queue.DeadLetters())
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("Error writing status: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestHealth(t *testing.T) (*health, *http.ServeMux) {
+	t.Helper()
+	q, err := OpenTaskQueue(filepath.Join(t.TempDir(), "tasks.json"))
+	if err != nil {
+		t.Fatalf("OpenTaskQueue failed: %v", err)
+	}
+	block := func(ctx context.Context, id int, task *Task) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	pool := &workerPool{size: 2, queue: q, process: block, drain: time.Millisecond}
+	if err := pool.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(func() { pool.Stop(context.Background()) })
+
+	h := &health{pool: pool, queue: q, started: time.Now()}
+	mux := http.NewServeMux()
+	h.register(mux)
+	return h, mux
+}
+
+func get(mux *http.ServeMux, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func TestReadinessFollowsLifecycle(t *testing.T) {
+	h, mux := newTestHealth(t)
+
+	if code := get(mux, "/readyz").Code; code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 before start, got %d", code)
+	}
+	h.Start(context.Background())
+	if code := get(mux, "/readyz").Code; code != http.StatusOK {
+		t.Errorf("Expected 200 once started, got %d", code)
+	}
+	h.Stop(context.Background())
+	if code := get(mux, "/readyz").Code; code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 while draining, got %d", code)
+	}
+	if code := get(mux, "/healthz").Code; code != http.StatusOK {
+		t.Errorf("Expected liveness to stay 200 while draining, got %d", code)
+	}
+}
+
+func TestStatusListsWorkers(t *testing.T) {
+	h, mux := newTestHealth(t)
+	h.Start(context.Background())
+	h.queue.Submit("a")
+
+	var status serviceStatus
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rec := get(mux, "/status")
+		if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		if status.Running == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Task never started: %+v", status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if status.State != "running" || len(status.Workers) != 2 {
+		t.Fatalf("Unexpected status: %+v", status)
+	}
+	busy := 0
+	for _, ws := range status.Workers {
+		if ws.State == "busy" {
+			busy++
+			if ws.Task == nil || ws.Task.Payload != "a" {
+				t.Errorf("Expected busy worker to report task a, got %+v", ws.Task)
+			}
+		}
+		if ws.Uptime == "" {
+			t.Errorf("Expected worker %d to report an uptime", ws.ID)
+		}
+	}
+	if busy != 1 {
+		t.Errorf("Expected one busy worker, got %d", busy)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"math/rand"
@@ -13,86 +15,235 @@ import (
 )
 
 const (
-	workDuration = time.Duration(rand.Intn(5)) * time.Second
-	shutdownTimeout = 5 * time.Second
+	shutdownTimeout = 10 * time.Second
+	taskTimeout     = 3 * time.Second
+	upgradeTimeout  = 10 * time.Second
 )
 
-func processTask(ctx context.Context, id int) error {
-	log.Printf("Worker %d started task\n", id)
+// processTask simulates a task of random length. It returns ctx.Err() as soon
+// as the task's deadline passes or the worker is cancelled.
+func processTask(ctx context.Context, id int, task *Task) error {
+	log.Printf("Worker %d started task %d (%s)\n", id, task.ID, task.Payload)
 
+	workDuration := time.Duration(rand.Intn(5)) * time.Second
+	timer := time.NewTimer(workDuration)
+	defer timer.Stop()
 	select {
 	case <-ctx.Done():
-		return fmt.Errorf("task %d cancelled", id)
-	default:
-		time.Sleep(workDuration)
+		return ctx.Err()
+	case <-timer.C:
 	}
 
-	log.Printf("Worker %d completed task\n", id)
+	log.Printf("Worker %d completed task %d\n", id, task.ID)
 	return nil
 }
 
-func worker(ctx context.Context, id int) {
-	defer log.Printf("Worker %d exited\n", id)
+// taskFeeder submits a new task every interval, standing in for incoming work.
+type taskFeeder struct {
+	queue    *TaskQueue
+	interval time.Duration
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			if err := processTask(ctx, id); err != nil {
-				log.Printf("Worker %d task error: %v\n", id, err)
+func (f *taskFeeder) Start(ctx context.Context) error {
+	feedCtx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+	f.done = make(chan struct{})
+	go func() {
+		defer close(f.done)
+		ticker := time.NewTicker(f.interval)
+		defer ticker.Stop()
+		for n := 1; ; n++ {
+			select {
+			case <-feedCtx.Done():
 				return
+			case <-ticker.C:
+				if _, err := f.queue.Submit(fmt.Sprintf("job-%d", n)); err != nil {
+					return
+				}
 			}
 		}
+	}()
+	return nil
+}
+
+func (f *taskFeeder) Stop(ctx context.Context) error {
+	f.cancel()
+	select {
+	case <-f.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// httpServer serves HTTP as a supervised component. Its listener is taken
+// from listeners under name so that it can be inherited and handed over.
+type httpServer struct {
+	name      string
+	addr      string
+	listeners *listenerSet
+	srv       *http.Server
+}
+
+func (h *httpServer) Start(ctx context.Context) error {
+	ln, err := h.listeners.Listen(h.name, h.addr)
+	if err != nil {
+		return err
 	}
+	log.Printf("Listening for %s on %s", h.name, ln.Addr())
+	go func() {
+		if err := h.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Error serving HTTP: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (h *httpServer) Stop(ctx context.Context) error {
+	return h.srv.Shutdown(ctx)
 }
 
 func main() {
+	configPath := flag.String("config", "config.json", "runtime config file, reloaded on SIGHUP")
+	adminAddr := flag.String("admin-addr", "127.0.0.1:8081", "address for the /admin endpoints; keep it off public interfaces")
+	maxAttempts := flag.Int("max-attempts", defaultMaxTaskAttempts, "times a task may time out, fail or panic before it is dead-lettered")
+	flag.Parse()
+
 	rand.Seed(time.Now().UnixNano())
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
 
-	numWorkers := 3
-	workers := make([]*worker, numWorkers)
+	// Listeners passed by systemd socket activation or by a process upgrading
+	// to this binary; anything not inherited is opened when first needed.
+	listeners, err := newListenerSet()
+	if err != nil {
+		log.Fatalf("Error inheriting listeners: %v", err)
+	}
 
-	for i := 0; i < numWorkers; i++ {
-		w := &worker{
-			ctx: ctx,
-			id:  i,
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Hello, World!")
+	})
+
+	// Reload unfinished tasks from the last run before accepting new work
+	var queue *TaskQueue
+	if upgradeChild() {
+		if err := confirmStarted(); err != nil {
+			log.Fatalf("Error confirming upgrade: %v", err)
+		}
+		// Serve at once, alongside the previous process until it stops
+		// accepting, but leave the tasks to it until it has checkpointed
+		// them on the way out
+		queue = newTaskQueue("tasks.json")
+		go func() {
+			if err := waitForParent(); err != nil {
+				log.Fatalf("Error waiting for previous process: %v", err)
+			}
+			if err := queue.Load(); err != nil {
+				log.Fatalf("Error loading task checkpoint: %v", err)
+			}
+		}()
+	} else if queue, err = OpenTaskQueue("tasks.json"); err != nil {
+		log.Fatalf("Error loading task checkpoint: %v", err)
+	}
+
+	// Workers start before the HTTP server and stop after it; the task queue
+	// is checkpointed once everything feeding and draining it has stopped.
+	// The stop timeouts below add up to shutdownTimeout.
+	sup := NewSupervisor(shutdownTimeout)
+	sup.Register("tasks", queue, time.Second)
+	pool := &workerPool{
+		size:        cfg.Workers,
+		queue:       queue,
+		drain:       2 * time.Second,
+		taskTimeout: taskTimeout,
+		maxAttempts: *maxAttempts,
+		policy:      defaultRestartPolicy,
+	}
+	sup.Register("workers", pool, 3*time.Second, "tasks")
+	sup.Register("feeder", &taskFeeder{queue: queue, interval: 500 * time.Millisecond}, 500*time.Millisecond, "tasks")
+	sup.Register("http", &httpServer{name: "http", addr: ":8080", listeners: listeners, srv: &http.Server{Handler: mux}}, 2*time.Second, "workers")
+
+	// A successful upgrade hands the listeners to a new process, then this
+	// one shuts down as it would on SIGTERM.
+	upgraded := make(chan *os.File, 1)
+	upgrade := func() error {
+		pid, handoff, err := listeners.Upgrade(upgradeTimeout)
+		if err != nil {
+			return err
+		}
+		upgraded <- handoff
+		if err := sdNotify(fmt.Sprintf("MAINPID=%d", pid)); err != nil {
+			log.Printf("Error notifying service manager: %v", err)
 		}
-		workers[i] = w
-		go w.run()
+		return nil
 	}
 
-	// Simulate some work being done
-	time.Sleep(2 * time.Second)
+	// Runtime control of the pool through signals and /admin endpoints
+	// The admin endpoints are unauthenticated, so they get their own
+	// listener, loopback only by default, instead of sharing the public one
+	adm := &admin{pool: pool, configPath: *configPath, upgrade: upgrade}
+	adminMux := http.NewServeMux()
+	adm.register(adminMux)
+	sup.Register("admin", adm, 500*time.Millisecond, "workers")
+	// Started after http, which has first pick of the inherited listeners
+	sup.Register("admin-http", &httpServer{name: "admin", addr: *adminAddr, listeners: listeners, srv: &http.Server{Handler: adminMux}}, time.Second, "admin", "http")
+
+	// Readiness flips to failing before anything else stops
+	h := &health{pool: pool, queue: queue, grace: time.Second, started: time.Now()}
+	h.register(mux)
+	sup.Register("health", h, 2*time.Second, "http")
+
+	if err := sup.Start(context.Background()); err != nil {
+		log.Fatalf("Error starting: %v", err)
+	}
+	if cfg.Paused {
+		pool.Pause()
+	}
+	if err := sdNotify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid())); err != nil {
+		log.Printf("Error notifying service manager: %v", err)
+	}
 
 	// Graceful shutdown: handle interrupt signals (SIGINT, SIGTERM)
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	go func() {
-		<-sigChan
+	var handoff *os.File
+	select {
+	case <-sigChan:
 		log.Println("Received interrupt signal, shutting down...")
-		// Cancel the context to signal workers to stop
-		cancel()
-		// Wait for workers to complete or timeout
-		time.AfterFunc(shutdownTimeout, func() {
-			log.Println("Shutdown timeout reached, forcing exit")
-			os.Exit(1)
-		})
-	}()
+	case <-pool.Failed():
+		log.Println("Worker pool gave up restarting workers, shutting down...")
+	case handoff = <-upgraded:
+		log.Println("Upgrade started, draining before handing over...")
+	}
 
-	// Serve HTTP requests until shutdown
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "Hello, World!")
-	})
-	log.Println("Listening on port 8080")
-	err := http.ListenAndServe(":8080", nil)
-	if err != nil && err != http.ErrServerClosed {
-		log.Fatalf("Error starting HTTP server: %v", err)
+	// After an upgrade the service manager already follows the new process
+	if handoff == nil {
+		if err := sdNotify("STOPPING=1"); err != nil {
+			log.Printf("Error notifying service manager: %v", err)
+		}
+	}
+	err = sup.Stop(context.Background())
+	// An overrunning stop is abandoned, but the checkpoint must be written
+	// before this process exits or the new one loads it
+	<-queue.Stopped()
+	if handoff != nil {
+		// Lets the new process take over the checkpointed tasks
+		handoff.Close()
+	}
+	if err != nil {
+		var stopErr *StopError
+		if errors.As(err, &stopErr) {
+			log.Printf("Components that did not stop in time: %v", stopErr.TimedOut())
+		}
+		log.Printf("Shutdown incomplete: %v", err)
+		os.Exit(1)
 	}
 
 	log.Println("Shutdown complete")
-}
\ No newline at end of file
+}
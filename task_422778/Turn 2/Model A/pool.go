@@ -0,0 +1,652 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// taskFunc processes a single task on behalf of a worker. ctx carries the
+// task's deadline and is also cancelled when the worker is stopped, so
+// blocking work should select on ctx.Done().
+type taskFunc func(ctx context.Context, id int, task *Task) error
+
+// PanicError is returned for a task that panicked instead of returning.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// runTask calls process, turning a panic into a *PanicError.
+func runTask(ctx context.Context, process taskFunc, id int, task *Task) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return process(ctx, id, task)
+}
+
+// defaultMaxTaskAttempts is how many times a task may time out, fail or panic
+// before it is dead-lettered, unless the pool sets maxAttempts.
+const defaultMaxTaskAttempts = 3
+
+// work takes tasks from the queue until it is closed, ctx is cancelled or
+// retire is cancelled, which are normal exits. Cancelling retire lets the
+// running task finish first; cancelling ctx aborts it.
+//
+// Each task runs under its own deadline derived from ctx. A task that times
+// out, fails or panics is retried until it has had maxAttempts attempts, then
+// dead-lettered; a failure or panic is also returned as the worker's error.
+// Attempts are checkpointed with the task, so one restored with none left is
+// dead-lettered without running again.
+func (p *workerPool) work(ctx, retire context.Context, id int) error {
+	for {
+		if err := p.waitResumed(retire, id); err != nil {
+			return nil
+		}
+		task, err := p.nextTask(retire)
+		if err != nil {
+			if retire.Err() == nil && !errors.Is(err, ErrQueueClosed) {
+				// Paused while waiting for a task.
+				continue
+			}
+			return nil
+		}
+		if task.Attempts > p.maxAttempts {
+			// Restored from a checkpoint with its attempts already used up.
+			log.Printf("Worker %d task %d already had %d attempts, dead-lettering it\n", id, task.ID, task.Attempts-1)
+			p.queue.DeadLetter(task)
+			continue
+		}
+		p.setState(id, "busy", task)
+		taskCtx, cancel := p.taskContext(ctx)
+		err = runTask(taskCtx, p.process, id, task)
+		timedOut := errors.Is(taskCtx.Err(), context.DeadlineExceeded)
+		cancel()
+		p.setState(id, "idle", nil)
+
+		switch {
+		case err == nil:
+			p.record(id, outcomeCompleted)
+			p.queue.Done(task)
+		case ctx.Err() != nil:
+			p.record(id, outcomeCancelled)
+			p.queue.Retry(task)
+			return nil
+		case timedOut:
+			p.record(id, outcomeTimedOut)
+			if task.Attempts >= p.maxAttempts {
+				log.Printf("Worker %d task %d timed out %d times, dead-lettering it\n", id, task.ID, task.Attempts)
+				p.queue.DeadLetter(task)
+			} else {
+				log.Printf("Worker %d task %d timed out after %v\n", id, task.ID, p.taskTimeout)
+				p.queue.Retry(task)
+			}
+		default:
+			p.record(id, outcomeFailed)
+			if task.Attempts >= p.maxAttempts {
+				log.Printf("Worker %d task %d failed %d times, dead-lettering it\n", id, task.ID, task.Attempts)
+				p.queue.DeadLetter(task)
+			} else {
+				p.queue.Retry(task)
+			}
+			return fmt.Errorf("task %d: %w", task.ID, err)
+		}
+	}
+}
+
+// taskContext derives the context a single task runs under.
+func (p *workerPool) taskContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.taskTimeout > 0 {
+		return context.WithTimeout(ctx, p.taskTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// nextTask waits for a task, giving up if the pool is paused meanwhile.
+func (p *workerPool) nextTask(retire context.Context) (*Task, error) {
+	p.pauseMu.Lock()
+	unpaused := p.unpaused
+	p.pauseMu.Unlock()
+
+	ctx, cancel := context.WithCancel(retire)
+	defer cancel()
+	stop := context.AfterFunc(unpaused, cancel)
+	defer stop()
+	return p.queue.Next(ctx)
+}
+
+// waitResumed blocks while the pool is paused.
+func (p *workerPool) waitResumed(ctx context.Context, id int) error {
+	p.pauseMu.Lock()
+	resumed := p.resumed
+	p.pauseMu.Unlock()
+
+	select {
+	case <-resumed:
+		return nil
+	default:
+	}
+	p.setState(id, "paused", nil)
+	select {
+	case <-resumed:
+		p.setState(id, "idle", nil)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RestartStrategy decides which workers are restarted when one crashes.
+type RestartStrategy int
+
+const (
+	// OneForOne restarts only the crashed worker.
+	OneForOne RestartStrategy = iota
+	// OneForAll stops the remaining workers and restarts all of them.
+	OneForAll
+)
+
+// RestartPolicy configures how a workerPool restarts crashed workers.
+type RestartPolicy struct {
+	Strategy RestartStrategy
+	// MinBackoff is the delay before the first restart of a worker; it doubles
+	// with each further restart of that worker within Window, up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxRestarts is how many restarts the pool allows within Window before
+	// it gives up and stops all workers.
+	MaxRestarts int
+	Window      time.Duration
+}
+
+var defaultRestartPolicy = RestartPolicy{
+	Strategy:    OneForOne,
+	MinBackoff:  100 * time.Millisecond,
+	MaxBackoff:  5 * time.Second,
+	MaxRestarts: 10,
+	Window:      time.Minute,
+}
+
+type workerExit struct {
+	id  int
+	err error
+}
+
+// workerPool runs a set of workers as a supervised component and restarts
+// the ones that crash according to its RestartPolicy. The number of workers
+// can be changed and the pool paused while it runs.
+type workerPool struct {
+	// size is the initial number of workers; use Resize once started.
+	size    int
+	queue   *TaskQueue
+	process taskFunc
+	policy  RestartPolicy
+	// drain is how long in-progress tasks may run after shutdown begins
+	// before they are cancelled and marked for retry.
+	drain time.Duration
+	// taskTimeout bounds each task; zero means no deadline.
+	taskTimeout time.Duration
+	// maxAttempts is how many times a task may time out, fail or panic
+	// before it is dead-lettered; zero means defaultMaxTaskAttempts.
+	maxAttempts int
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	failed chan struct{}
+	resize chan int
+
+	pauseMu sync.Mutex
+	paused  bool
+	// resumed is closed while the pool is not paused; unpaused is cancelled
+	// when it is paused, interrupting workers waiting for a task.
+	resumed  chan struct{}
+	unpaused context.Context
+	pause    context.CancelFunc
+
+	statusMu sync.Mutex
+	workers  map[int]*WorkerStatus
+	target   int
+}
+
+// WorkerStatus describes what a worker is doing.
+type WorkerStatus struct {
+	ID int `json:"id"`
+	// State is one of idle, busy, paused, restarting, stopped or failed.
+	State     string    `json:"state"`
+	Task      *Task     `json:"task,omitempty"`
+	Restarts  int       `json:"restarts"`
+	StartedAt time.Time `json:"started_at"`
+	Uptime    string    `json:"uptime"`
+
+	// Task outcomes since the worker was first started.
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+	TimedOut  int `json:"timed_out"`
+	Cancelled int `json:"cancelled"`
+}
+
+type taskOutcome int
+
+const (
+	outcomeCompleted taskOutcome = iota
+	outcomeFailed
+	outcomeTimedOut
+	outcomeCancelled
+)
+
+// record counts a task outcome for a worker.
+func (p *workerPool) record(id int, outcome taskOutcome) {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	ws := p.workers[id]
+	if ws == nil {
+		return
+	}
+	switch outcome {
+	case outcomeCompleted:
+		ws.Completed++
+	case outcomeFailed:
+		ws.Failed++
+	case outcomeTimedOut:
+		ws.TimedOut++
+	case outcomeCancelled:
+		ws.Cancelled++
+	}
+}
+
+// setState records a worker's state and the task it is running, if any,
+// and returns the worker's restart count.
+func (p *workerPool) setState(id int, state string, task *Task) int {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	ws := p.workers[id]
+	if ws == nil {
+		ws = &WorkerStatus{ID: id}
+		p.workers[id] = ws
+	}
+	ws.State = state
+	ws.Task = nil
+	if task != nil {
+		// Keep a copy; the queue may hand the task to another worker after a retry.
+		t := *task
+		ws.Task = &t
+	}
+	switch state {
+	case "idle":
+		if ws.StartedAt.IsZero() {
+			ws.StartedAt = time.Now()
+		}
+	case "restarting":
+		ws.Restarts++
+		ws.StartedAt = time.Time{}
+	}
+	return ws.Restarts
+}
+
+// Status returns a snapshot of every worker, ordered by ID.
+func (p *workerPool) Status() []WorkerStatus {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	statuses := make([]WorkerStatus, 0, len(p.workers))
+	for _, ws := range p.workers {
+		s := *ws
+		if !s.StartedAt.IsZero() && s.State != "restarting" && s.State != "stopped" && s.State != "failed" {
+			s.Uptime = time.Since(s.StartedAt).Round(time.Second).String()
+		}
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// removeState forgets a worker that was retired by a scale-down.
+func (p *workerPool) removeState(id int) {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	delete(p.workers, id)
+}
+
+// Running returns the number of workers that are idle, busy or paused.
+func (p *workerPool) Running() int {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	n := 0
+	for _, ws := range p.workers {
+		if ws.State == "idle" || ws.State == "busy" || ws.State == "paused" {
+			n++
+		}
+	}
+	return n
+}
+
+func (p *workerPool) Start(ctx context.Context) error {
+	if p.process == nil {
+		p.process = processTask
+	}
+	if p.policy == (RestartPolicy{}) {
+		p.policy = defaultRestartPolicy
+	}
+	if p.maxAttempts == 0 {
+		p.maxAttempts = defaultMaxTaskAttempts
+	}
+	p.done = make(chan struct{})
+	p.failed = make(chan struct{})
+	p.resize = make(chan int)
+	p.resumed = make(chan struct{})
+	close(p.resumed)
+	p.unpaused, p.pause = context.WithCancel(context.Background())
+	p.workers = make(map[int]*WorkerStatus)
+	p.target = p.size
+	// Report the workers as running as soon as Start returns.
+	for id := 0; id < p.size; id++ {
+		p.setState(id, "idle", nil)
+	}
+
+	// Workers outlive the start context; they run until Stop.
+	workCtx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	go p.supervise(workCtx)
+	return nil
+}
+
+// Failed is closed when the pool gives up after exceeding its restart intensity.
+func (p *workerPool) Failed() <-chan struct{} {
+	return p.failed
+}
+
+// Pause stops workers from taking new tasks; running tasks finish normally.
+func (p *workerPool) Pause() {
+	p.pauseMu.Lock()
+	defer p.pauseMu.Unlock()
+	if p.paused {
+		return
+	}
+	p.paused = true
+	p.resumed = make(chan struct{})
+	p.pause()
+}
+
+// Resume lets paused workers take tasks again.
+func (p *workerPool) Resume() {
+	p.pauseMu.Lock()
+	defer p.pauseMu.Unlock()
+	if !p.paused {
+		return
+	}
+	p.paused = false
+	close(p.resumed)
+	p.unpaused, p.pause = context.WithCancel(context.Background())
+}
+
+// Paused reports whether the pool is paused.
+func (p *workerPool) Paused() bool {
+	p.pauseMu.Lock()
+	defer p.pauseMu.Unlock()
+	return p.paused
+}
+
+// Resize changes the number of workers. Workers removed by a scale-down
+// finish their running task before they exit.
+func (p *workerPool) Resize(n int) error {
+	if n < 0 {
+		return fmt.Errorf("invalid worker count %d", n)
+	}
+	select {
+	case p.resize <- n:
+		p.statusMu.Lock()
+		p.target = n
+		p.statusMu.Unlock()
+		return nil
+	case <-p.done:
+		return errors.New("worker pool is not running")
+	}
+}
+
+// Size returns the number of workers the pool is scaled to.
+func (p *workerPool) Size() int {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	return p.target
+}
+
+// poolWorker is the supervisor's handle on a running worker.
+type poolWorker struct {
+	abort    context.CancelFunc
+	retire   context.CancelFunc
+	retiring bool
+}
+
+func (p *workerPool) supervise(ctx context.Context) {
+	defer close(p.done)
+
+	exits := make(chan workerExit)
+	running := make(map[int]*poolWorker)
+	recent := make(map[int][]time.Time)
+	var history []time.Time
+	size, nextID := p.size, 0
+	// due holds the workers waiting out their restart backoff, and when
+	// each may start again. wake fires at the earliest of them.
+	due := make(map[int]time.Time)
+	wake := time.NewTimer(0)
+	wake.Stop()
+	defer wake.Stop()
+
+	start := func(id int) {
+		workerCtx, abort := context.WithCancel(ctx)
+		retireCtx, retire := context.WithCancel(workerCtx)
+		running[id] = &poolWorker{abort: abort, retire: retire}
+		p.setState(id, "idle", nil)
+		go func() {
+			exits <- workerExit{id: id, err: p.work(workerCtx, retireCtx, id)}
+		}()
+	}
+	// active returns the IDs of the workers that are running and not
+	// retiring, or waiting to restart.
+	active := func() []int {
+		var ids []int
+		for id, w := range running {
+			if !w.retiring {
+				ids = append(ids, id)
+			}
+		}
+		for id := range due {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		return ids
+	}
+	// schedule arms wake for the earliest due restart.
+	schedule := func() {
+		wake.Stop()
+		var next time.Time
+		for _, at := range due {
+			if next.IsZero() || at.Before(next) {
+				next = at
+			}
+		}
+		if !next.IsZero() {
+			wake.Reset(time.Until(next))
+		}
+	}
+	// scale starts or retires workers until size are active, retiring the newest first.
+	scale := func() {
+		ids := active()
+		for n := len(ids); n < size; n++ {
+			log.Printf("Starting worker %d\n", nextID)
+			start(nextID)
+			nextID++
+		}
+		for i := len(ids) - 1; i >= size; i-- {
+			id := ids[i]
+			log.Printf("Retiring worker %d\n", id)
+			if _, ok := due[id]; ok {
+				delete(due, id)
+				p.removeState(id)
+				continue
+			}
+			running[id].retiring = true
+			running[id].retire()
+		}
+		schedule()
+	}
+	// stopAll aborts every running worker and waits for them to exit,
+	// leaving the ones not being retired in state.
+	stopAll := func(state string) {
+		for _, w := range running {
+			w.abort()
+		}
+		for len(running) > 0 {
+			exit := <-exits
+			if running[exit.id].retiring {
+				p.removeState(exit.id)
+				log.Printf("Worker %d retired\n", exit.id)
+			} else {
+				p.setState(exit.id, state, nil)
+				log.Printf("Worker %d exited\n", exit.id)
+			}
+			delete(running, exit.id)
+		}
+	}
+	// stopDue gives up on the restarts still waiting out their backoff.
+	stopDue := func() {
+		for id := range due {
+			p.setState(id, "stopped", nil)
+		}
+		clear(due)
+		schedule()
+	}
+
+	scale()
+	stopping := ctx.Done()
+	for {
+		if ctx.Err() != nil && len(running) == 0 {
+			stopDue()
+			return
+		}
+
+		var exit workerExit
+		select {
+		case <-stopping:
+			// Workers see the cancellation themselves; keep collecting their exits.
+			stopping = nil
+			stopDue()
+			continue
+		case size = <-p.resize:
+			if ctx.Err() == nil {
+				scale()
+			}
+			continue
+		case <-wake.C:
+			now := time.Now()
+			for id, at := range due {
+				if !at.After(now) {
+					delete(due, id)
+					log.Printf("Restarting worker %d\n", id)
+					start(id)
+				}
+			}
+			schedule()
+			continue
+		case exit = <-exits:
+		}
+
+		w := running[exit.id]
+		w.abort()
+		delete(running, exit.id)
+		if w.retiring {
+			p.removeState(exit.id)
+			log.Printf("Worker %d retired\n", exit.id)
+			continue
+		}
+		if exit.err == nil || ctx.Err() != nil {
+			p.setState(exit.id, "stopped", nil)
+			log.Printf("Worker %d exited\n", exit.id)
+			continue
+		}
+
+		restarts := p.setState(exit.id, "restarting", nil)
+		var panicErr *PanicError
+		if errors.As(exit.err, &panicErr) {
+			log.Printf("Worker %d crashed (restarts: %d): %v\n%s", exit.id, restarts, exit.err, panicErr.Stack)
+		} else {
+			log.Printf("Worker %d crashed (restarts: %d): %v\n", exit.id, restarts, exit.err)
+		}
+
+		now := time.Now()
+		history = append(withinWindow(history, now, p.policy.Window), now)
+		recent[exit.id] = append(withinWindow(recent[exit.id], now, p.policy.Window), now)
+		if len(history) > p.policy.MaxRestarts {
+			log.Printf("Restart intensity exceeded (%d restarts in %v), stopping all workers", len(history), p.policy.Window)
+			stopAll("stopped")
+			stopDue()
+			p.setState(exit.id, "failed", nil)
+			close(p.failed)
+			return
+		}
+
+		// The restart waits out its backoff in the loop, so Resize and
+		// shutdown are not held up meanwhile.
+		at := now.Add(p.policy.backoff(len(recent[exit.id])))
+		due[exit.id] = at
+		if p.policy.Strategy == OneForAll {
+			for id, w := range running {
+				if !w.retiring {
+					due[id] = at
+				}
+			}
+			stopAll("restarting")
+		}
+		schedule()
+	}
+}
+
+// backoff returns the delay before the n-th restart of a worker within the window.
+func (rp RestartPolicy) backoff(n int) time.Duration {
+	d := rp.MinBackoff
+	for i := 1; i < n && d < rp.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > rp.MaxBackoff {
+		d = rp.MaxBackoff
+	}
+	return d
+}
+
+// withinWindow drops the times older than window before now.
+func withinWindow(times []time.Time, now time.Time, window time.Duration) []time.Time {
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= window {
+		i++
+	}
+	return times[i:]
+}
+
+func (p *workerPool) Stop(ctx context.Context) error {
+	// Stop handing out tasks and give the running ones a chance to finish
+	p.queue.Close()
+	drainCtx, cancelDrain := context.WithTimeout(ctx, p.drain)
+	defer cancelDrain()
+	if err := p.queue.Drain(drainCtx); err != nil {
+		_, running := p.queue.Len()
+		log.Printf("Drain window elapsed, cancelling %d running tasks", running)
+	}
+	p.cancel()
+
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
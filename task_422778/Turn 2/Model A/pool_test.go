@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestPool starts a pool, applying configure to it first.
+func newTestPool(t *testing.T, size int, policy RestartPolicy, process taskFunc, configure ...func(*workerPool)) (*workerPool, *TaskQueue) {
+	t.Helper()
+	q, err := OpenTaskQueue(filepath.Join(t.TempDir(), "tasks.json"))
+	if err != nil {
+		t.Fatalf("OpenTaskQueue failed: %v", err)
+	}
+	p := &workerPool{size: size, queue: q, process: process, policy: policy, drain: time.Second}
+	for _, f := range configure {
+		f(p)
+	}
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	return p, q
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPoolRecoversPanicsAndRetriesTask(t *testing.T) {
+	var calls atomic.Int32
+	var done atomic.Int32
+	process := func(ctx context.Context, id int, task *Task) error {
+		if calls.Add(1) == 1 {
+			panic("boom")
+		}
+		done.Add(1)
+		return nil
+	}
+	policy := RestartPolicy{Strategy: OneForOne, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRestarts: 5, Window: time.Minute}
+	p, q := newTestPool(t, 1, policy, process)
+
+	q.Submit("a")
+	waitFor(t, func() bool { return done.Load() == 1 })
+
+	if err := p.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("Expected the panicked task to be retried once, got %d calls", calls.Load())
+	}
+}
+
+func TestPoolDeadLettersPoisonTask(t *testing.T) {
+	var poison atomic.Int32
+	process := func(ctx context.Context, id int, task *Task) error {
+		if task.Payload == "poison" {
+			poison.Add(1)
+			panic("boom")
+		}
+		return nil
+	}
+	policy := RestartPolicy{Strategy: OneForOne, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRestarts: 5, Window: time.Minute}
+	p, q := newTestPool(t, 1, policy, process, func(p *workerPool) {
+		p.maxAttempts = 3
+	})
+	defer p.Stop(context.Background())
+
+	q.Submit("poison")
+	q.Submit("ok")
+	waitFor(t, func() bool { return len(q.DeadLetters()) == 1 && p.Status()[0].Completed == 1 })
+
+	if got := poison.Load(); got != 3 {
+		t.Errorf("Expected the poison task to run 3 times, got %d", got)
+	}
+	if dead := q.DeadLetters(); dead[0].Payload != "poison" {
+		t.Errorf("Expected the poison task to be dead-lettered, got %+v", dead)
+	}
+	select {
+	case <-p.Failed():
+		t.Fatal("Expected the pool to stay up after dead-lettering the poison task")
+	default:
+	}
+	if pending, running := q.Len(); pending != 0 || running != 0 {
+		t.Errorf("Expected an empty queue, got %d pending, %d running", pending, running)
+	}
+}
+
+func TestPoolDeadLettersRestoredTaskWithoutAttemptsLeft(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.json")
+	q, _ := OpenTaskQueue(path)
+	q.Submit("poison")
+	q.Submit("ok")
+	for i := 0; i < 3; i++ {
+		task, _ := q.Next(context.Background())
+		q.Retry(task)
+	}
+	if err := q.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	q, err := OpenTaskQueue(path)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	var ran []string
+	var mu sync.Mutex
+	process := func(ctx context.Context, id int, task *Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, task.Payload)
+		return nil
+	}
+	p := &workerPool{size: 1, queue: q, process: process, drain: time.Second, maxAttempts: 3}
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer p.Stop(context.Background())
+
+	waitFor(t, func() bool { return p.Status()[0].Completed == 1 })
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ran) != 1 || ran[0] != "ok" {
+		t.Errorf("Expected only the ok task to run, got %v", ran)
+	}
+	if dead := q.DeadLetters(); len(dead) != 1 || dead[0].Payload != "poison" {
+		t.Errorf("Expected the restored poison task to be dead-lettered, got %+v", dead)
+	}
+}
+
+func TestPoolOneForAllRestartsEveryWorker(t *testing.T) {
+	var mu sync.Mutex
+	started := make(map[int]int)
+	process := func(ctx context.Context, id int, task *Task) error {
+		mu.Lock()
+		started[id]++
+		mu.Unlock()
+		if task.Payload == "fail" {
+			return errors.New("failed")
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	policy := RestartPolicy{Strategy: OneForAll, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRestarts: 5, Window: time.Minute}
+	p, q := newTestPool(t, 2, policy, process)
+	defer p.Stop(context.Background())
+
+	// Occupy one worker, then crash the other.
+	q.Submit("block")
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(started) == 1
+	})
+	q.Submit("fail")
+
+	// The blocked task is cancelled by the restart and picked up again,
+	// as is the failed one, so at least four task starts are observed.
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return started[0]+started[1] >= 4
+	})
+}
+
+func TestPoolGivesUpAfterMaxRestarts(t *testing.T) {
+	process := func(ctx context.Context, id int, task *Task) error {
+		return errors.New("always fails")
+	}
+	policy := RestartPolicy{Strategy: OneForOne, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRestarts: 3, Window: time.Minute}
+	p, q := newTestPool(t, 1, policy, process, func(p *workerPool) {
+		p.maxAttempts = 10
+	})
+	q.Submit("a")
+
+	select {
+	case <-p.Failed():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Pool did not give up")
+	}
+	if err := p.Stop(context.Background()); err != nil {
+		t.Errorf("Stop failed: %v", err)
+	}
+	if pending, _ := q.Len(); pending != 1 {
+		t.Errorf("Expected the failing task to stay queued, got %d pending", pending)
+	}
+}
+
+func TestPoolResizesDuringRestartBackoff(t *testing.T) {
+	process := func(ctx context.Context, id int, task *Task) error {
+		return errors.New("failed")
+	}
+	policy := RestartPolicy{Strategy: OneForOne, MinBackoff: time.Hour, MaxBackoff: time.Hour, MaxRestarts: 5, Window: time.Minute}
+	p, q := newTestPool(t, 1, policy, process)
+	q.Submit("fail")
+	waitFor(t, func() bool { return p.Status()[0].State == "restarting" })
+
+	resized := make(chan error, 1)
+	go func() { resized <- p.Resize(2) }()
+	select {
+	case err := <-resized:
+		if err != nil {
+			t.Fatalf("Resize failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Resize blocked by a restart backoff")
+	}
+	// The worker waiting to restart still counts towards the size.
+	waitFor(t, func() bool { return len(p.Status()) == 2 })
+
+	if err := p.Resize(0); err != nil {
+		t.Fatalf("Resize failed: %v", err)
+	}
+	waitFor(t, func() bool { return len(p.Status()) == 0 })
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- p.Stop(context.Background()) }()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop blocked by a restart backoff")
+	}
+}
+
+func TestRestartBackoff(t *testing.T) {
+	rp := RestartPolicy{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	tests := []struct {
+		n    int
+		want time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{50, time.Second},
+	}
+	for _, tt := range tests {
+		if got := rp.backoff(tt.n); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestPoolScaleDownFinishesRunningTask(t *testing.T) {
+	release := make(chan struct{})
+	var finished atomic.Int32
+	process := func(ctx context.Context, id int, task *Task) error {
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		finished.Add(1)
+		return nil
+	}
+	p, q := newTestPool(t, 2, RestartPolicy{}, process)
+	defer p.Stop(context.Background())
+
+	q.Submit("a")
+	waitFor(t, func() bool {
+		_, running := q.Len()
+		return running == 1
+	})
+
+	if err := p.Resize(0); err != nil {
+		t.Fatalf("Resize failed: %v", err)
+	}
+	// The idle worker retires at once; the busy one waits for its task.
+	waitFor(t, func() bool { return len(p.Status()) == 1 })
+	close(release)
+	waitFor(t, func() bool { return len(p.Status()) == 0 })
+
+	if finished.Load() != 1 {
+		t.Errorf("Expected the running task to finish, got %d", finished.Load())
+	}
+	if pending, running := q.Len(); pending != 0 || running != 0 {
+		t.Errorf("Expected an empty queue, got %d pending, %d running", pending, running)
+	}
+
+	if err := p.Resize(3); err != nil {
+		t.Fatalf("Resize failed: %v", err)
+	}
+	waitFor(t, func() bool { return p.Running() == 3 })
+}
+
+func TestPoolPauseAndResume(t *testing.T) {
+	var done atomic.Int32
+	process := func(ctx context.Context, id int, task *Task) error {
+		done.Add(1)
+		return nil
+	}
+	p, q := newTestPool(t, 2, RestartPolicy{}, process)
+	defer p.Stop(context.Background())
+
+	q.Submit("a")
+	waitFor(t, func() bool { return done.Load() == 1 })
+
+	p.Pause()
+	waitFor(t, func() bool {
+		for _, ws := range p.Status() {
+			if ws.State != "paused" {
+				return false
+			}
+		}
+		return true
+	})
+	q.Submit("b")
+	time.Sleep(20 * time.Millisecond)
+	if done.Load() != 1 {
+		t.Fatal("Paused pool took a new task")
+	}
+
+	p.Resume()
+	waitFor(t, func() bool { return done.Load() == 2 })
+}
+
+func TestPoolSeparatesTimeoutsFromFailures(t *testing.T) {
+	process := func(ctx context.Context, id int, task *Task) error {
+		switch task.Payload {
+		case "slow":
+			<-ctx.Done()
+			return ctx.Err()
+		case "fail":
+			return errors.New("failed")
+		}
+		return nil
+	}
+	policy := RestartPolicy{Strategy: OneForOne, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRestarts: 5, Window: time.Minute}
+	p, q := newTestPool(t, 1, policy, process, func(p *workerPool) {
+		p.taskTimeout = 10 * time.Millisecond
+		p.maxAttempts = 2
+	})
+	defer p.Stop(context.Background())
+
+	q.Submit("slow")
+	q.Submit("ok")
+	waitFor(t, func() bool {
+		ws := p.Status()[0]
+		return ws.TimedOut == 2 && ws.Completed == 1
+	})
+	if pending, running := q.Len(); pending != 0 || running != 0 {
+		t.Errorf("Expected the slow task to be dead-lettered after 2 timeouts, got %d pending, %d running", pending, running)
+	}
+	if dead := q.DeadLetters(); len(dead) != 1 || dead[0].Payload != "slow" {
+		t.Errorf("Expected the slow task to be dead-lettered, got %+v", dead)
+	}
+
+	q.Submit("fail")
+	waitFor(t, func() bool { return p.Status()[0].Failed >= 1 })
+	if ws := p.Status()[0]; ws.TimedOut != 2 || ws.Cancelled != 0 {
+		t.Errorf("Unexpected outcome counts: %+v", ws)
+	}
+}
+
+func TestPoolCountsCancelledTasks(t *testing.T) {
+	started := make(chan struct{})
+	process := func(ctx context.Context, id int, task *Task) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	p, q := newTestPool(t, 1, RestartPolicy{}, process, func(p *workerPool) {
+		p.taskTimeout = time.Hour
+		p.drain = time.Millisecond
+	})
+
+	q.Submit("a")
+	<-started
+	if err := p.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if ws := p.Status()[0]; ws.Cancelled != 1 || ws.TimedOut != 0 {
+		t.Errorf("Expected one cancelled task, got %+v", ws)
+	}
+	if pending, _ := q.Len(); pending != 1 {
+		t.Errorf("Expected the cancelled task to be requeued, got %d pending", pending)
+	}
+}
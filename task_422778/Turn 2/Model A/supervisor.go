@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Component is a part of the service whose lifecycle is managed by a Supervisor.
+// Start must return once the component is running; Stop must return once it has
+// released its resources, or as soon as ctx is done.
+type Component interface {
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+}
+
+type registration struct {
+	name        string
+	component   Component
+	stopTimeout time.Duration
+	dependsOn   []string
+}
+
+// Supervisor starts components in dependency order and stops them in reverse order.
+type Supervisor struct {
+	stopTimeout time.Duration
+	components  map[string]*registration
+	names       []string
+	started     []*registration
+}
+
+// NewSupervisor creates a supervisor whose Stop gives up after stopTimeout overall.
+func NewSupervisor(stopTimeout time.Duration) *Supervisor {
+	return &Supervisor{
+		stopTimeout: stopTimeout,
+		components:  make(map[string]*registration),
+	}
+}
+
+// Register adds a component that is started after the components it depends on
+// and stopped before them. Stop gets at most stopTimeout for this component.
+func (s *Supervisor) Register(name string, c Component, stopTimeout time.Duration, dependsOn ...string) {
+	if _, ok := s.components[name]; !ok {
+		s.names = append(s.names, name)
+	}
+	s.components[name] = &registration{
+		name:        name,
+		component:   c,
+		stopTimeout: stopTimeout,
+		dependsOn:   dependsOn,
+	}
+}
+
+// order returns the registrations sorted so every component follows its dependencies.
+// Components without a dependency between them keep their registration order.
+func (s *Supervisor) order() ([]*registration, error) {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	var ordered []*registration
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		r, ok := s.components[name]
+		if !ok {
+			return fmt.Errorf("component %q depends on unknown component %q", path[len(path)-1], name)
+		}
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("dependency cycle: %s -> %s", strings.Join(path, " -> "), name)
+		case done:
+			return nil
+		}
+		state[name] = visiting
+		for _, dep := range r.dependsOn {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		ordered = append(ordered, r)
+		return nil
+	}
+
+	for _, name := range s.names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// Start starts every component in dependency order. If one fails to start,
+// the ones already running are stopped again and the start error is returned.
+func (s *Supervisor) Start(ctx context.Context) error {
+	ordered, err := s.order()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range ordered {
+		log.Printf("Starting %s", r.name)
+		if err := r.component.Start(ctx); err != nil {
+			startErr := fmt.Errorf("starting %s: %w", r.name, err)
+			if stopErr := s.Stop(context.Background()); stopErr != nil {
+				return errors.Join(startErr, stopErr)
+			}
+			return startErr
+		}
+		s.started = append(s.started, r)
+	}
+	return nil
+}
+
+// StopFailure describes a component that did not stop cleanly.
+type StopFailure struct {
+	Name string
+	// Err is context.DeadlineExceeded if the component did not stop in time.
+	Err error
+}
+
+// StopError lists the components that did not stop cleanly.
+type StopError struct {
+	Failures []StopFailure
+}
+
+func (e *StopError) Error() string {
+	parts := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		parts[i] = fmt.Sprintf("%s: %v", f.Name, f.Err)
+	}
+	return "components failed to stop: " + strings.Join(parts, "; ")
+}
+
+// TimedOut returns the names of the components that did not stop in time.
+func (e *StopError) TimedOut() []string {
+	var names []string
+	for _, f := range e.Failures {
+		if errors.Is(f.Err, context.DeadlineExceeded) {
+			names = append(names, f.Name)
+		}
+	}
+	return names
+}
+
+// Stop stops the started components in reverse start order. Each component gets
+// its own stop timeout, bounded by what is left of the supervisor's overall timeout
+// once the stop timeouts of the components still to stop are set aside, so a slow
+// component cannot eat into the time of those stopped after it. A component that
+// overruns is abandoned and reported in the returned *StopError.
+func (s *Supervisor) Stop(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.stopTimeout)
+	defer cancel()
+
+	var reserved time.Duration
+	for _, r := range s.started {
+		reserved += r.stopTimeout
+	}
+	var failures []StopFailure
+	for i := len(s.started) - 1; i >= 0; i-- {
+		r := s.started[i]
+		reserved -= r.stopTimeout
+		log.Printf("Stopping %s", r.name)
+		if err := stopReserving(ctx, r, reserved); err != nil {
+			log.Printf("Error stopping %s: %v", r.name, err)
+			failures = append(failures, StopFailure{Name: r.name, Err: err})
+		}
+	}
+	s.started = nil
+
+	if len(failures) > 0 {
+		return &StopError{Failures: failures}
+	}
+	return nil
+}
+
+// stopReserving stops r, leaving at least reserve of ctx for what comes after.
+func stopReserving(ctx context.Context, r *registration, reserve time.Duration) error {
+	if deadline, ok := ctx.Deadline(); ok && reserve > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline.Add(-reserve))
+		defer cancel()
+	}
+	return stopComponent(ctx, r)
+}
+
+func stopComponent(ctx context.Context, r *registration) error {
+	if r.stopTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.stopTimeout)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.component.Stop(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeComponent struct {
+	name     string
+	events   *[]string
+	mu       *sync.Mutex
+	startErr error
+	stopWait time.Duration
+}
+
+func (f *fakeComponent) record(event string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	*f.events = append(*f.events, event+" "+f.name)
+}
+
+func (f *fakeComponent) Start(ctx context.Context) error {
+	f.record("start")
+	return f.startErr
+}
+
+func (f *fakeComponent) Stop(ctx context.Context) error {
+	select {
+	case <-time.After(f.stopWait):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	f.record("stop")
+	return nil
+}
+
+func newFakes(names ...string) (map[string]*fakeComponent, *[]string) {
+	events := &[]string{}
+	mu := &sync.Mutex{}
+	fakes := make(map[string]*fakeComponent)
+	for _, name := range names {
+		fakes[name] = &fakeComponent{name: name, events: events, mu: mu}
+	}
+	return fakes, events
+}
+
+func TestSupervisorOrdersByDependency(t *testing.T) {
+	fakes, events := newFakes("http", "db", "workers")
+	s := NewSupervisor(time.Second)
+	s.Register("http", fakes["http"], 0, "workers")
+	s.Register("workers", fakes["workers"], 0, "db")
+	s.Register("db", fakes["db"], 0)
+
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	want := []string{"start db", "start workers", "start http", "stop http", "stop workers", "stop db"}
+	if len(*events) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, *events)
+	}
+	for i := range want {
+		if (*events)[i] != want[i] {
+			t.Fatalf("Expected %v, got %v", want, *events)
+		}
+	}
+}
+
+func TestSupervisorRejectsCycles(t *testing.T) {
+	fakes, _ := newFakes("a", "b")
+	s := NewSupervisor(time.Second)
+	s.Register("a", fakes["a"], 0, "b")
+	s.Register("b", fakes["b"], 0, "a")
+
+	if err := s.Start(context.Background()); err == nil {
+		t.Error("Expected an error for a dependency cycle")
+	}
+}
+
+func TestSupervisorStopsStartedOnFailure(t *testing.T) {
+	fakes, events := newFakes("a", "b")
+	fakes["b"].startErr = errors.New("boom")
+	s := NewSupervisor(time.Second)
+	s.Register("a", fakes["a"], 0)
+	s.Register("b", fakes["b"], 0, "a")
+
+	if err := s.Start(context.Background()); err == nil {
+		t.Fatal("Expected Start to fail")
+	}
+	want := []string{"start a", "start b", "stop a"}
+	if len(*events) != len(want) || (*events)[2] != want[2] {
+		t.Errorf("Expected %v, got %v", want, *events)
+	}
+}
+
+func TestSupervisorReservesTimeForLaterComponents(t *testing.T) {
+	fakes, events := newFakes("slow", "last")
+	fakes["slow"].stopWait = time.Second
+	fakes["last"].stopWait = 100 * time.Millisecond
+	s := NewSupervisor(300 * time.Millisecond)
+	s.Register("last", fakes["last"], 200*time.Millisecond)
+	s.Register("slow", fakes["slow"], time.Second, "last")
+
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	err := s.Stop(context.Background())
+
+	var stopErr *StopError
+	if !errors.As(err, &stopErr) {
+		t.Fatalf("Expected *StopError, got %v", err)
+	}
+	if timedOut := stopErr.TimedOut(); len(timedOut) != 1 || timedOut[0] != "slow" {
+		t.Errorf("Expected only slow to time out, got %v", timedOut)
+	}
+	if last := (*events)[len(*events)-1]; last != "stop last" {
+		t.Errorf("Expected last to stop within its reserved time, got %v", *events)
+	}
+}
+
+func TestSupervisorReportsStopTimeouts(t *testing.T) {
+	fakes, events := newFakes("slow", "fast")
+	fakes["slow"].stopWait = time.Second
+	s := NewSupervisor(time.Second)
+	s.Register("fast", fakes["fast"], 0)
+	s.Register("slow", fakes["slow"], 20*time.Millisecond, "fast")
+
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	err := s.Stop(context.Background())
+
+	var stopErr *StopError
+	if !errors.As(err, &stopErr) {
+		t.Fatalf("Expected *StopError, got %v", err)
+	}
+	if timedOut := stopErr.TimedOut(); len(timedOut) != 1 || timedOut[0] != "slow" {
+		t.Errorf("Expected slow to time out, got %v", timedOut)
+	}
+	if last := (*events)[len(*events)-1]; last != "stop fast" {
+		t.Errorf("Expected fast to stop after slow timed out, got %v", *events)
+	}
+}
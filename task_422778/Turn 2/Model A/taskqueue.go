@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ErrQueueClosed is returned by Next and Submit once the queue is closed.
+var ErrQueueClosed = errors.New("task queue closed")
+
+// Task is a unit of work handed to a worker.
+type Task struct {
+	ID       int    `json:"id"`
+	Payload  string `json:"payload"`
+	Attempts int    `json:"attempts"`
+}
+
+// checkpoint is the on-disk form of the queue.
+type checkpoint struct {
+	NextID int     `json:"next_id"`
+	Tasks  []*Task `json:"tasks"`
+	Dead   []*Task `json:"dead,omitempty"`
+}
+
+// TaskQueue is a FIFO of tasks that is checkpointed to a local file at shutdown
+// and reloaded on the next start, so unfinished work survives a restart.
+type TaskQueue struct {
+	path string
+
+	mu       sync.Mutex
+	pending  []*Task
+	running  map[int]*Task
+	dead     []*Task
+	nextID   int
+	closed   bool
+	loaded   bool
+	ready    chan struct{}
+	finished chan struct{}
+	stopped  chan struct{}
+}
+
+// OpenTaskQueue creates a queue and loads the tasks checkpointed at path, if any.
+// Restored tasks are queued ahead of anything submitted afterwards.
+func OpenTaskQueue(path string) (*TaskQueue, error) {
+	q := newTaskQueue(path)
+	if err := q.Load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// newTaskQueue creates a queue for the checkpoint at path without loading it.
+// Until Load, Submit and Next wait and Checkpoint leaves the file alone.
+func newTaskQueue(path string) *TaskQueue {
+	return &TaskQueue{
+		path:     path,
+		running:  make(map[int]*Task),
+		nextID:   1,
+		ready:    make(chan struct{}),
+		finished: make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// Load restores the tasks checkpointed at the queue's path, if any, and
+// starts accepting and handing out tasks.
+func (q *TaskQueue) Load() error {
+	var cp checkpoint
+	data, err := os.ReadFile(q.path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(data, &cp); err != nil {
+			return err
+		}
+		log.Printf("Restored %d tasks from %s", len(cp.Tasks), q.path)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = cp.Tasks
+	q.dead = cp.Dead
+	if cp.NextID > q.nextID {
+		q.nextID = cp.NextID
+	}
+	q.loaded = true
+	q.wake()
+	return nil
+}
+
+// Submit queues a new task with the given payload, once the queue is loaded.
+func (q *TaskQueue) Submit(payload string) (*Task, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !q.loaded && !q.closed {
+		ready := q.ready
+		q.mu.Unlock()
+		<-ready
+		q.mu.Lock()
+	}
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+	t := &Task{ID: q.nextID, Payload: payload}
+	q.nextID++
+	q.pending = append(q.pending, t)
+	q.wake()
+	return t, nil
+}
+
+// wake unblocks every Next waiting for a task. Callers hold q.mu.
+func (q *TaskQueue) wake() {
+	close(q.ready)
+	q.ready = make(chan struct{})
+}
+
+// Next blocks until a task is available and marks it as running.
+func (q *TaskQueue) Next(ctx context.Context) (*Task, error) {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return nil, ErrQueueClosed
+		}
+		if q.loaded && len(q.pending) > 0 {
+			t := q.pending[0]
+			q.pending = q.pending[1:]
+			t.Attempts++
+			q.running[t.ID] = t
+			q.mu.Unlock()
+			return t, nil
+		}
+		ready := q.ready
+		q.mu.Unlock()
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Done marks a running task as finished.
+func (q *TaskQueue) Done(t *Task) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.running, t.ID)
+	q.signalIdle()
+}
+
+// Retry moves a running task back to the front of the queue.
+func (q *TaskQueue) Retry(t *Task) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.running[t.ID]; !ok {
+		return
+	}
+	delete(q.running, t.ID)
+	q.pending = append([]*Task{t}, q.pending...)
+	q.signalIdle()
+	if !q.closed {
+		q.wake()
+	}
+}
+
+// DeadLetter takes a running task out of circulation for good. It is kept,
+// and checkpointed, so it can be inspected; see DeadLetters.
+func (q *TaskQueue) DeadLetter(t *Task) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.running[t.ID]; !ok {
+		return
+	}
+	delete(q.running, t.ID)
+	q.dead = append(q.dead, t)
+	q.signalIdle()
+}
+
+// DeadLetters returns a copy of the dead-lettered tasks, oldest first.
+func (q *TaskQueue) DeadLetters() []Task {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	tasks := make([]Task, len(q.dead))
+	for i, t := range q.dead {
+		tasks[i] = *t
+	}
+	return tasks
+}
+
+// signalIdle closes the finished channel once nothing is running. Callers hold q.mu.
+func (q *TaskQueue) signalIdle() {
+	if len(q.running) == 0 {
+		close(q.finished)
+		q.finished = make(chan struct{})
+	}
+}
+
+// Close stops handing out tasks. Running tasks can still be marked Done or Retry.
+func (q *TaskQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.wake()
+}
+
+// Drain waits until no task is running or ctx is done.
+func (q *TaskQueue) Drain(ctx context.Context) error {
+	for {
+		q.mu.Lock()
+		if len(q.running) == 0 {
+			q.mu.Unlock()
+			return nil
+		}
+		finished := q.finished
+		q.mu.Unlock()
+
+		select {
+		case <-finished:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Len returns the number of queued and running tasks.
+func (q *TaskQueue) Len() (pending, running int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending), len(q.running)
+}
+
+// Checkpoint writes every unfinished task to the queue file. Tasks still
+// running are saved as pending, in submission order, so they are retried
+// first on the next start.
+func (q *TaskQueue) Checkpoint() error {
+	q.mu.Lock()
+	if !q.loaded {
+		// Whoever wrote the file still owns the tasks in it
+		q.mu.Unlock()
+		log.Printf("Tasks never loaded, leaving %s as it is", q.path)
+		return nil
+	}
+	cp := checkpoint{NextID: q.nextID, Dead: q.dead}
+	for _, t := range q.running {
+		cp.Tasks = append(cp.Tasks, t)
+	}
+	sort.Slice(cp.Tasks, func(i, j int) bool { return cp.Tasks[i].ID < cp.Tasks[j].ID })
+	cp.Tasks = append(cp.Tasks, q.pending...)
+	data, err := json.MarshalIndent(cp, "", "  ")
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(q.path), filepath.Base(q.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), q.path); err != nil {
+		return err
+	}
+	log.Printf("Checkpointed %d tasks to %s", len(cp.Tasks), q.path)
+	return nil
+}
+
+// Start implements Component. The checkpoint is already loaded by OpenTaskQueue.
+func (q *TaskQueue) Start(ctx context.Context) error {
+	return nil
+}
+
+// Stop implements Component by closing the queue and checkpointing what is left.
+// The checkpoint is written even if ctx is done first; see Stopped.
+func (q *TaskQueue) Stop(ctx context.Context) error {
+	defer close(q.stopped)
+	q.Close()
+	return q.Checkpoint()
+}
+
+// Stopped is closed once Stop has written the final checkpoint, or failed to.
+func (q *TaskQueue) Stopped() <-chan struct{} {
+	return q.stopped
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTaskQueueCheckpointRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.json")
+	q, err := OpenTaskQueue(path)
+	if err != nil {
+		t.Fatalf("OpenTaskQueue failed: %v", err)
+	}
+
+	for _, payload := range []string{"a", "b", "c"} {
+		if _, err := q.Submit(payload); err != nil {
+			t.Fatalf("Submit failed: %v", err)
+		}
+	}
+	running, err := q.Next(context.Background())
+	if err != nil {
+		t.Fatalf("Next failed: %v", err)
+	}
+	if err := q.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	q, err = OpenTaskQueue(path)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	if pending, _ := q.Len(); pending != 3 {
+		t.Fatalf("Expected 3 restored tasks, got %d", pending)
+	}
+
+	first, _ := q.Next(context.Background())
+	if first.ID != running.ID || first.Attempts != 2 {
+		t.Errorf("Expected in-progress task %d to be retried first, got %+v", running.ID, first)
+	}
+	if next, _ := q.Submit("d"); next.ID != 4 {
+		t.Errorf("Expected new task IDs to continue at 4, got %d", next.ID)
+	}
+}
+
+func TestTaskQueueCheckpointKeepsSubmissionOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.json")
+	q, _ := OpenTaskQueue(path)
+	for i := 0; i < 10; i++ {
+		q.Submit(fmt.Sprint(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.Next(context.Background())
+	}
+	if err := q.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	q, _ = OpenTaskQueue(path)
+	for want := 1; want <= 10; want++ {
+		if got, _ := q.Next(context.Background()); got.ID != want {
+			t.Fatalf("Expected task %d next, got %d", want, got.ID)
+		}
+	}
+}
+
+func TestTaskQueueDeadLettersSurviveCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.json")
+	q, _ := OpenTaskQueue(path)
+	q.Submit("a")
+	q.Submit("b")
+	a, _ := q.Next(context.Background())
+	q.DeadLetter(a)
+	if err := q.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	q, _ = OpenTaskQueue(path)
+	if pending, _ := q.Len(); pending != 1 {
+		t.Errorf("Expected 1 restored task, got %d", pending)
+	}
+	if dead := q.DeadLetters(); len(dead) != 1 || dead[0].ID != a.ID {
+		t.Errorf("Expected task %d dead-lettered, got %+v", a.ID, dead)
+	}
+}
+
+func TestTaskQueueWaitsForLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.json")
+	prev, _ := OpenTaskQueue(path)
+	prev.Submit("a")
+
+	q := newTaskQueue(path)
+	submitted := make(chan *Task, 1)
+	go func() {
+		task, _ := q.Submit("b")
+		submitted <- task
+	}()
+	select {
+	case <-submitted:
+		t.Fatal("Submit did not wait for the checkpoint to load")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if err := prev.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	// Checkpointing an unloaded queue must not clobber the file.
+	if err := q.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	if err := q.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if task := <-submitted; task.ID != 2 {
+		t.Errorf("Expected the new task to follow the restored one, got ID %d", task.ID)
+	}
+	if first, _ := q.Next(context.Background()); first.Payload != "a" {
+		t.Errorf("Expected the restored task first, got %q", first.Payload)
+	}
+}
+
+func TestTaskQueueRetryRequeuesAtFront(t *testing.T) {
+	q, _ := OpenTaskQueue(filepath.Join(t.TempDir(), "tasks.json"))
+	q.Submit("a")
+	q.Submit("b")
+
+	a, _ := q.Next(context.Background())
+	q.Retry(a)
+
+	if again, _ := q.Next(context.Background()); again.ID != a.ID {
+		t.Errorf("Expected retried task %d first, got %d", a.ID, again.ID)
+	}
+}
+
+func TestTaskQueueNextAfterClose(t *testing.T) {
+	q, _ := OpenTaskQueue(filepath.Join(t.TempDir(), "tasks.json"))
+
+	errs := make(chan error)
+	go func() {
+		_, err := q.Next(context.Background())
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.Close()
+
+	if err := <-errs; err != ErrQueueClosed {
+		t.Errorf("Expected ErrQueueClosed, got %v", err)
+	}
+	if _, err := q.Submit("late"); err != ErrQueueClosed {
+		t.Errorf("Expected Submit to fail after Close, got %v", err)
+	}
+}
+
+func TestTaskQueueDrain(t *testing.T) {
+	q, _ := OpenTaskQueue(filepath.Join(t.TempDir(), "tasks.json"))
+	q.Submit("a")
+	task, _ := q.Next(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := q.Drain(ctx); err == nil {
+		t.Fatal("Expected Drain to time out while a task is running")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Done(task)
+	}()
+	if err := q.Drain(context.Background()); err != nil {
+		t.Errorf("Drain failed: %v", err)
+	}
+}